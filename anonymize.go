@@ -0,0 +1,181 @@
+package boomerang
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// pseudonym returns a stable pseudonym for hostname, e.g. host-3f2a9c1b7d4e. The same hostname
+// and salt always produce the same pseudonym, so diffs across runs stay meaningful.
+func pseudonym(hostname, salt string) string {
+	h := hmac.New(sha256.New, []byte(salt))
+	h.Write([]byte(hostname))
+	return "host-" + hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// AnonymizeHosts replaces hostnames in machines with pseudonyms. A machine's hostname, and its
+// jump host's, are replaced wherever they appear as a whole name in its exported fields, e.g.
+// errors, output, banners and downloaded file paths, but not as part of a longer one, e.g. db
+// in mongodb. It returns the mapping of pseudonym -> hostname.
+//
+// Each machine is rewritten in place, but its slices, maps and pointers are replaced by rewritten
+// copies, so a copy of a machine, e.g. one passed to Options.OnMachine, is left unchanged.
+func AnonymizeHosts(machines []Machine, salt string) map[string]string {
+	mapping := make(map[string]string)
+
+	for i := range machines {
+		m := &machines[i]
+		hosts := machineHosts(m)
+		if len(hosts) == 0 {
+			continue
+		}
+
+		r := &hostReplacer{}
+		for _, host := range hosts {
+			p := pseudonym(host, salt)
+			mapping[p] = host
+			r.add(host, p)
+			// e.g. the raw/<hostname>/ directory of downloads
+			if safe := SafeFileName(host); safe != host {
+				r.add(safe, p)
+			}
+		}
+		replaceStrings(reflect.ValueOf(m).Elem(), r)
+	}
+
+	return mapping
+}
+
+// machineHosts returns the hostnames of m and its jump host.
+func machineHosts(m *Machine) []string {
+	var hosts []string
+	if m.HostName != "" {
+		hosts = append(hosts, m.HostName)
+	}
+	j := m.jump
+	if j == nil && m.JumpHost != "" {
+		j, _ = parseJumpHost(m.JumpHost)
+	}
+	if j != nil {
+		if h, _, err := net.SplitHostPort(j.addr); err == nil && h != m.HostName {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// hostReplacer replaces hostnames with their pseudonyms where they appear as a whole name: not
+// preceded or followed by a character that would make it part of a longer name or address, e.g.
+// db in mongodb or db.corp, or 10.0.0.1 in 10.0.0.10. A trailing ., e.g. ending a sentence, is
+// not part of the name.
+type hostReplacer struct {
+	old, new []string // longest first, so a hostname containing another is replaced whole
+}
+
+// add replaces host with pseudonym.
+func (r *hostReplacer) add(host, pseudonym string) {
+	i := sort.Search(len(r.old), func(i int) bool { return len(r.old[i]) < len(host) })
+	r.old = append(r.old[:i], append([]string{host}, r.old[i:]...)...)
+	r.new = append(r.new[:i], append([]string{pseudonym}, r.new[i:]...)...)
+}
+
+func (r *hostReplacer) Replace(s string) string {
+	var b strings.Builder
+	last := 0
+	for i := 0; i < len(s); i++ {
+		for n, old := range r.old {
+			if !strings.HasPrefix(s[i:], old) || !hostBoundary(s, i, i+len(old), old) {
+				continue
+			}
+			b.WriteString(s[last:i])
+			b.WriteString(r.new[n])
+			last = i + len(old)
+			i = last - 1
+			break
+		}
+	}
+	if last == 0 {
+		return s
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// hostBoundary reports whether host, found at s[start:end], is a whole name.
+func hostBoundary(s string, start, end int, host string) bool {
+	// an IPv6 address continues past a :, e.g. fd00::1 in fd00::1:2
+	ipv6 := strings.Contains(host, ":")
+	inName := func(c byte) bool {
+		return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == ':' && ipv6
+	}
+	if start > 0 && (inName(s[start-1]) || s[start-1] == '.') {
+		return false
+	}
+	if end < len(s) && (inName(s[end]) || s[end] == '.' && end+1 < len(s) && inName(s[end+1])) {
+		return false
+	}
+	return true
+}
+
+// replaceStrings replaces every string reachable from v through exported fields written out,
+// pointers, interfaces, slices and maps with r. Pointers, slices and maps are replaced by
+// rewritten copies rather than modified, as they may be shared.
+func replaceStrings(v reflect.Value, r *hostReplacer) {
+	switch v.Kind() {
+	case reflect.String:
+		if v.CanSet() {
+			v.SetString(r.Replace(v.String()))
+		}
+	case reflect.Ptr:
+		if !v.IsNil() && v.CanSet() {
+			c := reflect.New(v.Elem().Type())
+			c.Elem().Set(v.Elem())
+			replaceStrings(c.Elem(), r)
+			v.Set(c)
+		}
+	case reflect.Interface:
+		// the value in an interface can't be set, it's replaced by a rewritten copy
+		if !v.IsNil() && v.CanSet() {
+			c := reflect.New(v.Elem().Type()).Elem()
+			c.Set(v.Elem())
+			replaceStrings(c, r)
+			v.Set(c)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Type().Field(i); f.IsExported() && f.Tag.Get("json") != "-" {
+				replaceStrings(v.Field(i), r)
+			}
+		}
+	case reflect.Slice:
+		if !v.IsNil() && v.CanSet() {
+			c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+			reflect.Copy(c, v)
+			for i := 0; i < c.Len(); i++ {
+				replaceStrings(c.Index(i), r)
+			}
+			v.Set(c)
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			replaceStrings(v.Index(i), r)
+		}
+	case reflect.Map:
+		if !v.IsNil() && v.CanSet() {
+			c := reflect.MakeMapWithSize(v.Type(), v.Len())
+			for _, k := range v.MapKeys() {
+				e := reflect.New(v.Type().Elem()).Elem()
+				e.Set(v.MapIndex(k))
+				replaceStrings(e, r)
+				c.SetMapIndex(k, e)
+			}
+			v.Set(c)
+		}
+	}
+}
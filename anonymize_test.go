@@ -0,0 +1,119 @@
+package boomerang
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAnonymizeHosts(t *testing.T) {
+	const host, bastion = "db1.corp.example.com", "bastion.corp.example.com"
+
+	m := Machine{
+		SSHInfo: SSHInfo{
+			HostName: host,
+			Username: "me",
+			JumpHost: "ops@" + bastion + ":2222",
+			Extras:   map[string]interface{}{"fqdn": host, "aliases": []interface{}{host}},
+		},
+		KeyFile:          "/keys/" + host,
+		Banner:           "Welcome to " + host + "\n",
+		ServerVersion:    "SSH-2.0-OpenSSH_8.9 " + host,
+		ConnectionErrors: []string{"bastion connect failed [" + bastion + ":2222]"},
+		StreamData: []Stream{{
+			Name:         "hostname",
+			Stdout:       host,
+			StreamErrors: []string{"dial tcp " + host + ":22"},
+			Transfer:     &Transfer{Local: "raw/" + host + "/app.log", Remote: "/var/log/app.log"},
+		}},
+	}
+	// an IPv6 address is written to raw/ with its colons replaced
+	m6 := Machine{
+		SSHInfo:    SSHInfo{HostName: "fd00::1"},
+		StreamData: []Stream{{Transfer: &Transfer{Local: "raw/" + SafeFileName("fd00::1") + "/app.log"}}},
+	}
+
+	machines := []Machine{m, m6}
+	mapping := AnonymizeHosts(machines, "salt")
+
+	by, err := json.Marshal(machines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, real := range []string{host, bastion, "fd00::1", SafeFileName("fd00::1")} {
+		if strings.Contains(string(by), real) {
+			t.Errorf("anonymized output contains %q: %s", real, by)
+		}
+	}
+
+	if got := machines[0].HostName; got != pseudonym(host, "salt") {
+		t.Errorf("HostName = %q, want %q", got, pseudonym(host, "salt"))
+	}
+	for _, real := range []string{host, bastion, "fd00::1"} {
+		if mapping[pseudonym(real, "salt")] != real {
+			t.Errorf("mapping is missing %q: %v", real, mapping)
+		}
+	}
+	// the pseudonym is stable across runs
+	if pseudonym(host, "salt") != pseudonym(host, "salt") || pseudonym(host, "salt") == pseudonym(host, "other") {
+		t.Error("pseudonym must depend only on hostname and salt")
+	}
+}
+
+func TestAnonymizeHostsWholeNames(t *testing.T) {
+	tests := []struct {
+		name, host, in string
+		replaced       bool
+	}{
+		{"alone", "db", "db", true},
+		{"in a longer name", "db", "mongodb", false},
+		{"prefix of a name", "db", "db-1", false},
+		{"subdomain", "db", "db.corp", false},
+		{"with port", "db", "db:22", true},
+		{"ending a sentence", "db", "connect to db.", true},
+		{"in a path", "db", "raw/db/app.log", true},
+		{"in brackets", "db", "connect failed [db]", true},
+		{"ip", "10.0.0.1", "dial tcp 10.0.0.1:22", true},
+		{"ip prefix", "10.0.0.1", "10.0.0.10", false},
+		{"ip suffix", "10.0.0.1", "110.0.0.1", false},
+		{"ipv6", "fd00::1", "[fd00::1]:22", true},
+		{"ipv6 prefix", "fd00::1", "fd00::10", false},
+		{"ipv6 longer", "fd00::1", "fd00::1:2", false},
+	}
+	for _, tt := range tests {
+		ms := []Machine{{SSHInfo: SSHInfo{HostName: tt.host}, Banner: tt.in}}
+		AnonymizeHosts(ms, "salt")
+		got := ms[0].Banner
+		if tt.replaced && !strings.Contains(got, pseudonym(tt.host, "salt")) {
+			t.Errorf("%s: %q -> %q, want %s replaced", tt.name, tt.in, got, tt.host)
+		}
+		if !tt.replaced && got != tt.in {
+			t.Errorf("%s: %q -> %q, want unchanged", tt.name, tt.in, got)
+		}
+	}
+}
+
+func TestAnonymizeHostsCopy(t *testing.T) {
+	const host = "db1.corp.example.com"
+	m := Machine{
+		SSHInfo:    SSHInfo{HostName: host, Extras: map[string]interface{}{"fqdn": host}},
+		StreamData: []Stream{{Stdout: host, Transfer: &Transfer{Local: "raw/" + host + "/app.log"}}},
+	}
+
+	// a copy shares StreamData and Extras with m, e.g. the machine passed to OnMachine
+	ms := []Machine{m}
+	AnonymizeHosts(ms, "salt")
+
+	if ms[0].StreamData[0].Stdout == host || ms[0].Extras["fqdn"] == host {
+		t.Fatalf("copy not anonymized: %+v", ms[0])
+	}
+	if m.StreamData[0].Stdout != host {
+		t.Errorf("StreamData modified through the copy: %q", m.StreamData[0].Stdout)
+	}
+	if m.StreamData[0].Transfer.Local != "raw/"+host+"/app.log" {
+		t.Errorf("Transfer modified through the copy: %q", m.StreamData[0].Transfer.Local)
+	}
+	if m.Extras["fqdn"] != host {
+		t.Errorf("Extras modified through the copy: %v", m.Extras["fqdn"])
+	}
+}
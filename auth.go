@@ -0,0 +1,851 @@
+package boomerang
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// authSource is a configured auth method. It's turned into an ssh.AuthMethod for each connection,
+// so the method the server accepted can be recorded.
+type authSource struct {
+	name     string                       // key, cert, agent or password
+	signers  func() ([]ssh.Signer, error) // key, cert and agent, nil for a key not yet known
+	password string
+	keyFile  string // the private key when name=key or cert
+}
+
+// authMethods returns sources as ssh.AuthMethods, in order. The client tries each type of auth
+// method only once, so key and agent are merged into a single public key method, their keys
+// offered in the order listed. tried, if non-nil, is called with a source's name when it's used:
+// for key and agent when a key the server accepted signs, for password when it's sent.
+func authMethods(sources []authSource, tried func(string)) []ssh.AuthMethod {
+	var keys []authSource
+	for _, a := range sources {
+		if a.name != "password" {
+			keys = append(keys, a)
+		}
+	}
+
+	var methods []ssh.AuthMethod
+	var keysAdded bool
+	for _, a := range sources {
+		if a.name != "password" {
+			if !keysAdded {
+				methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+					return trackedSigners(keys, tried)
+				}))
+				keysAdded = true
+			}
+			continue
+		}
+
+		password := a.password
+		methods = append(methods, ssh.PasswordCallback(func() (string, error) {
+			if tried != nil {
+				tried("password")
+			}
+			return password, nil
+		}))
+	}
+	return methods
+}
+
+// trackedSigners returns the signers of keys, wrapped to call tried when they sign. A source
+// failing, e.g. an agent that went away, is skipped unless none are left.
+func trackedSigners(keys []authSource, tried func(string)) ([]ssh.Signer, error) {
+	var out []ssh.Signer
+	var lastErr error
+	for _, k := range keys {
+		ss, err := k.signers()
+		if err != nil {
+			lastErr = errors.Wrapf(err, "%s auth", k.name)
+			continue
+		}
+		for _, s := range ss {
+			if tried != nil {
+				s = trackSigner(s, k.name, tried)
+			}
+			out = append(out, s)
+		}
+	}
+	if len(out) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return out, nil
+}
+
+// trackSigner wraps s to call tried with name when it signs. The client only signs with a key
+// the server accepted. The optional interfaces the client uses to pick a signature algorithm,
+// e.g. rsa-sha2-256 over ssh-rsa, are kept.
+func trackSigner(s ssh.Signer, name string, tried func(string)) ssh.Signer {
+	t := trackedSigner{Signer: s, used: func() { tried(name) }}
+	as, ok := s.(ssh.AlgorithmSigner)
+	if !ok {
+		return t
+	}
+	ta := trackedAlgorithmSigner{trackedSigner: t, as: as}
+	if ms, ok := s.(ssh.MultiAlgorithmSigner); ok {
+		return trackedMultiAlgorithmSigner{trackedAlgorithmSigner: ta, algorithms: ms.Algorithms}
+	}
+	return ta
+}
+
+type trackedSigner struct {
+	ssh.Signer
+	used func()
+}
+
+func (t trackedSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	t.used()
+	return t.Signer.Sign(rand, data)
+}
+
+type trackedAlgorithmSigner struct {
+	trackedSigner
+	as ssh.AlgorithmSigner
+}
+
+func (t trackedAlgorithmSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	t.used()
+	return t.as.SignWithAlgorithm(rand, data, algorithm)
+}
+
+type trackedMultiAlgorithmSigner struct {
+	trackedAlgorithmSigner
+	algorithms func() []string
+}
+
+func (t trackedMultiAlgorithmSigner) Algorithms() []string { return t.algorithms() }
+
+// keySource returns a key auth source for signer, read from file.
+func keySource(signer ssh.Signer, file string) authSource {
+	return authSource{
+		name:    "key",
+		signers: func() ([]ssh.Signer, error) { return []ssh.Signer{signer}, nil },
+		keyFile: file,
+	}
+}
+
+// certSource returns a cert auth source for signer, a certificate signer, read from file. The
+// certificate is checked on every connection, so a run outlasting a short-lived certificate
+// fails clearly rather than as a rejected key.
+func certSource(signer ssh.Signer, file string) authSource {
+	return authSource{
+		name: "cert",
+		signers: func() ([]ssh.Signer, error) {
+			if err := checkCert(signer.PublicKey().(*ssh.Certificate), time.Now()); err != nil {
+				return nil, err
+			}
+			return []ssh.Signer{signer}, nil
+		},
+		keyFile: file,
+	}
+}
+
+// certFile returns the certificate for the private key keyFile, cert if set, otherwise
+// <keyFile>-cert.pub as written by ssh-keygen -s.
+func certFile(keyFile, cert string) string {
+	if cert != "" {
+		return cert
+	}
+	return keyFile + "-cert.pub"
+}
+
+// getCertSigner returns a signer for the private key in keyFile presenting the OpenSSH user
+// certificate in certFile, e.g. id_ed25519-cert.pub. The certificate must be for the key and
+// currently valid.
+func getCertSigner(keyFile, certFile string) (ssh.Signer, error) {
+	signer, err := getPrivKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return certSigner(signer, certFile)
+}
+
+// certSigner returns signer presenting the OpenSSH user certificate in certFile.
+func certSigner(signer ssh.Signer, certFile string) (ssh.Signer, error) {
+	b, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read certificate")
+	}
+
+	// a -cert.pub file is in authorized_keys format, the wire format after the key type
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse certificate: %s", certFile)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.Errorf("not a certificate: %s is a %s public key", certFile, pub.Type())
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, errors.Errorf("not a user certificate: %s", certFile)
+	}
+	if err := checkCert(cert, time.Now()); err != nil {
+		return nil, errors.Wrap(err, certFile)
+	}
+
+	s, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, errors.Wrapf(err, "certificate %s does not match the private key", certFile)
+	}
+	return s, nil
+}
+
+// checkCert returns an error if cert is not valid at now, e.g. a short-lived certificate that
+// has expired. The server makes the same check, but only reports the key as rejected.
+func checkCert(cert *ssh.Certificate, now time.Time) error {
+	unix := uint64(now.Unix())
+	if cert.ValidAfter != 0 && unix < cert.ValidAfter {
+		return errors.Errorf("certificate %s is not valid until %s", cert.KeyId, time.Unix(int64(cert.ValidAfter), 0).Format(time.RFC3339))
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && unix >= cert.ValidBefore {
+		return errors.Errorf("certificate %s expired at %s", cert.KeyId, time.Unix(int64(cert.ValidBefore), 0).Format(time.RFC3339))
+	}
+	return nil
+}
+
+// authTracker records the auth method used, see authMethods. Once connected, the last one
+// used is the one that succeeded.
+type authTracker struct {
+	mu   sync.Mutex
+	last string
+}
+
+func (t *authTracker) tried(name string) {
+	t.mu.Lock()
+	t.last = name
+	t.mu.Unlock()
+}
+
+func (t *authTracker) used() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.last
+}
+
+// setAuth accepts auth options and attempts converts auth to an authSource.
+// Supports key, cert, agent or password.
+// If using auth=key must supply privKeyLocation,
+// If using auth=cert must supply privKeyLocation, the cert defaults to <privKeyLocation>-cert.pub,
+// If using auth=password must supply password.
+// if using auth=agent, must supply the env variable holding the agent socket, e.g. SSH_AUTH_SOCK.
+func setAuth(a authOpt) (authSource, error) {
+
+	switch a.auth {
+	case "key":
+		// check existence of private key in config file
+		pk := a.key
+		if pk == "" {
+			return authSource{}, errors.New("must include privKeyLocation when auth=key")
+		}
+
+		signer, err := getPrivKey(pk) // get private key
+		if err != nil {
+			return authSource{}, errors.Wrapf(err, "could not convert private key to a valid signer: %s", pk)
+		}
+
+		return keySource(signer, pk), nil
+
+	case "cert":
+		pk := a.key
+		if pk == "" {
+			return authSource{}, errors.New("must include privKeyLocation when auth=cert")
+		}
+
+		signer, err := getCertSigner(pk, certFile(pk, a.cert))
+		if err != nil {
+			return authSource{}, errors.Wrapf(err, "could not convert certificate to a valid signer: %s", pk)
+		}
+
+		return certSource(signer, pk), nil
+
+	case "agent":
+		auth, err := sshAgent(a.agent)
+		if err != nil {
+			return authSource{}, errors.Wrapf(err, "could not convert agent into a valid auth method: %s", a.agent)
+		}
+		return auth, nil
+
+	case "password":
+		if a.pass == "" {
+			return authSource{}, errors.New("must include a password when auth=password")
+		}
+
+		return authSource{name: "password", password: a.pass}, nil
+
+	default:
+		return authSource{}, errors.Errorf("unsupported auth method: %v\n\tmust use key, cert, agent or password", a.auth)
+	}
+
+}
+
+type authOpt struct {
+	auth  string
+	key   string
+	cert  string
+	pass  string
+	agent string
+}
+
+// authSources returns a's methods as auth sources, in the order they're tried. With several
+// methods, one missing what it needs, e.g. a password, is skipped with a warning; a single method
+// must be usable.
+func authSources(a Auth) ([]authSource, error) {
+	if len(a.Methods) == 0 {
+		return nil, errors.New("missing valid auth option. Available options: key, cert, agent or password")
+	}
+
+	var sources []authSource
+	for _, m := range a.Methods {
+		switch m {
+		case "key", "cert", "agent", "password":
+		default:
+			return nil, errors.Errorf("unsupported auth method: %v\n\tmust use key, cert, agent or password", m)
+		}
+
+		// with a KeyDir, the global key is only a fallback and may be omitted
+		if m == "key" && a.PrivateKey == "" && a.KeyDir != "" {
+			sources = append(sources, authSource{name: "key"})
+			continue
+		}
+
+		s, err := setAuth(authOpt{
+			auth:  m,
+			key:   a.PrivateKey,
+			cert:  a.Certificate,
+			pass:  a.Password,
+			agent: a.Agent,
+		})
+		if err != nil {
+			if len(a.Methods) == 1 {
+				return nil, err
+			}
+			log.Printf("Skipping auth %s: %v\n", m, err)
+			continue
+		}
+		sources = append(sources, s)
+	}
+	if len(sources) == 0 {
+		return nil, errors.New("none of the auth methods listed can be used")
+	}
+	return sources, nil
+}
+
+// keyCache lazily parses private keys and caches the resulting signers by file path,
+// so a key shared by many machines is only read and parsed once.
+type keyCache struct {
+	mu      sync.Mutex
+	signers map[string]ssh.Signer
+}
+
+func newKeyCache() *keyCache {
+	return &keyCache{signers: make(map[string]ssh.Signer)}
+}
+
+func (k *keyCache) signer(file string) (ssh.Signer, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if s, ok := k.signers[file]; ok {
+		return s, nil
+	}
+	s, err := getPrivKey(file)
+	if err != nil {
+		return nil, err
+	}
+	k.signers[file] = s
+	return s, nil
+}
+
+// machineAuth returns the auth methods for a machine, in the order they're tried, and the
+// private key file used, if any. tried is called as described in authMethods.
+//
+// A machine's own auth, key_location, cert_location or password in the inventory overrides the
+// global auth. Otherwise, if keyDir is set, <keyDir>/<hostname> (or <keyDir>/<extras.key_name>) is
+// used as the machine's private key. When no such file exists it falls back to the global
+// privKeyLocation, and without that key auth is skipped for the machine if other auth methods are
+// configured.
+func (s *runState) machineAuth(m *Machine, tried func(string)) ([]ssh.AuthMethod, string, error) {
+	if m.Auth != "" || m.KeyLocation != "" || m.CertLocation != "" || m.password != "" {
+		a, err := s.overrideAuth(m)
+		if err != nil {
+			return nil, a.keyFile, err
+		}
+		return authMethods([]authSource{a}, tried), a.keyFile, nil
+	}
+
+	var sources []authSource
+	var keyFile string
+	for _, a := range s.auth {
+		if a.name == "key" {
+			var err error
+			if a, err = s.machineKey(m, a); err != nil {
+				return nil, a.keyFile, err
+			}
+			if a.signers == nil {
+				continue
+			}
+			keyFile = a.keyFile
+		}
+		if a.name == "cert" {
+			keyFile = a.keyFile
+		}
+		sources = append(sources, a)
+	}
+
+	if len(sources) == 0 {
+		return nil, "", errors.Errorf("no private key for [%v] in %s and no PrivateKey to fall back to", m.HostName, s.Auth.KeyDir)
+	}
+	return authMethods(sources, tried), keyFile, nil
+}
+
+// machineKey returns the machine's key in keyDir, if any, otherwise fallback, the global key.
+func (s *runState) machineKey(m *Machine, fallback authSource) (authSource, error) {
+	if s.Auth.KeyDir == "" {
+		return fallback, nil
+	}
+
+	name := m.HostName
+	if n, ok := m.Extras["key_name"].(string); ok && n != "" {
+		name = n
+	}
+	file := filepath.Join(s.Auth.KeyDir, name)
+	if !fileExists(file) {
+		return fallback, nil
+	}
+
+	signer, err := s.keys.signer(file)
+	if err != nil {
+		return authSource{keyFile: file}, errors.Wrapf(err, "could not convert private key to a valid signer: %s", file)
+	}
+	return keySource(signer, file), nil
+}
+
+// overrideAuth returns the auth method set on the machine itself. auth may be omitted when it's
+// implied by key_location, cert_location or password. Keys are parsed once per path and shared
+// across machines.
+func (s *runState) overrideAuth(m *Machine) (authSource, error) {
+	auth := m.Auth
+	if auth == "" {
+		auth = "password"
+		if m.KeyLocation != "" {
+			auth = "key"
+		}
+		if m.CertLocation != "" {
+			auth = "cert"
+		}
+	}
+
+	switch auth {
+	case "key":
+		if m.KeyLocation == "" {
+			return authSource{}, errors.New("must include key_location when machine auth=key")
+		}
+		signer, err := s.keys.signer(m.KeyLocation)
+		if err != nil {
+			return authSource{keyFile: m.KeyLocation}, errors.Wrapf(err, "could not convert private key to a valid signer: %s", m.KeyLocation)
+		}
+		return keySource(signer, m.KeyLocation), nil
+
+	case "cert":
+		if m.KeyLocation == "" {
+			return authSource{}, errors.New("must include key_location when machine auth=cert")
+		}
+		key, err := s.keys.signer(m.KeyLocation)
+		if err != nil {
+			return authSource{keyFile: m.KeyLocation}, errors.Wrapf(err, "could not convert private key to a valid signer: %s", m.KeyLocation)
+		}
+		signer, err := certSigner(key, certFile(m.KeyLocation, m.CertLocation))
+		if err != nil {
+			return authSource{keyFile: m.KeyLocation}, errors.Wrapf(err, "could not convert certificate to a valid signer: %s", m.KeyLocation)
+		}
+		return certSource(signer, m.KeyLocation), nil
+
+	case "password":
+		if m.password == "" {
+			return authSource{}, errors.New("must include password when machine auth=password")
+		}
+		return authSource{name: "password", password: m.password}, nil
+
+	case "agent":
+		for _, a := range s.auth {
+			if a.name == "agent" {
+				return a, nil
+			}
+		}
+		a, err := sshAgent(s.Auth.Agent)
+		if err != nil {
+			return authSource{}, errors.Wrapf(err, "could not convert agent into a valid auth method: %s", s.Auth.Agent)
+		}
+		return a, nil
+
+	default:
+		return authSource{}, errors.Errorf("unsupported machine auth method: %v\n\tmust use key, cert, agent or password", m.Auth)
+	}
+}
+
+// sshAgent returns an agent auth source for the agent whose socket is in the env variable s.
+// The agent is connected to once and shared by every machine, see sharedAgent.
+func sshAgent(s string) (authSource, error) {
+	a := agents.get(s)
+
+	// A Signer can create signatures that verify against a public key.
+	ss, err := a.signers()
+	if err != nil {
+		return authSource{}, err
+	}
+
+	// If ss is empty program cannot access the necessary keys,
+	// user may need to run ssh-add and authenticate (if key is passphrase-protected)
+	if len(ss) == 0 {
+		return authSource{}, errors.Errorf("unable to authenticate agent using [%v]. Either key not loaded or has passphrase, confirm with ssh-add -l and load with ssh-add", s)
+	}
+
+	return authSource{name: "agent", signers: a.signers}, nil
+}
+
+// agents are the agents connected to, by socket env variable.
+var agents = &agentCache{agents: make(map[string]*sharedAgent)}
+
+type agentCache struct {
+	mu     sync.Mutex
+	agents map[string]*sharedAgent
+}
+
+func (c *agentCache) get(env string) *sharedAgent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a, ok := c.agents[env]
+	if !ok {
+		a = &sharedAgent{env: env}
+		c.agents[env] = a
+	}
+	return a
+}
+
+// sharedAgent is a single connection to an agent, shared by every machine, so connecting to
+// thousands of machines doesn't open thousands of agent connections. Its keys are listed once and
+// reused. The agent client serializes requests over the connection. If the connection fails,
+// e.g. the agent restarted, it's reconnected and the keys listed again, see agentSigner.
+type sharedAgent struct {
+	env string // e.g. SSH_AUTH_SOCK
+
+	mu   sync.Mutex
+	conn *agentConn
+	keys []ssh.Signer
+}
+
+func (a *sharedAgent) signers() ([]ssh.Signer, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.conn != nil && !a.conn.failed.Load() {
+		return a.keys, nil
+	}
+	if a.conn != nil {
+		a.conn.Close()
+		a.conn, a.keys = nil, nil
+	}
+
+	conn, err := net.Dial("unix", os.Getenv(a.env))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not get %s from env", a.env)
+	}
+	c := &agentConn{Conn: conn}
+	ss, err := agent.NewClient(c).Signers()
+	if err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "signer failed")
+	}
+	for i, s := range ss {
+		if as, ok := s.(ssh.AlgorithmSigner); ok {
+			ss[i] = agentSigner{AlgorithmSigner: as, a: a, conn: c}
+		}
+	}
+	a.conn, a.keys = c, ss
+	return ss, nil
+}
+
+// signer returns the agent's key for pub, reconnecting if the connection failed.
+func (a *sharedAgent) signer(pub ssh.PublicKey) (ssh.AlgorithmSigner, error) {
+	ss, err := a.signers()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range ss {
+		if as, ok := s.(agentSigner); ok && bytes.Equal(s.PublicKey().Marshal(), pub.Marshal()) {
+			return as.AlgorithmSigner, nil
+		}
+	}
+	return nil, errors.Errorf("key %s is no longer in the agent", ssh.FingerprintSHA256(pub))
+}
+
+// agentSigner is a key in a sharedAgent. A signature failing because the agent connection
+// failed, e.g. the agent restarted while machines were connecting, is retried once over a
+// new connection.
+type agentSigner struct {
+	ssh.AlgorithmSigner
+	a    *sharedAgent
+	conn *agentConn // the connection the key was listed on
+}
+
+func (s agentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+func (s agentSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	sig, err := s.AlgorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+	if err == nil || !s.conn.failed.Load() {
+		return sig, err
+	}
+	fresh, ferr := s.a.signer(s.PublicKey())
+	if ferr != nil {
+		return nil, errors.Wrapf(err, "reconnecting to agent: %v", ferr)
+	}
+	return fresh.SignWithAlgorithm(rand, data, algorithm)
+}
+
+// agentConn records an error reading or writing the agent socket, after which it's replaced.
+type agentConn struct {
+	net.Conn
+	failed atomic.Bool
+}
+
+func (c *agentConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err != nil {
+		c.failed.Store(true)
+	}
+	return n, err
+}
+
+func (c *agentConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if err != nil {
+		c.failed.Store(true)
+	}
+	return n, err
+}
+
+func getPrivKey(pkFile string) (ssh.Signer, error) {
+	// A public key may be used to authenticate against the remote
+	// server by using an unencrypted PEM-encoded private key file.
+	b, err := ioutil.ReadFile(pkFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read private key")
+	}
+
+	// Create the Signer for this private key.
+	s, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse private key to a Signer")
+	}
+
+	return s, nil
+}
+
+// Host key modes, set with Options.HostKeyMode.
+const (
+	HostKeyStrict   = "strict"   // hosts must be in known_hosts
+	HostKeyInsecure = "insecure" // host keys are not checked
+	HostKeyTOFU     = "tofu"     // hosts missing from known_hosts are trusted and added
+)
+
+// hostKeyCallback returns the host key check for host:port according to s.HostKeyMode, and the
+// host key algorithms to negotiate, see knownAlgorithms.
+func (s *runState) hostKeyCallback(host, port string) (ssh.HostKeyCallback, []string, error) {
+	switch s.HostKeyMode {
+	case HostKeyInsecure:
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	}
+
+	files := s.KnownHosts
+	if len(files) == 0 {
+		files = defaultKnownHosts()
+	}
+	if s.HostKeyMode == HostKeyTOFU {
+		return trustOnFirstUse(files, host, port)
+	}
+	return checkHostKey(files, host, port)
+}
+
+// fingerprintCallback returns a host key check that the host key has the SHA256 fingerprint
+// want, as printed by ssh-keygen -lf, with or without the SHA256: prefix. No host key
+// algorithms are returned, the server's preferred key is checked.
+func fingerprintCallback(want string) (ssh.HostKeyCallback, []string, error) {
+	if i := strings.Index(want, ":"); i >= 0 && !strings.HasPrefix(want, "SHA256:") {
+		return nil, nil, errors.Errorf("unsupported host_key_fingerprint [%v], only SHA256 fingerprints are supported", want)
+	}
+	// ssh.FingerprintSHA256 is unpadded base64
+	want = "SHA256:" + strings.TrimRight(strings.TrimPrefix(want, "SHA256:"), "=")
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if got := ssh.FingerprintSHA256(key); got != want {
+			return errors.Errorf("host key fingerprint mismatch, possible MITM: %s presented %s %s, expecting %s", hostname, key.Type(), got, want)
+		}
+		return nil
+	}, nil, nil
+}
+
+// defaultKnownHosts are the known_hosts files host keys are checked against when knownHosts
+// is not set, the user's then the system's.
+func defaultKnownHosts() []string {
+	return []string{filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts"), "/etc/ssh/ssh_known_hosts"}
+}
+
+// existingFiles returns the files that exist. knownhosts fails on a missing file, but it's
+// common for only one of the user's or system's known_hosts to exist.
+func existingFiles(files []string) []string {
+	var out []string
+	for _, f := range files {
+		if fileExists(f) {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// checkHostKey returns a callback verifying the host key presented by host:port against
+// files, known_hosts files, a key in any of them being accepted. Missing files are skipped, but
+// at least one must exist. Parsing is left to the knownhosts package, which handles hashed hosts,
+// @cert-authority and @revoked markers, comments and multiple keys per host.
+//
+// Hosts are looked up as known_hosts writes them: bare on port 22, otherwise bracketed with the
+// port, e.g. [::1]:2222.
+func checkHostKey(files []string, host, port string) (ssh.HostKeyCallback, []string, error) {
+	existing := existingFiles(files)
+	if len(existing) == 0 {
+		return nil, nil, errors.Errorf("none of the known_hosts files exist: %s", strings.Join(files, ", "))
+	}
+
+	cb, err := knownhosts.New(existing...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := cb(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+		if ke, ok := err.(*knownhosts.KeyError); ok && len(ke.Want) == 0 {
+			err = errors.New("no hostkey")
+		}
+		return errors.Wrapf(err, "[%v]", knownhosts.Normalize(net.JoinHostPort(host, port)))
+	}, knownAlgorithms(cb, host, port), nil
+}
+
+// placeholderKey is a key in no known_hosts file.
+var placeholderKey, _ = ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+
+// knownAlgorithms returns the algorithms of the host keys cb knows for host:port, in known_hosts
+// order, for ssh.ClientConfig.HostKeyAlgorithms. A host commonly has several keys, e.g. rsa and
+// ed25519, and without this the server may present one of a type that isn't in known_hosts and
+// fail as a mismatch. nil means no keys are known and any algorithm is negotiated.
+func knownAlgorithms(cb ssh.HostKeyCallback, host, port string) []string {
+	// checking a key that isn't known lists the keys that are
+	err := cb(net.JoinHostPort(host, port), &net.TCPAddr{IP: net.IPv4zero}, placeholderKey)
+	ke, ok := err.(*knownhosts.KeyError)
+	if !ok {
+		return nil
+	}
+
+	var algos []string
+	seen := make(map[string]bool)
+	for _, k := range ke.Want {
+		as := []string{k.Key.Type()}
+		// an rsa key can sign with any of these, the server picks from those it supports
+		if k.Key.Type() == ssh.KeyAlgoRSA {
+			as = []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+		}
+		for _, a := range as {
+			if !seen[a] {
+				seen[a] = true
+				algos = append(algos, a)
+			}
+		}
+	}
+	return algos
+}
+
+// knownHostsMu serializes reading and appending to known_hosts in tofu mode, as machines are
+// connected to concurrently.
+var knownHostsMu sync.Mutex
+
+// trustOnFirstUse returns a callback like checkHostKey, except that a host missing from all of
+// files is trusted and the key it presented appended to the first file, which is created if
+// absent. A host in any of files presenting a different key still fails.
+func trustOnFirstUse(files []string, host, port string) (ssh.HostKeyCallback, []string, error) {
+	file := files[0]
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return nil, nil, err
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	f.Close()
+
+	addr := knownhosts.Normalize(net.JoinHostPort(host, port))
+
+	// a known host must present a key of a known type, as with checkHostKey
+	known, err := knownhosts.New(existingFiles(files)...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		knownHostsMu.Lock()
+		defer knownHostsMu.Unlock()
+
+		// read on every check, the host may have just been added while connecting to another
+		// machine, or by a retry
+		cb, err := knownhosts.New(existingFiles(files)...)
+		if err != nil {
+			return err
+		}
+		err = cb(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+		ke, ok := err.(*knownhosts.KeyError)
+		if !ok {
+			// e.g. a revoked key
+			return errors.Wrapf(err, "[%v]", addr)
+		}
+		if len(ke.Want) > 0 {
+			return errors.Wrapf(err, "[%v] host key mismatch, possible MITM", addr)
+		}
+
+		f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return errors.Wrapf(err, "[%v] could not add host key", addr)
+		}
+		if _, err := fmt.Fprintln(f, knownhosts.Line([]string{addr}, key)); err != nil {
+			f.Close()
+			return errors.Wrapf(err, "[%v] could not add host key", addr)
+		}
+		if err := f.Close(); err != nil {
+			return errors.Wrapf(err, "[%v] could not add host key", addr)
+		}
+		log.Printf("Added host key for [%v] to %s (%s)\n", addr, file, ssh.FingerprintSHA256(key))
+		return nil
+	}, knownAlgorithms(known, host, port), nil
+}
@@ -0,0 +1,525 @@
+package boomerang
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// writeKey writes a new private key to file and returns its signer.
+func writeKey(t *testing.T, file string) ssh.Signer {
+	t.Helper()
+	_, pk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(pk, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestRunCertAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := writeKey(t, filepath.Join(dir, "ca"))
+	other := writeKey(t, filepath.Join(dir, "other_ca"))
+
+	// the server only accepts certificates signed by ca
+	s := startFakeSSH(t, &fakeSSH{config: func(cfg *ssh.ServerConfig) {
+		cfg.PasswordCallback = nil
+		checker := &ssh.CertChecker{IsUserAuthority: func(k ssh.PublicKey) bool {
+			return bytes.Equal(k.Marshal(), ca.PublicKey().Marshal())
+		}}
+		cfg.PublicKeyCallback = checker.Authenticate
+	}})
+
+	tests := []struct {
+		name        string
+		method      string
+		signedBy    ssh.Signer // nil writes no certificate
+		wantConnect bool
+	}{
+		{"signed by the ca", "cert", ca, true},
+		{"signed by another ca", "cert", other, false},
+		{"key without a certificate", "key", nil, false},
+	}
+	for i, tt := range tests {
+		key := filepath.Join(dir, fmt.Sprintf("id_%d", i))
+		user := writeKey(t, key)
+		if tt.signedBy != nil {
+			cert := &ssh.Certificate{
+				Key:             user.PublicKey(),
+				CertType:        ssh.UserCert,
+				KeyId:           "u",
+				ValidPrincipals: []string{"u"},
+				ValidBefore:     ssh.CertTimeInfinity,
+			}
+			if err := cert.SignCert(rand.Reader, tt.signedBy); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(key+"-cert.pub", ssh.MarshalAuthorizedKey(cert), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		b, err := Run(context.Background(), Options{
+			Inventory:   Inventory{{HostName: s.host, Port: s.port, Username: "u"}},
+			Commands:    []Command{{Name: "echo", Command: "echo hello"}},
+			Auth:        Auth{Methods: []string{tt.method}, PrivateKey: key},
+			HostKeyMode: HostKeyInsecure,
+			DownloadDir: t.TempDir(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := b.MachineData[0]
+		if m.Connection != tt.wantConnect {
+			t.Errorf("%s: connection %v, want %v: %v", tt.name, m.Connection, tt.wantConnect, m.ConnectionErrors)
+		}
+		if tt.wantConnect && m.AuthMethod != "cert" {
+			t.Errorf("%s: auth method %q, want cert", tt.name, m.AuthMethod)
+		}
+	}
+}
+
+func TestCheckHostKeyHashed(t *testing.T) {
+	key, other := newHostKey(t), newHostKey(t)
+
+	// hosts are hashed as ssh-keygen -H writes them, the port bracketed unless 22
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	lines := []string{
+		knownhosts.Line([]string{knownhosts.HashHostname("web1")}, key),
+		knownhosts.Line([]string{knownhosts.HashHostname("[web2]:2222")}, key),
+		knownhosts.Line([]string{knownhosts.HashHostname("10.0.0.1")}, key),
+	}
+	if err := os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host, port string
+		key        ssh.PublicKey
+		wantErr    string // empty if the key is accepted
+	}{
+		{"web1", "22", key, ""},
+		{"web1", "22", other, "key mismatch"},
+		{"web2", "2222", key, ""},
+		{"web2", "22", key, "no hostkey"},
+		{"web3", "22", key, "no hostkey"},
+		{"10.0.0.1", "22", key, ""},
+		// a host the known one is a prefix of is not matched
+		{"10.0.0.10", "22", key, "no hostkey"},
+	}
+	for _, tt := range tests {
+		cb, algos, err := checkHostKey([]string{file}, tt.host, tt.port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := net.JoinHostPort(tt.host, tt.port)
+		err = cb(addr, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1)}, tt.key)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: %v, want the key accepted", addr, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: error %v, want %q", addr, err, tt.wantErr)
+		}
+		// the algorithms of known keys are negotiated, any if none are known
+		if wantAlgos := tt.wantErr != "no hostkey"; (len(algos) > 0) != wantAlgos {
+			t.Errorf("%s: algorithms %v, want known: %v", addr, algos, wantAlgos)
+		}
+	}
+}
+
+func TestCheckHostKeyMissingFiles(t *testing.T) {
+	dir := t.TempDir()
+	if _, _, err := checkHostKey([]string{filepath.Join(dir, "a"), filepath.Join(dir, "b")}, "web1", "22"); err == nil {
+		t.Error("no known_hosts files exist, want an error")
+	}
+}
+
+func TestCheckHostKeyFiles(t *testing.T) {
+	key, other := newHostKey(t), newHostKey(t)
+
+	// web1 is only in the second file, e.g. the system's known_hosts
+	dir := t.TempDir()
+	user, system := filepath.Join(dir, "known_hosts"), filepath.Join(dir, "ssh_known_hosts")
+	if err := os.WriteFile(user, []byte(knownhosts.Line([]string{"web2"}, other)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(system, []byte(knownhosts.Line([]string{"web1"}, key)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		files   []string
+		key     ssh.PublicKey
+		wantErr string // empty if the key is accepted
+	}{
+		{[]string{user, system}, key, ""},
+		{[]string{user, system}, other, "key mismatch"},
+		{[]string{filepath.Join(dir, "missing"), system}, key, ""},
+		{[]string{user}, key, "no hostkey"},
+	}
+	for _, tt := range tests {
+		cb, _, err := checkHostKey(tt.files, "web1", "22")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = cb("web1:22", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1)}, tt.key)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%v: %v, want the key accepted", tt.files, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%v: error %v, want %q", tt.files, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckHostKeyIPv6(t *testing.T) {
+	key := newHostKey(t)
+
+	// known_hosts brackets the address with the port, as ssh writes it
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(file, []byte(knownhosts.Line([]string{"[::1]:2222"}, key)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		port    string
+		wantErr string
+	}{
+		{"2222", ""},
+		{"22", "no hostkey"},
+	}
+	for _, tt := range tests {
+		cb, _, err := checkHostKey([]string{file}, "::1", tt.port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := net.JoinHostPort("::1", tt.port)
+		err = cb(addr, &net.TCPAddr{IP: net.IPv6loopback}, key)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: %v, want the key accepted", addr, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: error %v, want %q", addr, err, tt.wantErr)
+		}
+	}
+}
+
+func TestTrustOnFirstUse(t *testing.T) {
+	key, other, revoked := newHostKey(t), newHostKey(t), newHostKey(t)
+
+	// new hosts are added to the first file, created along with its directory
+	dir := t.TempDir()
+	first := filepath.Join(dir, "ssh", "known_hosts")
+	second := filepath.Join(dir, "known_hosts")
+	lines := []string{
+		knownhosts.Line([]string{"web1"}, key),
+		"@revoked * " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(revoked))),
+	}
+	if err := os.WriteFile(second, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// in order, a host added by one check is known to the next
+	tests := []struct {
+		name    string
+		host    string
+		key     ssh.PublicKey
+		wantErr string // empty if the key is accepted
+	}{
+		{"known", "web1", key, ""},
+		{"known mismatch", "web1", other, "possible MITM"},
+		{"new host added", "web2", other, ""},
+		{"added host", "web2", other, ""},
+		{"added host mismatch", "web2", key, "possible MITM"},
+		{"revoked", "web3", revoked, "revoked"},
+	}
+	for _, tt := range tests {
+		cb, _, err := trustOnFirstUse([]string{first, second}, tt.host, "22")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = cb(tt.host+":22", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1)}, tt.key)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: %v, want the key accepted", tt.name, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+
+	b, err := os.ReadFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := knownhosts.Line([]string{"web2"}, other) + "\n"; string(b) != want {
+		t.Errorf("%s = %q, want only web2 added %q", first, b, want)
+	}
+}
+
+func TestRunAgentShared(t *testing.T) {
+	_, pk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: pk}); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(pk.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an agent counting its connections
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skipf("could not listen on a unix socket: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var dials atomic.Int32
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			dials.Add(1)
+			go func() {
+				agent.ServeAgent(keyring, c)
+				c.Close()
+			}()
+		}
+	}()
+	// a variable of its own, as agents are cached by variable, dropped so a rerun dials again
+	t.Setenv("BOOMERANG_TEST_AGENT_SOCK", sock)
+	t.Cleanup(func() {
+		agents.mu.Lock()
+		delete(agents.agents, "BOOMERANG_TEST_AGENT_SOCK")
+		agents.mu.Unlock()
+	})
+
+	// the server accepts only the agent's key
+	s := startFakeSSH(t, &fakeSSH{config: func(cfg *ssh.ServerConfig) {
+		cfg.PasswordCallback = nil
+		cfg.PublicKeyCallback = func(_ ssh.ConnMetadata, k ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(k.Marshal(), pub.Marshal()) {
+				return nil, fmt.Errorf("unknown key")
+			}
+			return nil, nil
+		}
+	}})
+
+	var inventory Inventory
+	for i := 0; i < 5; i++ {
+		inventory.Add(SSHInfo{HostName: s.host, Port: s.port, Username: fmt.Sprintf("u%d", i)})
+	}
+	b, err := Run(context.Background(), Options{
+		Inventory:   inventory,
+		Commands:    []Command{{Name: "echo", Command: "echo hello"}},
+		Auth:        Auth{Methods: []string{"agent"}, Agent: "BOOMERANG_TEST_AGENT_SOCK"},
+		HostKeyMode: HostKeyInsecure,
+		DownloadDir: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range b.MachineData {
+		if !m.Connection || m.AuthMethod != "agent" {
+			t.Errorf("%s: connection %v with auth %q, want agent: %v", m.Username, m.Connection, m.AuthMethod, m.ConnectionErrors)
+		}
+	}
+	if n := dials.Load(); n != 1 {
+		t.Errorf("agent dialed %d times for 5 machines, want once", n)
+	}
+}
+
+func TestRunHostKeyFingerprint(t *testing.T) {
+	s := startFakeSSH(t, &fakeSSH{})
+
+	tests := []struct {
+		name        string
+		fingerprint string
+		wantConnect bool
+	}{
+		{"match", ssh.FingerprintSHA256(s.hostKey), true},
+		{"match without prefix", strings.TrimPrefix(ssh.FingerprintSHA256(s.hostKey), "SHA256:"), true},
+		{"mismatch", ssh.FingerprintSHA256(newHostKey(t)), false},
+	}
+	for _, tt := range tests {
+		// the fingerprint is checked instead of known_hosts, which doesn't exist
+		b, err := Run(context.Background(), Options{
+			Inventory:   Inventory{{HostName: s.host, Port: s.port, Username: "u", HostKeyFingerprint: tt.fingerprint}},
+			Commands:    []Command{{Name: "echo", Command: "echo hello"}},
+			Auth:        Auth{Methods: []string{"password"}, Password: "secret"},
+			KnownHosts:  []string{filepath.Join(t.TempDir(), "known_hosts")},
+			DownloadDir: t.TempDir(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := b.MachineData[0]
+		if m.Connection != tt.wantConnect {
+			t.Errorf("%s: connection %v, want %v: %v", tt.name, m.Connection, tt.wantConnect, m.ConnectionErrors)
+		}
+		if !tt.wantConnect && (len(m.ConnectionErrors) != 1 || !strings.Contains(m.ConnectionErrors[0], "host key fingerprint mismatch")) {
+			t.Errorf("%s: connection errors %q, want a fingerprint mismatch", tt.name, m.ConnectionErrors)
+		}
+	}
+}
+
+func TestRunAuthFallback(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "id_ed25519")
+	writeKey(t, key)
+
+	// the key isn't authorized, the password is
+	var offered atomic.Int32
+	s := startFakeSSH(t, &fakeSSH{config: func(cfg *ssh.ServerConfig) {
+		cfg.PublicKeyCallback = func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			offered.Add(1)
+			return nil, fmt.Errorf("unauthorized key")
+		}
+	}})
+
+	b, err := Run(context.Background(), Options{
+		Inventory:   Inventory{{HostName: s.host, Port: s.port, Username: "u"}},
+		Commands:    []Command{{Name: "echo", Command: "echo hello"}},
+		Auth:        Auth{Methods: []string{"key", "password"}, PrivateKey: key, Password: "secret"},
+		HostKeyMode: HostKeyInsecure,
+		DownloadDir: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := b.MachineData[0]
+	if !m.Connection || m.AuthMethod != "password" {
+		t.Errorf("connection %v with auth method %q, want password: %v", m.Connection, m.AuthMethod, m.ConnectionErrors)
+	}
+	if offered.Load() == 0 {
+		t.Error("the key was never offered, want it tried before the password")
+	}
+}
+
+func TestRunHostKeyAlgorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaSigner, err := ssh.NewSignerFromKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		serverRSA bool            // the server also has an rsa host key, not in known_hosts
+		known     []ssh.PublicKey // nil is the server's ed25519 key
+	}{
+		// the server presents ed25519, the rsa key known for it isn't negotiated
+		{"rsa and ed25519 known", false, []ssh.PublicKey{rsaSigner.PublicKey(), nil}},
+		// the client prefers rsa over ed25519, unless only ed25519 is known
+		{"server has both", true, []ssh.PublicKey{nil}},
+	}
+	for _, tt := range tests {
+		s := startFakeSSH(t, &fakeSSH{config: func(cfg *ssh.ServerConfig) {
+			if tt.serverRSA {
+				cfg.AddHostKey(rsaSigner)
+			}
+		}})
+
+		host := knownhosts.Normalize(net.JoinHostPort(s.host, s.port))
+		var lines []string
+		for _, k := range tt.known {
+			if k == nil {
+				k = s.hostKey
+			}
+			lines = append(lines, knownhosts.Line([]string{host}, k))
+		}
+		file := filepath.Join(t.TempDir(), "known_hosts")
+		if err := os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := Run(context.Background(), Options{
+			Inventory:   Inventory{{HostName: s.host, Port: s.port, Username: "u"}},
+			Commands:    []Command{{Name: "echo", Command: "echo hello"}},
+			Auth:        Auth{Methods: []string{"password"}, Password: "secret"},
+			HostKeyMode: HostKeyStrict,
+			KnownHosts:  []string{file},
+			DownloadDir: t.TempDir(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m := b.MachineData[0]; !m.Connection {
+			t.Errorf("%s: connection failed: %v", tt.name, m.ConnectionErrors)
+		}
+	}
+}
+
+func TestRunIPv6(t *testing.T) {
+	s := startFakeSSH(t, &fakeSSH{listen: "::1"})
+
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(net.JoinHostPort(s.host, s.port))}, s.hostKey)
+	if err := os.WriteFile(file, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := Run(context.Background(), Options{
+		Inventory:   Inventory{{HostName: "::1", Port: s.port, Username: "u"}},
+		Commands:    []Command{{Name: "echo", Command: "echo hello"}},
+		Auth:        Auth{Methods: []string{"password"}, Password: "secret"},
+		HostKeyMode: HostKeyStrict,
+		KnownHosts:  []string{file},
+		DownloadDir: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := b.MachineData[0]
+	if !m.Connection {
+		t.Fatalf("connection failed: %v", m.ConnectionErrors)
+	}
+	if got := m.StreamData[0].Stdout; got != "hello\n" {
+		t.Errorf("stdout %q, want %q", got, "hello\n")
+	}
+}
@@ -0,0 +1,74 @@
+package boomerang
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff computes the wait between retries, e.g. of a connection.
+//
+// Policy fixed, or empty, waits Wait between every retry. Policy exponential waits Wait*2^n before
+// retry n, capped at Max, with up to ±25% jitter so machines retrying together drift apart.
+type Backoff struct {
+	Policy string
+	Wait   time.Duration
+	Max    time.Duration
+}
+
+// Delay returns the wait before retry n, counting from 0.
+func (b Backoff) Delay(n int) time.Duration {
+	d := b.ceiling(n)
+	if b.Policy != "exponential" {
+		return d
+	}
+	// jitter in [-25%, +25%), never past the cap
+	d += time.Duration((rand.Float64() - 0.5) * 0.5 * float64(d))
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	return d
+}
+
+// ceiling returns the wait before retry n without jitter.
+func (b Backoff) ceiling(n int) time.Duration {
+	d := b.Wait
+	if b.Policy != "exponential" {
+		return d
+	}
+	// with room left for Delay's jitter
+	for i := 0; i < n; i++ {
+		if (b.Max > 0 && d >= b.Max) || d > math.MaxInt64/4 {
+			break
+		}
+		d *= 2
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	return d
+}
+
+// total returns the most time spent waiting across retries.
+func (b Backoff) total(retries int64) time.Duration {
+	var t time.Duration
+	for n := 0; n < int(retries); n++ {
+		d := b.ceiling(n)
+		if b.Policy == "exponential" {
+			d += d / 4
+			if b.Max > 0 && d > b.Max {
+				d = b.Max
+			}
+		}
+		t += d
+	}
+	return t
+}
+
+func (b Backoff) String() string {
+	if b.Policy != "exponential" {
+		return fmt.Sprintf("%v wait", b.Wait)
+	}
+	return fmt.Sprintf("%v exponential backoff, capped at %v", b.Wait, b.Max)
+}
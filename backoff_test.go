@@ -0,0 +1,66 @@
+package boomerang
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	s := time.Second
+	tests := []struct {
+		name    string
+		backoff Backoff
+		n       int
+		want    time.Duration // before jitter
+	}{
+		{"fixed", Backoff{Policy: "fixed", Wait: 15 * s}, 0, 15 * s},
+		{"fixed ignores n", Backoff{Policy: "fixed", Wait: 15 * s, Max: 20 * s}, 5, 15 * s},
+		{"empty policy is fixed", Backoff{Wait: 3 * s}, 4, 3 * s},
+		{"exponential first", Backoff{Policy: "exponential", Wait: s, Max: 30 * s}, 0, s},
+		{"exponential doubles", Backoff{Policy: "exponential", Wait: s, Max: 30 * s}, 3, 8 * s},
+		{"exponential capped", Backoff{Policy: "exponential", Wait: s, Max: 30 * s}, 10, 30 * s},
+		{"exponential uncapped", Backoff{Policy: "exponential", Wait: s}, 4, 16 * s},
+		{"no overflow", Backoff{Policy: "exponential", Wait: s}, 100, -1},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 50; i++ {
+			d := tt.backoff.Delay(tt.n)
+			if tt.want < 0 {
+				if d <= 0 {
+					t.Fatalf("%s: Delay(%d) = %v, want a positive duration", tt.name, tt.n, d)
+				}
+				continue
+			}
+			lo, hi := tt.want, tt.want
+			if tt.backoff.Policy == "exponential" {
+				// ±25% jitter, never past the cap
+				lo, hi = tt.want*3/4, tt.want*5/4
+				if tt.backoff.Max > 0 && hi > tt.backoff.Max {
+					hi = tt.backoff.Max
+				}
+			}
+			if d < lo || d > hi {
+				t.Fatalf("%s: Delay(%d) = %v, want between %v and %v", tt.name, tt.n, d, lo, hi)
+			}
+		}
+	}
+}
+
+func TestBackoffTotal(t *testing.T) {
+	s := time.Second
+	tests := []struct {
+		backoff Backoff
+		retries int64
+		want    time.Duration
+	}{
+		{Backoff{Policy: "fixed", Wait: 15 * s}, 0, 0},
+		{Backoff{Policy: "fixed", Wait: 15 * s}, 3, 45 * s},
+		// 1.25s + 2.5s + 4s, the last capped
+		{Backoff{Policy: "exponential", Wait: s, Max: 4 * s}, 3, 7750 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := tt.backoff.total(tt.retries); got != tt.want {
+			t.Errorf("%v: total(%d) = %v, want %v", tt.backoff, tt.retries, got, tt.want)
+		}
+	}
+}
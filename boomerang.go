@@ -0,0 +1,374 @@
+// Package boomerang executes a list of commands on many machines, concurrently, recording
+// stdout & stderr of each command. See cmd/boomerang for the command built on it, reading
+// options from a config file.
+package boomerang
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Boomerang is the parent struct written out as JSON to file
+type Boomerang struct {
+	MetaData    Meta      `json:"metadata"`
+	MachineData []Machine `json:"machine_data"`
+}
+
+// MarshalBoomerang returns data, usually a *Boomerang, as JSON, indented with tabs if indent.
+// Nothing is written, so the output can be used without touching disk, e.g. when embedding.
+func MarshalBoomerang(data interface{}, indent bool) ([]byte, error) {
+	var by []byte
+	var err error
+	if indent {
+		by, err = json.MarshalIndent(data, "", "\t")
+	} else {
+		by, err = json.Marshal(data)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed marshal")
+	}
+	return by, nil
+}
+
+// Meta structure holds all non machine-specific data
+type Meta struct {
+	// TODO remove BoomerangVersion once API becomes stable,
+	// used mainly for debugging as API change frequently.
+	// Think about replacing with an actual API version?
+	BoomerangVersion string            `json:"boomerang_version"`
+	Type             string            `json:"type"`
+	TypeBreakdown    map[string]int    `json:"type_breakdown,omitempty"`
+	Profile          string            `json:"profile"`
+	Timestamp        string            `json:"timestamp"`
+	RunID            string            `json:"run_id"` // a UUID identifying the run, also in remote temp file names
+	Labels           map[string]string `json:"labels,omitempty"`
+	TotalMachines    int               `json:"total_items"`
+	TotalTime        string            `json:"total_time"`
+	Retries          Retries           `json:"retries"`
+	Health           Health            `json:"health"`
+	Canary           *Canary           `json:"canary,omitempty"`
+	Truncated        string            `json:"truncated,omitempty"` // why the run was cut short, e.g. global timeout
+	Filter           *Filter           `json:"filter,omitempty"`
+}
+
+// Filter records the outputFilter applied to machine_data.
+type Filter struct {
+	Mode  string `json:"mode"`
+	Items int    `json:"items"` // machines kept, out of total_items
+}
+
+// Retries summarizes connection and command retries across all machines.
+type Retries struct {
+	ConnectionRetries int `json:"connection_retries"`
+	MachinesRetried   int `json:"machines_retried"`
+	CommandRetries    int `json:"command_retries"`
+}
+
+// summarizeRetries reduces per-machine connection attempts, and per-command attempts, into the
+// metadata retry summary.
+func (b *Boomerang) summarizeRetries() {
+	var r Retries
+	for _, m := range b.MachineData {
+		if m.ConnectionAttempts > 1 {
+			r.ConnectionRetries += m.ConnectionAttempts - 1
+			r.MachinesRetried++
+		}
+		for _, s := range m.StreamData {
+			if len(s.Attempts) > 1 {
+				r.CommandRetries += len(s.Attempts) - 1
+			}
+		}
+	}
+	b.MetaData.Retries = r
+}
+
+// Health classifies machines by outcome, a health summary of the run without reading every machine.
+type Health struct {
+	Succeeded        int            `json:"succeeded"`         // connected and every command succeeded
+	PartiallyFailed  int            `json:"partially_failed"`  // connected but a command failed
+	ConnectionFailed int            `json:"connection_failed"` // failed to connect
+	CommandFailures  map[string]int `json:"command_failures"`  // machines each command, by name, failed on
+}
+
+// summarizeHealth classifies each machine into the metadata health summary.
+func (b *Boomerang) summarizeHealth() {
+	h := Health{CommandFailures: make(map[string]int)}
+	for _, m := range b.MachineData {
+		switch {
+		case !m.Connection:
+			h.ConnectionFailed++
+		case m.Failed():
+			h.PartiallyFailed++
+		default:
+			h.Succeeded++
+		}
+		for _, s := range m.StreamData {
+			if !s.Succeeded {
+				h.CommandFailures[s.Name]++
+			}
+		}
+	}
+	b.MetaData.Health = h
+}
+
+// typeFromInventory derives the metadata type from the Extras field key across the inventory.
+// It returns the dominant value and, when machines have differing values, the breakdown of
+// value -> machine count. Machines without the field are not counted.
+func typeFromInventory(inventory []SSHInfo, key string) (string, map[string]int) {
+	breakdown := make(map[string]int)
+	for _, s := range inventory {
+		if v, ok := s.Extras[key]; ok {
+			breakdown[fmt.Sprint(v)]++
+		}
+	}
+
+	var dominant string
+	for v, n := range breakdown {
+		// ties are broken alphabetically so the type is stable across runs
+		if n > breakdown[dominant] || (n == breakdown[dominant] && v < dominant) {
+			dominant = v
+		}
+	}
+
+	if len(breakdown) < 2 {
+		return dominant, nil
+	}
+	return dominant, breakdown
+}
+
+// Version is recorded in the metadata of every run, set at build time through -ldflags, e.g.
+// -ldflags="-X github.com/mfridman/boomerang.Version=$(git describe --always --tags)"
+var Version = "devel"
+
+// Run runs opts' uploads and commands on every machine in opts.Inventory and returns the
+// populated Boomerang. Nothing is written to disk, except downloads.
+//
+// If ctx is cancelled, running commands are killed and machines not yet started are recorded
+// as cancelled; the Boomerang returned holds whatever completed.
+func Run(ctx context.Context, opts Options) (*Boomerang, error) {
+	start := time.Now()
+
+	state, err := newState(opts)
+	if err != nil {
+		return nil, err
+	}
+	inventory := opts.Inventory
+
+	// a machine's own commands are checked before connecting to any machine
+	for _, s := range inventory {
+		if _, err := state.hostCommands(s); err != nil {
+			return nil, errors.Wrapf(err, "[%v] failed command setup", s.HostName)
+		}
+	}
+	inventory = downloadDirs(inventory, state.DownloadDir)
+
+	// once globalTimeout passes, running machines are aborted and what completed is returned
+	if state.GlobalTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, state.GlobalTimeout, errGlobalTimeout)
+		defer cancel()
+	}
+
+	// once failFastThreshold is exceeded, the rest of the run is aborted and what completed is
+	// returned. Machines not run because of a failed canary aren't counted.
+	onMachine := opts.OnMachine
+	if state.FailFastThreshold > 0 {
+		var cancel context.CancelCauseFunc
+		ctx, cancel = context.WithCancelCause(ctx)
+		defer cancel(nil)
+		f := &failFast{threshold: state.FailFastThreshold, min: state.FailFastMinHosts, cancel: cancel}
+		onMachine = func(m Machine) {
+			f.machine(ctx, m)
+			if opts.OnMachine != nil {
+				opts.OnMachine(m)
+			}
+		}
+	}
+
+	boomerang := &Boomerang{
+		MetaData: Meta{
+			BoomerangVersion: Version,
+			Type:             state.Type,
+			Profile:          state.Profile,
+			TotalMachines:    len(inventory),
+			Timestamp:        start.Format(time.RFC3339),
+			RunID:            state.RunID,
+			Labels:           state.Labels,
+		},
+		MachineData: make([]Machine, 0),
+	}
+
+	if state.TypeFrom != "" {
+		if t, breakdown := typeFromInventory(inventory, state.TypeFrom); t != "" {
+			boomerang.MetaData.Type = t
+			boomerang.MetaData.TypeBreakdown = breakdown
+		}
+	}
+
+	remaining := inventory
+
+	// With a canary, a subset of machines runs first. The rest only run if the canary's
+	// failure rate is within canaryMaxFailure, otherwise they're recorded as not run.
+	if n := state.canarySize(len(inventory)); n > 0 {
+		runMachines(ctx, inventory[:n], 0, state, boomerang, onMachine)
+
+		c := newCanary(boomerang.MachineData, state.CanaryMaxFailure)
+		boomerang.MetaData.Canary = c
+
+		remaining = inventory[n:]
+		// a cancelled canary says nothing about the change, the rest are recorded as cancelled
+		if c.Aborted && ctx.Err() == nil {
+			for i, s := range remaining {
+				m := NewMachine(s)
+				m.order = n + i
+				m.ConnectionErrors = []string{fmt.Sprintf("not run: canary failure rate %.1f%% exceeded canaryMaxFailure %.1f%%", c.FailureRate, state.CanaryMaxFailure)}
+				boomerang.MachineData = append(boomerang.MachineData, *m)
+				if opts.OnMachine != nil {
+					opts.OnMachine(*m)
+				}
+			}
+			remaining = nil
+		}
+	}
+
+	runMachines(ctx, remaining, len(inventory)-len(remaining), state, boomerang, onMachine)
+
+	elapsed := time.Since(start)
+
+	boomerang.MetaData.TotalTime = fmt.Sprintf("%v", elapsed-(elapsed%time.Millisecond))
+	boomerang.summarizeRetries()
+	boomerang.summarizeHealth()
+	sortMachines(boomerang.MachineData, state.OutputOrder)
+	if cause := context.Cause(ctx); isAbort(cause) {
+		boomerang.MetaData.Truncated = cause.Error()
+	}
+
+	return boomerang, nil
+}
+
+// runMachines runs all machines in inventory concurrently, appending results to b.MachineData
+// and calling onMachine, if non-nil, with each. offset is the position of inventory[0] in the
+// whole inventory, recorded so results can be put back in inventory order.
+// At most st.maxConcurrency machines run at once, unbounded if <= 0. It blocks until all
+// machines have completed.
+func runMachines(ctx context.Context, inventory []SSHInfo, offset int, st *runState, b *Boomerang, onMachine func(Machine)) {
+	var wg sync.WaitGroup
+	wg.Add(len(inventory))
+
+	// sem bounds the number of machines running at once, a nil channel means unbounded.
+	var sem chan struct{}
+	if st.MaxConcurrency > 0 {
+		sem = make(chan struct{}, st.MaxConcurrency)
+	}
+
+	var mut sync.Mutex
+	for i, ssh := range inventory {
+		var acquired bool
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+				acquired = true
+			case <-ctx.Done():
+				// once cancelled, machines still waiting are run without a slot, and are
+				// recorded as cancelled before run
+			}
+		}
+		go func(s SSHInfo, order int, rc *runState, acquired bool) {
+			if acquired {
+				defer func() { <-sem }()
+			}
+
+			m := NewMachine(s)
+			m.order = order
+
+			finalMachine := m.run(ctx, rc)
+
+			mut.Lock()
+			{
+				b.MachineData = append(b.MachineData, *finalMachine)
+				if onMachine != nil {
+					onMachine(*finalMachine)
+				}
+			}
+			mut.Unlock()
+
+			wg.Done()
+
+		}(ssh, offset+i, st, acquired)
+	}
+
+	// block until all goroutines have completed.
+	wg.Wait()
+}
+
+// Canary records the outcome of the canary subset run before the rest of the inventory.
+type Canary struct {
+	Machines    int     `json:"machines"`
+	Failed      int     `json:"failed"`
+	FailureRate float64 `json:"failure_rate"`
+	Aborted     bool    `json:"aborted"`
+}
+
+// newCanary evaluates the canary machines against maxFailure, a percentage.
+func newCanary(machines []Machine, maxFailure float64) *Canary {
+	c := &Canary{Machines: len(machines)}
+	for _, m := range machines {
+		if m.Failed() {
+			c.Failed++
+		}
+	}
+	if c.Machines > 0 {
+		c.FailureRate = float64(c.Failed) / float64(c.Machines) * 100
+	}
+	c.Aborted = c.FailureRate > maxFailure
+	return c
+}
+
+// failFast aborts a run once more than threshold percent of the machines completed so far
+// failed to connect, e.g. after a credential or network problem, checked once at least min
+// machines have completed. It's called under the runMachines lock.
+type failFast struct {
+	threshold float64
+	min       int
+	cancel    context.CancelCauseFunc
+
+	completed, failed int
+	tripped           bool
+}
+
+// machine counts m, a completed machine, cancelling the run if the threshold is exceeded.
+// Machines completing after the run was cancelled, by any cause, aren't counted.
+func (f *failFast) machine(ctx context.Context, m Machine) {
+	if f.tripped || ctx.Err() != nil {
+		return
+	}
+	f.completed++
+	if !m.Connection {
+		f.failed++
+	}
+	if f.completed < f.min {
+		return
+	}
+	if rate := float64(f.failed) / float64(f.completed) * 100; rate > f.threshold {
+		f.tripped = true
+		f.cancel(&failFastError{failed: f.failed, completed: f.completed, threshold: f.threshold})
+	}
+}
+
+// FailFastCause prefixes Meta.Truncated when the run was aborted by FailFastThreshold.
+const FailFastCause = "fail fast"
+
+// failFastError is the cause of the run being cancelled by failFast.
+type failFastError struct {
+	failed, completed int
+	threshold         float64
+}
+
+func (e *failFastError) Error() string {
+	return fmt.Sprintf(FailFastCause+": %d of %d machines failed to connect, over failFastThreshold %g%%", e.failed, e.completed, e.threshold)
+}
@@ -0,0 +1,1361 @@
+package boomerang
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeSSHServer starts a fakeSSH with the default options and returns its host and port.
+func fakeSSHServer(t *testing.T) (string, string) {
+	s := startFakeSSH(t, &fakeSSH{})
+	return s.host, s.port
+}
+
+// fakeSSH is an in-process ssh server accepting any password, which echoes each command run back
+// on stdout, except echo, which writes its arguments and a newline as a shell would. A command of
+// false exits 1, and sleep <seconds> sleeps first, see exec. Sessions may also
+// request the sftp subsystem, served from the local filesystem. Options are set before
+// startFakeSSH.
+type fakeSSH struct {
+	config    func(*ssh.ServerConfig) // optional, e.g. to change auth or algorithms
+	acceptEnv []string                // env variables a session may set, as sshd's AcceptEnv
+	sudoPass  string                  // sudo <cmd> prompts for it on a PTY before running cmd
+	// idleTimeout closes a connection once no global request, e.g. a keepalive, has arrived for
+	// this long, as an idle-timeout firewall would
+	idleTimeout time.Duration
+	noReply     bool   // global requests are never replied to, as by a hung server
+	listen      string // address listened on, 127.0.0.2 if empty
+
+	host, port string
+	hostKey    ssh.PublicKey
+	conns      atomic.Int32 // connections accepted
+	keepalives atomic.Int32 // keepalive requests received
+	running    atomic.Int32 // commands running
+	peak       atomic.Int32 // most commands running at once
+
+	mu        sync.Mutex
+	forwarded []string // addresses connections were tunneled to, as a bastion
+	remotes   []string // addresses connections came from
+}
+
+// startFakeSSH starts s listening on 127.0.0.2, as 127.0.0.1 and localhost are rejected as
+// machines, or s.listen, until the test ends.
+func startFakeSSH(t *testing.T, s *fakeSSH) *fakeSSH {
+	t.Helper()
+	_, pk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) { return nil, nil },
+	}
+	cfg.AddHostKey(signer)
+	s.hostKey = signer.PublicKey()
+	if s.config != nil {
+		s.config(cfg)
+	}
+
+	if s.listen == "" {
+		s.listen = "127.0.0.2"
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(s.listen, "0"))
+	if err != nil {
+		t.Skipf("could not listen on %s: %v", s.listen, err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.conns.Add(1)
+			go s.serve(c, cfg)
+		}
+	}()
+
+	s.host, s.port, _ = net.SplitHostPort(l.Addr().String())
+	return s
+}
+
+func (s *fakeSSH) serve(c net.Conn, cfg *ssh.ServerConfig) {
+	s.mu.Lock()
+	s.remotes = append(s.remotes, c.RemoteAddr().String())
+	s.mu.Unlock()
+
+	conn, chans, reqs, err := ssh.NewServerConn(c, cfg)
+	if err != nil {
+		return
+	}
+	go s.globalRequests(conn, reqs)
+	for nc := range chans {
+		if nc.ChannelType() == "direct-tcpip" {
+			go s.forward(nc)
+			continue
+		}
+		ch, requests, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go s.session(conn, ch, requests)
+	}
+}
+
+// globalRequests serves conn's global requests, replying false as they're unknown. See
+// idleTimeout and noReply.
+func (s *fakeSSH) globalRequests(conn ssh.Conn, reqs <-chan *ssh.Request) {
+	var idle *time.Timer
+	if s.idleTimeout > 0 {
+		idle = time.AfterFunc(s.idleTimeout, func() { conn.Close() })
+		defer idle.Stop()
+	}
+	for req := range reqs {
+		if idle != nil {
+			idle.Reset(s.idleTimeout)
+		}
+		if req.Type == "keepalive@openssh.com" {
+			s.keepalives.Add(1)
+		}
+		if req.WantReply && !s.noReply {
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// forward serves a direct-tcpip channel, tunneling a connection to the address requested as a
+// bastion does.
+func (s *fakeSSH) forward(nc ssh.NewChannel) {
+	var req struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	ssh.Unmarshal(nc.ExtraData(), &req)
+	addr := net.JoinHostPort(req.Host, strconv.Itoa(int(req.Port)))
+	s.mu.Lock()
+	s.forwarded = append(s.forwarded, addr)
+	s.mu.Unlock()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		io.Copy(ch, conn)
+		ch.Close()
+	}()
+	io.Copy(conn, ch)
+	conn.Close()
+}
+
+// session serves a session channel's requests on conn, running an exec or the sftp subsystem.
+func (s *fakeSSH) session(conn ssh.Conn, ch ssh.Channel, requests <-chan *ssh.Request) {
+	env := make(map[string]string)
+	var pty bool
+	for req := range requests {
+		switch req.Type {
+		case "pty-req":
+			pty = true
+			req.Reply(true, nil)
+		case "env":
+			var kv struct{ Name, Value string }
+			ssh.Unmarshal(req.Payload, &kv)
+			ok := slices.Contains(s.acceptEnv, kv.Name)
+			if ok {
+				env[kv.Name] = kv.Value
+			}
+			req.Reply(ok, nil)
+		case "exec":
+			req.Reply(true, nil)
+			var exec struct{ Command string }
+			ssh.Unmarshal(req.Payload, &exec)
+			if c, ok := strings.CutPrefix(exec.Command, "sudo "); ok {
+				s.sudo(conn, ch, c, pty)
+				continue
+			}
+			s.exec(conn, ch, exec.Command, env)
+		case "subsystem":
+			var sub struct{ Name string }
+			ssh.Unmarshal(req.Payload, &sub)
+			req.Reply(sub.Name == "sftp", nil)
+			if sub.Name == "sftp" {
+				go ssh.DiscardRequests(requests)
+				if srv, err := sftp.NewServer(ch); err == nil {
+					srv.Serve()
+				}
+				ch.Close()
+				return
+			}
+		default:
+			req.Reply(true, nil)
+		}
+	}
+}
+
+// exec runs cmd, writing it back on ch before exiting, or env set for the session, as name=value
+// lines, for printenv. After writing it back, drop closes the session without an exit status,
+// hangup closes the connection and kill exits by SIGKILL. warn and blank also write a warning,
+// or a blank line, to stderr and exit 0.
+func (s *fakeSSH) exec(conn ssh.Conn, ch ssh.Channel, cmd string, env map[string]string) {
+	n := s.running.Add(1)
+	defer s.running.Add(-1)
+	for p := s.peak.Load(); n > p && !s.peak.CompareAndSwap(p, n); p = s.peak.Load() {
+	}
+
+	if d, ok := strings.CutPrefix(cmd, "sleep "); ok {
+		secs, _ := strconv.ParseFloat(d, 64)
+		time.Sleep(time.Duration(secs * float64(time.Second)))
+	}
+	if cmd == "printenv" {
+		for _, k := range sortedKeys(env) {
+			fmt.Fprintf(ch, "%s=%s\n", k, env[k])
+		}
+	} else if args, ok := strings.CutPrefix(cmd, "echo "); ok {
+		fmt.Fprintln(ch, args)
+	} else {
+		ch.Write([]byte(cmd))
+	}
+
+	switch cmd {
+	case "warn":
+		fmt.Fprint(ch.Stderr(), "warning: deprecated\n")
+	case "blank":
+		fmt.Fprint(ch.Stderr(), "\n")
+	}
+
+	switch cmd {
+	case "drop":
+		ch.Close()
+		return
+	case "hangup":
+		conn.Close()
+		return
+	case "kill":
+		ch.SendRequest("exit-signal", false, ssh.Marshal(struct {
+			Signal     string
+			CoreDumped bool
+			Error      string
+			Lang       string
+		}{"KILL", false, "killed", "en"}))
+		ch.Close()
+		return
+	}
+
+	code := byte(0)
+	if cmd == "false" {
+		code = 1
+	}
+	ch.SendRequest("exit-status", false, []byte{0, 0, 0, code})
+	ch.Close()
+}
+
+// sudo runs cmd as sudo does, prompting for sudoPass on a PTY and failing without one.
+func (s *fakeSSH) sudo(conn ssh.Conn, ch ssh.Channel, cmd string, pty bool) {
+	code := byte(1)
+	if !pty {
+		fmt.Fprint(ch.Stderr(), "sudo: a terminal is required to read the password")
+	} else {
+		fmt.Fprintf(ch, "[sudo] password for %s: ", conn.User())
+		var line []byte
+		b := make([]byte, 1)
+		for {
+			if _, err := ch.Read(b); err != nil || b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+		}
+		if string(line) == s.sudoPass {
+			fmt.Fprintf(ch, "\r\n%s\r\n", cmd)
+			code = 0
+		} else {
+			fmt.Fprint(ch, "\r\nSorry, try again.\r\n")
+		}
+	}
+	ch.SendRequest("exit-status", false, []byte{0, 0, 0, code})
+	ch.Close()
+}
+
+func TestRun(t *testing.T) {
+	host, port := fakeSSHServer(t)
+
+	b, err := Run(context.Background(), Options{
+		Inventory: Inventory{{HostName: host, Port: port, Username: "u"}},
+		Commands: []Command{
+			{Name: "echo", Command: "echo hello"},
+			{Name: "fails", Command: "false"},
+		},
+		Finally:     []Command{{Name: "cleanup", Command: "true"}},
+		Auth:        Auth{Methods: []string{"password"}, Password: "secret"},
+		HostKeyMode: HostKeyInsecure,
+		DownloadDir: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.MetaData.TotalMachines != 1 || len(b.MachineData) != 1 {
+		t.Fatalf("got %d machines of %d, want 1", len(b.MachineData), b.MetaData.TotalMachines)
+	}
+	m := b.MachineData[0]
+	if !m.Connection {
+		t.Fatalf("machine did not connect: %v", m.ConnectionErrors)
+	}
+
+	tests := []struct {
+		name      string
+		stdout    string
+		succeeded bool
+		finalizer bool
+	}{
+		{"echo", "hello\n", true, false},
+		{"fails", "false", false, false},
+		{"cleanup", "true", true, true},
+	}
+	if len(m.StreamData) != len(tests) {
+		t.Fatalf("got %d streams, want %d", len(m.StreamData), len(tests))
+	}
+	for i, tt := range tests {
+		s := m.StreamData[i]
+		if s.Name != tt.name || s.Stdout != tt.stdout || s.Succeeded != tt.succeeded || s.Finalizer != tt.finalizer {
+			t.Errorf("stream %d = %q %q succeeded=%v finalizer=%v, want %q %q succeeded=%v finalizer=%v",
+				i, s.Name, s.Stdout, s.Succeeded, s.Finalizer, tt.name, tt.stdout, tt.succeeded, tt.finalizer)
+		}
+	}
+
+	if h := b.MetaData.Health; h.PartiallyFailed != 1 || h.CommandFailures["fails"] != 1 {
+		t.Errorf("health = %+v, want 1 partially failed by fails", h)
+	}
+}
+
+func TestRunCommandTimeout(t *testing.T) {
+	host, port := fakeSSHServer(t)
+
+	tests := []struct {
+		name    string
+		timeout time.Duration // the command's
+		global  time.Duration // CommandTimeout
+	}{
+		{"command timeout", 300 * time.Millisecond, 0},
+		{"global timeout", 0, 300 * time.Millisecond},
+		{"command overrides global", 300 * time.Millisecond, time.Minute},
+	}
+	for _, tt := range tests {
+		b, err := Run(context.Background(), Options{
+			Inventory: Inventory{{HostName: host, Port: port, Username: "u"}},
+			Commands: []Command{
+				{Name: "hangs", Command: "sleep 3", Timeout: tt.timeout},
+				{Name: "next", Command: "echo next"},
+			},
+			CommandTimeout: tt.global,
+			Auth:           Auth{Methods: []string{"password"}, Password: "secret"},
+			HostKeyMode:    HostKeyInsecure,
+			DownloadDir:    t.TempDir(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := b.MachineData[0]
+		if !m.Connection || len(m.StreamData) != 2 {
+			t.Fatalf("%s: connection %v with %d streams, want 2: %v", tt.name, m.Connection, len(m.StreamData), m.ConnectionErrors)
+		}
+		hung := m.StreamData[0]
+		if hung.ExitCode != -1 || hung.Succeeded || hung.Interrupted != interruptedTimeout {
+			t.Errorf("%s: exit code %d succeeded=%v interrupted=%q, want -1 false %q", tt.name, hung.ExitCode, hung.Succeeded, hung.Interrupted, interruptedTimeout)
+		}
+		if want := "Command timed out after 300ms"; len(hung.StreamErrors) == 0 || hung.StreamErrors[0] != want {
+			t.Errorf("%s: stream errors %q, want %q", tt.name, hung.StreamErrors, want)
+		}
+		if hung.Duration >= 3 {
+			t.Errorf("%s: ran for %vs, want it killed at the timeout", tt.name, hung.Duration)
+		}
+		// the timeout doesn't stop the machine's other commands
+		if next := m.StreamData[1]; !next.Succeeded || next.Stdout != "next\n" {
+			t.Errorf("%s: next command %q succeeded=%v, want it run: %v", tt.name, next.Stdout, next.Succeeded, next.StreamErrors)
+		}
+	}
+}
+
+func TestRunInterrupted(t *testing.T) {
+	host, port := fakeSSHServer(t)
+
+	tests := []struct {
+		command         string
+		wantInterrupted string
+		wantNext        bool // the connection is still usable for the next command
+	}{
+		{"drop", interruptedNoExit, true},
+		{"hangup", interruptedConnLost, false},
+	}
+	for _, tt := range tests {
+		b, err := Run(context.Background(), Options{
+			Inventory: Inventory{{HostName: host, Port: port, Username: "u"}},
+			Commands: []Command{
+				{Name: "interrupted", Command: tt.command},
+				{Name: "next", Command: "echo next"},
+			},
+			Auth:        Auth{Methods: []string{"password"}, Password: "secret"},
+			HostKeyMode: HostKeyInsecure,
+			DownloadDir: t.TempDir(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := b.MachineData[0]
+		if !m.Connection || len(m.StreamData) != 2 {
+			t.Fatalf("%s: connection %v with %d streams, want 2: %v", tt.command, m.Connection, len(m.StreamData), m.ConnectionErrors)
+		}
+		// what was written before the session closed is kept
+		sd := m.StreamData[0]
+		if sd.Stdout != tt.command || sd.ExitCode != -1 || sd.Succeeded || sd.Interrupted != tt.wantInterrupted {
+			t.Errorf("%s: stdout %q exit code %d succeeded=%v interrupted=%q, want %q -1 false %q",
+				tt.command, sd.Stdout, sd.ExitCode, sd.Succeeded, sd.Interrupted, tt.command, tt.wantInterrupted)
+		}
+		if next := m.StreamData[1]; next.Succeeded != tt.wantNext {
+			t.Errorf("%s: next command succeeded=%v, want %v: %v", tt.command, next.Succeeded, tt.wantNext, next.StreamErrors)
+		}
+	}
+}
+
+func TestRunSignal(t *testing.T) {
+	host, port := fakeSSHServer(t)
+
+	b, err := Run(context.Background(), Options{
+		Inventory:   Inventory{{HostName: host, Port: port, Username: "u"}},
+		Commands:    []Command{{Name: "killed", Command: "kill"}},
+		Auth:        Auth{Methods: []string{"password"}, Password: "secret"},
+		HostKeyMode: HostKeyInsecure,
+		DownloadDir: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sd := b.MachineData[0].StreamData[0]
+	want := Signal{Name: "KILL", Message: "killed", Lang: "en"}
+	if sd.Signal == nil || *sd.Signal != want {
+		t.Errorf("signal = %+v, want %+v", sd.Signal, want)
+	}
+	// 128 + 9, as a shell reports it
+	if sd.ExitCode != 137 || sd.Succeeded || sd.Interrupted != "" {
+		t.Errorf("exit code %d succeeded=%v interrupted=%q, want 137 false and not interrupted", sd.ExitCode, sd.Succeeded, sd.Interrupted)
+	}
+}
+
+func TestRunEnv(t *testing.T) {
+	s := startFakeSSH(t, &fakeSSH{acceptEnv: []string{"APP_ENV", "LANG"}})
+
+	b, err := Run(context.Background(), Options{
+		Inventory: Inventory{{HostName: s.host, Port: s.port, Username: "u"}},
+		Commands: []Command{
+			{Name: "env", Command: "printenv", Env: map[string]string{"APP_ENV": "prod", "LANG": "C"}},
+			// not allowed by the server, the command still runs
+			{Name: "rejected", Command: "printenv", Env: map[string]string{"APP_ENV": "prod", "SECRET": "x"}},
+			{Name: "dir", Command: "ls", Dir: "/srv/app's"},
+		},
+		Auth:        Auth{Methods: []string{"password"}, Password: "secret"},
+		HostKeyMode: HostKeyInsecure,
+		DownloadDir: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := b.MachineData[0]
+	if !m.Connection || len(m.StreamData) != 3 {
+		t.Fatalf("connection %v with %d streams, want 3: %v", m.Connection, len(m.StreamData), m.ConnectionErrors)
+	}
+	tests := []struct {
+		stdout       string
+		streamErrors []string
+	}{
+		{"APP_ENV=prod\nLANG=C\n", nil},
+		{"APP_ENV=prod\n", []string{"Failed to set env SECRET, check the server's AcceptEnv: ssh: setenv failed"}},
+		{`cd '/srv/app'"'"'s' && ls`, nil},
+	}
+	for i, tt := range tests {
+		sd := m.StreamData[i]
+		if sd.Stdout != tt.stdout || !sd.Succeeded {
+			t.Errorf("%s: stdout %q succeeded=%v, want %q", sd.Name, sd.Stdout, sd.Succeeded, tt.stdout)
+		}
+		// nil and empty are the same
+		if len(sd.StreamErrors)+len(tt.streamErrors) > 0 && !reflect.DeepEqual(sd.StreamErrors, tt.streamErrors) {
+			t.Errorf("%s: stream errors %q, want %q", sd.Name, sd.StreamErrors, tt.streamErrors)
+		}
+	}
+}
+
+func TestRunSudo(t *testing.T) {
+	s := startFakeSSH(t, &fakeSSH{sudoPass: "sudo-secret"})
+
+	tests := []struct {
+		name      string
+		password  string // sudoPassword
+		stdout    string
+		stderr    string
+		succeeded bool
+	}{
+		{"prompt answered", "sudo-secret", "whoami\n", "", true},
+		{"wrong password", "wrong", "Sorry, try again.\n", "", false},
+		// without a PTY sudo can't prompt
+		{"no sudoPassword", "", "", "sudo: a terminal is required to read the password", false},
+	}
+	for _, tt := range tests {
+		b, err := Run(context.Background(), Options{
+			Inventory:    Inventory{{HostName: s.host, Port: s.port, Username: "u"}},
+			Commands:     []Command{{Name: "whoami", Command: "sudo whoami", Sudo: true}},
+			SudoPassword: tt.password,
+			Auth:         Auth{Methods: []string{"password"}, Password: "secret"},
+			HostKeyMode:  HostKeyInsecure,
+			DownloadDir:  t.TempDir(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sd := b.MachineData[0].StreamData[0]
+		// the prompt is stripped, the password never appears
+		if sd.Stdout != tt.stdout || sd.Stderr != tt.stderr || sd.Succeeded != tt.succeeded {
+			t.Errorf("%s: stdout %q stderr %q succeeded=%v, want %q %q %v", tt.name, sd.Stdout, sd.Stderr, sd.Succeeded, tt.stdout, tt.stderr, tt.succeeded)
+		}
+	}
+}
+
+func TestRunKeepalive(t *testing.T) {
+	tests := []struct {
+		name        string
+		server      *fakeSSH
+		interval    time.Duration // KeepaliveInterval
+		interrupted string        // the command's
+		lost        bool          // recorded as connection lost (keepalive failed)
+	}{
+		{"idle connection dropped", &fakeSSH{idleTimeout: 300 * time.Millisecond}, 0, interruptedConnLost, false},
+		{"kept alive", &fakeSSH{idleTimeout: 300 * time.Millisecond}, 100 * time.Millisecond, "", false},
+		{"keepalive unanswered", &fakeSSH{noReply: true}, 100 * time.Millisecond, interruptedCancelled, true},
+	}
+	for _, tt := range tests {
+		s := startFakeSSH(t, tt.server)
+
+		b, err := Run(context.Background(), Options{
+			Inventory:         Inventory{{HostName: s.host, Port: s.port, Username: "u"}},
+			Commands:          []Command{{Name: "long", Command: "sleep 1"}},
+			KeepaliveInterval: tt.interval,
+			Auth:              Auth{Methods: []string{"password"}, Password: "secret"},
+			HostKeyMode:       HostKeyInsecure,
+			DownloadDir:       t.TempDir(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := b.MachineData[0]
+		if len(m.StreamData) != 1 {
+			t.Fatalf("%s: %d streams, want 1: %v", tt.name, len(m.StreamData), m.ConnectionErrors)
+		}
+		if sd := m.StreamData[0]; sd.Interrupted != tt.interrupted || sd.Succeeded != (tt.interrupted == "") {
+			t.Errorf("%s: interrupted=%q succeeded=%v, want %q", tt.name, sd.Interrupted, sd.Succeeded, tt.interrupted)
+		}
+		lost := slices.Contains(m.ConnectionErrors, "connection lost (keepalive failed)")
+		if lost != tt.lost || m.Connection == tt.lost {
+			t.Errorf("%s: connection %v errors %q, want lost %v", tt.name, m.Connection, m.ConnectionErrors, tt.lost)
+		}
+		if n := s.keepalives.Load(); tt.interval > 0 && !tt.lost && n < 3 {
+			t.Errorf("%s: %d keepalives sent during a 1s command, want one every 100ms", tt.name, n)
+		}
+	}
+}
+
+func TestRunDurations(t *testing.T) {
+	host, port := fakeSSHServer(t)
+
+	b, err := Run(context.Background(), Options{
+		Inventory: Inventory{{HostName: host, Port: port, Username: "u"}},
+		Commands: []Command{
+			{Name: "slow", Command: "sleep 0.3"},
+			{Name: "fails", Command: "false"},
+			{Name: "skipped", Command: "echo skipped"},
+		},
+		StopOnFailure: true,
+		Auth:          Auth{Methods: []string{"password"}, Password: "secret"},
+		HostKeyMode:   HostKeyInsecure,
+		DownloadDir:   t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sds := b.MachineData[0].StreamData
+	if len(sds) != 3 {
+		t.Fatalf("got %d streams, want 3", len(sds))
+	}
+	var prevEnd time.Time
+	for _, sd := range sds[:2] {
+		start, err := time.Parse(time.RFC3339Nano, sd.StartTime)
+		if err != nil {
+			t.Fatalf("%s: start time: %v", sd.Name, err)
+		}
+		end, err := time.Parse(time.RFC3339Nano, sd.EndTime)
+		if err != nil {
+			t.Fatalf("%s: end time: %v", sd.Name, err)
+		}
+		// the duration is measured on the monotonic clock, the times are wall clock
+		if d := end.Sub(start).Seconds(); math.Abs(d-sd.Duration) > 0.001 {
+			t.Errorf("%s: duration %v, want end - start %v", sd.Name, sd.Duration, d)
+		}
+		if start.Before(prevEnd) {
+			t.Errorf("%s: started at %v, before the previous command ended at %v", sd.Name, start, prevEnd)
+		}
+		prevEnd = end
+	}
+	if d := sds[0].Duration; d < 0.3 || d > 2 {
+		t.Errorf("slow: duration %vs, want about 0.3s", d)
+	}
+	if d := sds[1].Duration; d >= 0.3 {
+		t.Errorf("fails: duration %vs, want it timed on its own", d)
+	}
+	// a command that didn't run has no times
+	if sd := sds[2]; sd.StartTime != "" || sd.EndTime != "" || sd.Duration != 0 {
+		t.Errorf("skipped: start %q end %q duration %v, want none", sd.StartTime, sd.EndTime, sd.Duration)
+	}
+
+	// the machine's run is split into dialing, the handshake and running commands
+	m := b.MachineData[0]
+	if m.DialDuration <= 0 || m.HandshakeDuration <= 0 || m.CommandsDuration <= 0 {
+		t.Errorf("dial %vs, handshake %vs, commands %vs, want each recorded", m.DialDuration, m.HandshakeDuration, m.CommandsDuration)
+	}
+	if m.CommandsDuration < sds[0].Duration {
+		t.Errorf("commands %vs, want at least the slow command's %vs", m.CommandsDuration, sds[0].Duration)
+	}
+	if sum := m.DialDuration + m.HandshakeDuration + m.CommandsDuration; math.Abs(m.RunLength-sum) > 0.1 {
+		t.Errorf("dial, handshake and commands sum to %vs, want about the run length %vs", sum, m.RunLength)
+	}
+}
+
+func TestRunStopOnFailure(t *testing.T) {
+	host, port := fakeSSHServer(t)
+	yes, no := true, false
+
+	tests := []struct {
+		name    string
+		global  bool  // StopOnFailure
+		command *bool // the failing command's
+		skipped bool  // the third command
+	}{
+		{"global", true, nil, true},
+		{"command", false, &yes, true},
+		{"command overrides global", true, &no, false},
+		{"off", false, nil, false},
+	}
+	for _, tt := range tests {
+		b, err := Run(context.Background(), Options{
+			Inventory: Inventory{{HostName: host, Port: port, Username: "u"}},
+			Commands: []Command{
+				{Name: "build", Command: "echo build"},
+				{Name: "test", Command: "false", StopOnFailure: tt.command},
+				{Name: "deploy", Command: "echo deploy"},
+			},
+			Finally:       []Command{{Name: "cleanup", Command: "true"}},
+			StopOnFailure: tt.global,
+			Auth:          Auth{Methods: []string{"password"}, Password: "secret"},
+			HostKeyMode:   HostKeyInsecure,
+			DownloadDir:   t.TempDir(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := b.MachineData[0]
+		if !m.Connection || len(m.StreamData) != 4 {
+			t.Fatalf("%s: connection %v with %d streams, want 4: %v", tt.name, m.Connection, len(m.StreamData), m.ConnectionErrors)
+		}
+		if s := m.StreamData[1]; s.Succeeded || s.ExitCode != 1 {
+			t.Errorf("%s: test exit code %d succeeded=%v, want 1 false", tt.name, s.ExitCode, s.Succeeded)
+		}
+
+		deploy := m.StreamData[2]
+		if tt.skipped {
+			if deploy.ExitCode != -1 || deploy.Succeeded || deploy.StartTime != "" || deploy.Stdout != "" {
+				t.Errorf("%s: deploy exit code %d succeeded=%v, want it not run", tt.name, deploy.ExitCode, deploy.Succeeded)
+			}
+			if len(deploy.StreamErrors) != 1 || deploy.StreamErrors[0] != "skipped due to prior failure" {
+				t.Errorf("%s: deploy stream errors %q, want skipped due to prior failure", tt.name, deploy.StreamErrors)
+			}
+		} else if !deploy.Succeeded || deploy.Stdout != "deploy\n" {
+			t.Errorf("%s: deploy %q succeeded=%v, want it run: %v", tt.name, deploy.Stdout, deploy.Succeeded, deploy.StreamErrors)
+		}
+
+		// finally commands always run
+		if s := m.StreamData[3]; !s.Finalizer || !s.Succeeded {
+			t.Errorf("%s: cleanup finalizer=%v succeeded=%v, want it run", tt.name, s.Finalizer, s.Succeeded)
+		}
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	host, port := fakeSSHServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// one machine at a time, the run is cancelled once the first completes
+	var completed int
+	b, err := Run(ctx, Options{
+		Inventory: Inventory{
+			{HostName: host, Port: port, Username: "a"},
+			{HostName: host, Port: port, Username: "b"},
+			{HostName: host, Port: port, Username: "c"},
+		},
+		Commands:       []Command{{Name: "echo", Command: "echo hello"}},
+		MaxConcurrency: 1,
+		OutputOrder:    OutputOrderInventory,
+		Auth:           Auth{Methods: []string{"password"}, Password: "secret"},
+		HostKeyMode:    HostKeyInsecure,
+		DownloadDir:    t.TempDir(),
+		OnMachine: func(Machine) {
+			if completed++; completed == 1 {
+				cancel()
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(b.MachineData) != 3 {
+		t.Fatalf("got %d machines, want 3", len(b.MachineData))
+	}
+	if m := b.MachineData[0]; !m.Connection || len(m.StreamData) != 1 || !m.StreamData[0].Succeeded {
+		t.Errorf("%s: connection %v streams %+v, want the first machine to complete", m.Username, m.Connection, m.StreamData)
+	}
+	for _, m := range b.MachineData[1:] {
+		if m.Connection || len(m.StreamData) != 0 {
+			t.Errorf("%s: connection %v with %d streams, want it not run", m.Username, m.Connection, len(m.StreamData))
+		}
+		if len(m.ConnectionErrors) != 1 || m.ConnectionErrors[0] != "cancelled before run" {
+			t.Errorf("%s: connection errors %q, want cancelled before run", m.Username, m.ConnectionErrors)
+		}
+	}
+	// cancelled rather than cut short by boomerang
+	if b.MetaData.Truncated != "" {
+		t.Errorf("truncated = %q, want empty", b.MetaData.Truncated)
+	}
+}
+
+func TestRunGlobalTimeout(t *testing.T) {
+	host, port := fakeSSHServer(t)
+
+	// a and b are cut short while running, c waits for a slot until the run is aborted
+	slow := []Command{{Name: "first", Command: "echo first"}, {Name: "slow", Command: "sleep 3"}}
+	start := time.Now()
+	b, err := Run(context.Background(), Options{
+		Inventory: Inventory{
+			{HostName: host, Port: port, Username: "a", Commands: slow},
+			{HostName: host, Port: port, Username: "b", Commands: slow},
+			{HostName: host, Port: port, Username: "c"},
+		},
+		Commands:       []Command{{Name: "echo", Command: "echo hello"}},
+		GlobalTimeout:  500 * time.Millisecond,
+		MaxConcurrency: 2,
+		OutputOrder:    OutputOrderInventory,
+		Auth:           Auth{Methods: []string{"password"}, Password: "secret"},
+		HostKeyMode:    HostKeyInsecure,
+		DownloadDir:    t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2500*time.Millisecond {
+		t.Errorf("took %v, want the run aborted at the global timeout", elapsed)
+	}
+
+	if b.MetaData.Truncated != "global timeout" {
+		t.Errorf("truncated = %q, want global timeout", b.MetaData.Truncated)
+	}
+	if len(b.MachineData) != 3 {
+		t.Fatalf("got %d machines, want 3", len(b.MachineData))
+	}
+
+	// partial results of the machines that were running are kept
+	for _, m := range b.MachineData[:2] {
+		if !m.Connection || len(m.StreamData) != 2 {
+			t.Errorf("%s: connection %v with %d streams, want 2: %v", m.Username, m.Connection, len(m.StreamData), m.ConnectionErrors)
+			continue
+		}
+		if s := m.StreamData[0]; !s.Succeeded || s.Stdout != "first\n" {
+			t.Errorf("%s: first %q succeeded=%v, want it completed", m.Username, s.Stdout, s.Succeeded)
+		}
+		s := m.StreamData[1]
+		if s.ExitCode != -1 || s.Interrupted != interruptedCancelled {
+			t.Errorf("%s: slow exit code %d interrupted %q, want -1 %q", m.Username, s.ExitCode, s.Interrupted, interruptedCancelled)
+		}
+		if want := "Command aborted while running: global timeout"; len(s.StreamErrors) == 0 || s.StreamErrors[0] != want {
+			t.Errorf("%s: slow stream errors %q, want %q", m.Username, s.StreamErrors, want)
+		}
+	}
+	if m := b.MachineData[2]; m.Connection || len(m.ConnectionErrors) != 1 || m.ConnectionErrors[0] != "aborted before run: global timeout" {
+		t.Errorf("%s: connection %v errors %q, want aborted before run: global timeout", m.Username, m.Connection, m.ConnectionErrors)
+	}
+
+	// what completed is still written out
+	by, err := MarshalBoomerang(b, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"truncated":"global timeout"`, `"stdout":"first\n"`} {
+		if !strings.Contains(string(by), want) {
+			t.Errorf("output does not contain %s: %s", want, by)
+		}
+	}
+}
+
+// closedPort returns the host and port of an address on 127.0.0.2 refusing connections.
+func closedPort(t *testing.T) (string, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("could not listen on 127.0.0.2: %v", err)
+	}
+	l.Close()
+	h, p, _ := net.SplitHostPort(l.Addr().String())
+	return h, p
+}
+
+func TestRunFailFast(t *testing.T) {
+	host, port := fakeSSHServer(t)
+	_, closed := closedPort(t)
+
+	// 8 of 10 machines fail to connect, run one at a time so the threshold is crossed at the
+	// 5th: 3 of 5 failed
+	var inventory Inventory
+	for i := 0; i < 10; i++ {
+		s := SSHInfo{HostName: host, Port: port, Username: fmt.Sprintf("u%d", i)}
+		if i >= 2 {
+			s.Port = closed
+		}
+		inventory.Add(s)
+	}
+
+	b, err := Run(context.Background(), Options{
+		Inventory:         inventory,
+		Commands:          []Command{{Name: "echo", Command: "echo hello"}},
+		FailFastThreshold: 50,
+		FailFastMinHosts:  5,
+		MaxConcurrency:    1,
+		ConnTimeout:       time.Second,
+		OutputOrder:       OutputOrderInventory,
+		Auth:              Auth{Methods: []string{"password"}, Password: "secret"},
+		HostKeyMode:       HostKeyInsecure,
+		DownloadDir:       t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cause := "fail fast: 3 of 5 machines failed to connect, over failFastThreshold 50%"
+	if b.MetaData.Truncated != cause {
+		t.Errorf("truncated = %q, want %q", b.MetaData.Truncated, cause)
+	}
+	if len(b.MachineData) != 10 {
+		t.Fatalf("got %d machines, want 10", len(b.MachineData))
+	}
+	for i, m := range b.MachineData {
+		switch {
+		case i < 2:
+			if !m.Connection || len(m.StreamData) != 1 {
+				t.Errorf("%s: connection %v with %d streams, want it run", m.Username, m.Connection, len(m.StreamData))
+			}
+		case i < 5:
+			if m.Connection || len(m.ConnectionErrors) != 1 || strings.Contains(m.ConnectionErrors[0], "before run") {
+				t.Errorf("%s: connection %v errors %q, want it to fail to connect", m.Username, m.Connection, m.ConnectionErrors)
+			}
+		default:
+			if want := "aborted before run: " + cause; m.Connection || len(m.ConnectionErrors) != 1 || m.ConnectionErrors[0] != want {
+				t.Errorf("%s: connection %v errors %q, want %q", m.Username, m.Connection, m.ConnectionErrors, want)
+			}
+		}
+	}
+	if h := b.MetaData.Health; h.Succeeded != 2 || h.ConnectionFailed != 8 {
+		t.Errorf("health = %+v, want 2 succeeded and 8 connection failed", h)
+	}
+}
+
+func TestSummarizeRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		machines []Machine
+		want     Retries
+	}{
+		{"none", nil, Retries{}},
+		{"first attempt", []Machine{{ConnectionAttempts: 1}}, Retries{}},
+		{
+			"connection retries",
+			[]Machine{{ConnectionAttempts: 3}, {ConnectionAttempts: 1}, {ConnectionAttempts: 2}},
+			Retries{ConnectionRetries: 3, MachinesRetried: 2},
+		},
+		{
+			"command retries",
+			[]Machine{{ConnectionAttempts: 1, StreamData: []Stream{
+				{Attempts: make([]Attempt, 3)},
+				{Attempts: make([]Attempt, 1)},
+				{},
+			}}},
+			Retries{CommandRetries: 2},
+		},
+	}
+	for _, tt := range tests {
+		b := &Boomerang{MachineData: tt.machines}
+		b.summarizeRetries()
+		if b.MetaData.Retries != tt.want {
+			t.Errorf("%s: retries = %+v, want %+v", tt.name, b.MetaData.Retries, tt.want)
+		}
+	}
+}
+
+func TestExecuteParallelOrder(t *testing.T) {
+	host, port := fakeSSHServer(t)
+	opts := Options{
+		Auth:             Auth{Methods: []string{"password"}, Password: "secret"},
+		HostKeyMode:      HostKeyInsecure,
+		ParallelCommands: true,
+	}
+	m := NewMachine(SSHInfo{HostName: host, Port: port, Username: "u"})
+	client, err := m.Dial(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// later commands finish first, results are still in the order listed
+	var cs []Command
+	for i := 0; i < 4; i++ {
+		cs = append(cs, Command{Name: fmt.Sprintf("c%d", i), Command: fmt.Sprintf("sleep 0.%d", 4-i)})
+	}
+
+	tests := []struct {
+		maxSessions int
+		maxElapsed  time.Duration // commands must have run concurrently
+	}{
+		{0, 600 * time.Millisecond},
+		{2, 900 * time.Millisecond},
+		{1, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		opts.MaxSessions = tt.maxSessions
+		start := time.Now()
+		out, err := m.Exec(context.Background(), client, cs, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed > tt.maxElapsed {
+			t.Errorf("maxSessions %d: took %v, want at most %v", tt.maxSessions, elapsed, tt.maxElapsed)
+		}
+		if len(out) != len(cs) {
+			t.Fatalf("maxSessions %d: got %d streams, want %d", tt.maxSessions, len(out), len(cs))
+		}
+		for i, s := range out {
+			if s.Name != cs[i].Name || s.Stdout != cs[i].Command || !s.Succeeded {
+				t.Errorf("maxSessions %d: stream %d = %q %q succeeded=%v, want %q", tt.maxSessions, i, s.Name, s.Stdout, s.Succeeded, cs[i].Name)
+			}
+		}
+	}
+}
+
+func TestExecRetries(t *testing.T) {
+	host, port := fakeSSHServer(t)
+	opts := Options{
+		Auth:        Auth{Methods: []string{"password"}, Password: "secret"},
+		HostKeyMode: HostKeyInsecure,
+	}
+	m := NewMachine(SSHInfo{HostName: host, Port: port, Username: "u"})
+	client, err := m.Dial(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	tests := []struct {
+		name     string
+		c        Command
+		attempts int // 0 if not retried
+	}{
+		{"succeeds", Command{Command: "true", Retries: 2}, 0},
+		{"fails", Command{Command: "false", Retries: 2}, 3},
+		{"no retries", Command{Command: "false"}, 0},
+		{"exit code retried", Command{Command: "false", Retries: 1, RetryOnExit: []int{2, 1}}, 2},
+		{"exit code not retried", Command{Command: "false", Retries: 2, RetryOnExit: []int{2}}, 0},
+	}
+	for _, tt := range tests {
+		tt.c.Name = tt.name
+		out, err := m.Exec(context.Background(), client, []Command{tt.c}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != 1 {
+			t.Fatalf("%s: got %d streams, want 1", tt.name, len(out))
+		}
+		if n := len(out[0].Attempts); n != tt.attempts {
+			t.Errorf("%s: %d attempts, want %d", tt.name, n, tt.attempts)
+		}
+		for i, a := range out[0].Attempts {
+			if want := out[0].ExitCode; a.ExitCode != want {
+				t.Errorf("%s: attempt %d exit code %d, want %d", tt.name, i, a.ExitCode, want)
+			}
+		}
+	}
+}
+
+func TestMarshalBoomerang(t *testing.T) {
+	b := &Boomerang{MachineData: []Machine{*NewMachine(SSHInfo{HostName: "web1", Password: "secret"})}}
+
+	tests := []struct {
+		name    string
+		data    interface{}
+		indent  bool
+		want    []string // substrings of the output
+		wantErr bool
+	}{
+		{"compact", b, false, []string{`{"metadata":{`, `"hostname":"web1"`}, false},
+		{"indented", b, true, []string{"{\n\t\"metadata\": {", `"hostname": "web1"`}, false},
+		{"any value", map[string]int{"a": 1}, false, []string{`{"a":1}`}, false},
+		{"unsupported value", make(chan int), false, nil, true},
+	}
+	for _, tt := range tests {
+		by, err := MarshalBoomerang(tt.data, tt.indent)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error: %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		for _, w := range tt.want {
+			if !strings.Contains(string(by), w) {
+				t.Errorf("%s: output %s does not contain %q", tt.name, by, w)
+			}
+		}
+		// the password is never written out
+		if strings.Contains(string(by), "secret") {
+			t.Errorf("%s: output contains the password: %s", tt.name, by)
+		}
+	}
+}
+
+func TestFailFast(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold float64
+		min       int
+		connected string // machines completing, + connected and - failed
+		trippedAt int    // index of the machine tripping the threshold, -1 if none
+		cause     string
+	}{
+		{"under threshold", 50, 0, "+-+-+-", -1, ""},
+		{"over threshold", 50, 0, "+--", 2, "fail fast: 2 of 3 machines failed to connect, over failFastThreshold 50%"},
+		{"first machine", 10, 0, "-++", 0, "fail fast: 1 of 1 machines failed to connect, over failFastThreshold 10%"},
+		{"waits for min", 10, 3, "--+", 2, "fail fast: 2 of 3 machines failed to connect, over failFastThreshold 10%"},
+		{"recovers before min", 50, 4, "-+++", -1, ""},
+		{"all connected", 0.5, 0, "++++", -1, ""},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		f := &failFast{threshold: tt.threshold, min: tt.min, cancel: cancel}
+		tripped := -1
+		for i, c := range tt.connected {
+			f.machine(ctx, Machine{Connection: c == '+'})
+			if tripped < 0 && ctx.Err() != nil {
+				tripped = i
+			}
+		}
+		if tripped != tt.trippedAt {
+			t.Errorf("%s: tripped at %d, want %d", tt.name, tripped, tt.trippedAt)
+		}
+		var cause string
+		if err := context.Cause(ctx); err != nil {
+			cause = err.Error()
+		}
+		if cause != tt.cause {
+			t.Errorf("%s: cause %q, want %q", tt.name, cause, tt.cause)
+		}
+		// machines completing after the run was cancelled aren't counted
+		if tripped >= 0 && f.completed != tripped+1 {
+			t.Errorf("%s: counted %d machines, want %d", tt.name, f.completed, tripped+1)
+		}
+		cancel(nil)
+	}
+}
+
+func TestSummarizeHealth(t *testing.T) {
+	ok := Stream{Name: "up", Succeeded: true}
+	tests := []struct {
+		name     string
+		machines []Machine
+		want     Health
+	}{
+		{"none", nil, Health{CommandFailures: map[string]int{}}},
+		{"succeeded", []Machine{{Connection: true, StreamData: []Stream{ok}}, {Connection: true}}, Health{Succeeded: 2, CommandFailures: map[string]int{}}},
+		{
+			"partially failed",
+			[]Machine{
+				{Connection: true, StreamData: []Stream{ok, {Name: "df"}}},
+				{Connection: true, StreamData: []Stream{{Name: "df"}, {Name: "ps"}}},
+			},
+			Health{PartiallyFailed: 2, CommandFailures: map[string]int{"df": 2, "ps": 1}},
+		},
+		{
+			"connection failed",
+			[]Machine{{}, {Connection: true, StreamData: []Stream{ok}}, {StreamData: []Stream{{Name: "ping"}}}},
+			Health{Succeeded: 1, ConnectionFailed: 2, CommandFailures: map[string]int{"ping": 1}},
+		},
+	}
+	for _, tt := range tests {
+		b := &Boomerang{MachineData: tt.machines}
+		b.summarizeHealth()
+		if got := b.MetaData.Health; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: health = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRunTemplateResults(t *testing.T) {
+	s := startFakeSSH(t, &fakeSSH{})
+
+	tests := []struct {
+		name     string
+		command  string
+		stdout   string
+		exitCode int
+		errs     []string
+	}{
+		{"version", "v1.2.3", "v1.2.3", 0, nil},
+		{"upgrade", "upgrade --from {{ .Results.version.Stdout }}", "upgrade --from v1.2.3", 0, nil},
+		// failed commands are in .Results too
+		{"failing", "false", "false", 1, []string{"Command completed unsuccessfully: [*ssh.ExitError]: Process exited with status 1"}},
+		{"check", "{{ if eq .Results.failing.ExitCode 0 }}ok{{ else }}skip {{ .Results.failing.ExitCode }}{{ end }}", "skip 1", 0, nil},
+		{"my-name", "named", "named", 0, nil},
+		{"index", `{{ (index .Results "my-name").Stdout }} {{ $.Results.upgrade.Stdout }}`, "named upgrade --from v1.2.3", 0, nil},
+		// later hasn't run yet
+		{"ahead", "x{{ .Results.later.Stdout }}", "", -1, []string{`Failed to render command: missing key "later" for host ` + s.host}},
+		{"later", "later", "later", 0, nil},
+	}
+	commands := make([]Command, len(tests))
+	for i, tt := range tests {
+		commands[i] = Command{Name: tt.name, Command: tt.command}
+	}
+
+	for _, strict := range []bool{true, false} {
+		b, err := Run(context.Background(), Options{
+			Inventory:        Inventory{{HostName: s.host, Port: s.port, Username: "u"}},
+			Commands:         commands,
+			TemplateCommands: true,
+			TemplateStrict:   strict,
+			Auth:             Auth{Methods: []string{"password"}, Password: "secret"},
+			HostKeyMode:      HostKeyInsecure,
+			DownloadDir:      t.TempDir(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := b.MachineData[0]
+		if len(m.StreamData) != len(tests) {
+			t.Fatalf("strict %v: %d streams, want %d: %v", strict, len(m.StreamData), len(tests), m.ConnectionErrors)
+		}
+		for i, tt := range tests {
+			stdout, exitCode, errs := tt.stdout, tt.exitCode, tt.errs
+			if tt.name == "ahead" && !strict {
+				// like any missing key, it renders as <no value> and the command runs
+				stdout, exitCode, errs = "x<no value>", 0, nil
+			}
+			sd := m.StreamData[i]
+			if sd.Name != tt.name || sd.Stdout != stdout || sd.ExitCode != exitCode {
+				t.Errorf("strict %v: %s: stdout %q exit %d, want %q exit %d", strict, sd.Name, sd.Stdout, sd.ExitCode, stdout, exitCode)
+			}
+			// nil and empty are the same
+			if len(sd.StreamErrors)+len(errs) > 0 && !reflect.DeepEqual(sd.StreamErrors, errs) {
+				t.Errorf("strict %v: %s: stream errors %q, want %q", strict, sd.Name, sd.StreamErrors, errs)
+			}
+		}
+	}
+}
+
+func TestRunFailOnStderr(t *testing.T) {
+	s := startFakeSSH(t, &fakeSSH{})
+	no := false
+
+	tests := []struct {
+		name         string
+		failOnStderr bool // the global option
+		command      Command
+		stderr       string // recorded either way
+		succeeded    bool
+		streamErrors []string
+	}{
+		{"off", false, Command{Name: "warn", Command: "warn"}, "warning: deprecated\n", true, nil},
+		{"on", true, Command{Name: "warn", Command: "warn"}, "warning: deprecated\n", false, []string{"Command wrote to stderr and failOnStderr is set"}},
+		{"command override", true, Command{Name: "warn", Command: "warn", FailOnStderr: &no}, "warning: deprecated\n", true, nil},
+		{"only whitespace", true, Command{Name: "blank", Command: "blank"}, "\n", true, nil},
+	}
+	for _, tt := range tests {
+		b, err := Run(context.Background(), Options{
+			Inventory:    Inventory{{HostName: s.host, Port: s.port, Username: "u"}},
+			Commands:     []Command{tt.command},
+			FailOnStderr: tt.failOnStderr,
+			Auth:         Auth{Methods: []string{"password"}, Password: "secret"},
+			HostKeyMode:  HostKeyInsecure,
+			DownloadDir:  t.TempDir(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := b.MachineData[0]
+		if len(m.StreamData) != 1 {
+			t.Fatalf("%s: %d streams, want 1: %v", tt.name, len(m.StreamData), m.ConnectionErrors)
+		}
+		sd := m.StreamData[0]
+		// the exit code is the command's either way
+		if sd.Succeeded != tt.succeeded || sd.ExitCode != 0 || sd.Stderr != tt.stderr {
+			t.Errorf("%s: succeeded %v exit %d stderr %q, want succeeded %v exit 0 stderr %q", tt.name, sd.Succeeded, sd.ExitCode, sd.Stderr, tt.succeeded, tt.stderr)
+		}
+		// nil and empty are the same
+		if len(sd.StreamErrors)+len(tt.streamErrors) > 0 && !reflect.DeepEqual(sd.StreamErrors, tt.streamErrors) {
+			t.Errorf("%s: stream errors %q, want %q", tt.name, sd.StreamErrors, tt.streamErrors)
+		}
+	}
+}
+
+func TestRunMaxConcurrency(t *testing.T) {
+	s := startFakeSSH(t, &fakeSSH{})
+
+	var inventory Inventory
+	for i := 0; i < 6; i++ {
+		inventory.Add(SSHInfo{HostName: s.host, Port: s.port, Username: fmt.Sprintf("u%d", i)})
+	}
+	b, err := Run(context.Background(), Options{
+		Inventory:      inventory,
+		Commands:       []Command{{Name: "sleep", Command: "sleep 0.2"}},
+		MaxConcurrency: 2,
+		Auth:           Auth{Methods: []string{"password"}, Password: "secret"},
+		HostKeyMode:    HostKeyInsecure,
+		DownloadDir:    t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range b.MachineData {
+		if !m.Connection || len(m.StreamData) != 1 || !m.StreamData[0].Succeeded {
+			t.Fatalf("%s: connection %v with streams %+v, want the command to succeed: %v", m.Username, m.Connection, m.StreamData, m.ConnectionErrors)
+		}
+	}
+	// 6 machines of 0.2s each, 2 at a time, must have overlapped
+	if peak := s.peak.Load(); peak != 2 {
+		t.Errorf("%d commands ran at once, want at most 2, and 2 to have overlapped", peak)
+	}
+}
+
+func TestRunTrimOutput(t *testing.T) {
+	host, port := fakeSSHServer(t)
+
+	for _, trim := range []bool{false, true} {
+		b, err := Run(context.Background(), Options{
+			Inventory:   Inventory{{HostName: host, Port: port, Username: "u"}},
+			Commands:    []Command{{Name: "echo", Command: "echo hello"}, {Name: "warn", Command: "warn"}},
+			TrimOutput:  trim,
+			Auth:        Auth{Methods: []string{"password"}, Password: "secret"},
+			HostKeyMode: HostKeyInsecure,
+			DownloadDir: t.TempDir(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sds := b.MachineData[0].StreamData
+		if len(sds) != 2 {
+			t.Fatalf("trim %v: got %d streams, want 2: %v", trim, len(sds), b.MachineData[0].ConnectionErrors)
+		}
+		wantStdout, wantStderr := "hello\n", "warning: deprecated\n"
+		if trim {
+			wantStdout, wantStderr = "hello", "warning: deprecated"
+		}
+		if sds[0].Stdout != wantStdout || sds[1].Stderr != wantStderr {
+			t.Errorf("trim %v: stdout %q and stderr %q, want %q and %q", trim, sds[0].Stdout, sds[1].Stderr, wantStdout, wantStderr)
+		}
+	}
+}
+
+func TestRunLogger(t *testing.T) {
+	s := startFakeSSH(t, &fakeSSH{})
+	// another loopback address, so each host's lines can be told apart
+	_, downPort := closedPort(t)
+	downHost := "127.0.0.3"
+
+	var buf bytes.Buffer
+	_, err := Run(context.Background(), Options{
+		Inventory: Inventory{
+			{HostName: s.host, Port: s.port, Username: "u"},
+			{HostName: downHost, Port: downPort, Username: "u"},
+		},
+		Commands:    []Command{{Name: "up", Command: "uptime"}, {Name: "df", Command: "df -h"}},
+		Logger:      slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		Auth:        Auth{Methods: []string{"password"}, Password: "secret"},
+		HostKeyMode: HostKeyInsecure,
+		DownloadDir: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(buf.String(), "\n")
+	tests := []struct {
+		host string
+		want []string // all in one line
+	}{
+		{s.host, []string{"msg=connected"}},
+		{s.host, []string{`msg="command finished"`, "command=up"}},
+		{s.host, []string{`msg="command finished"`, "command=df"}},
+		{downHost, []string{`msg="connection failed"`}},
+	}
+	for _, tt := range tests {
+		found := false
+		for _, l := range lines {
+			match := strings.Contains(l, "host="+tt.host+" ")
+			for _, w := range tt.want {
+				match = match && strings.Contains(l, w)
+			}
+			found = found || match
+		}
+		if !found {
+			t.Errorf("%s: no line with %q:\n%s", tt.host, tt.want, buf.String())
+		}
+	}
+	for _, l := range lines {
+		if strings.Contains(l, "host="+downHost+" ") && strings.Contains(l, "command=") {
+			t.Errorf("%s: a command was logged without a connection: %s", downHost, l)
+		}
+	}
+}
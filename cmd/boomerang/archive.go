@@ -0,0 +1,151 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/mfridman/boomerang"
+	"github.com/pkg/errors"
+)
+
+// writeArchive writes b as a single tar.gz, encrypted to recipient if non-nil, and returns the
+// file written. The archive has an entry per machine, <hostname>.json with b's metadata as
+// writeSplit would write, and the files downloaded from it under <hostname>/. Machines sharing
+// a hostname are numbered, e.g. web1_2.json.
+// No file is written when o.Writer is set.
+func (o outCfg) writeArchive(b *boomerang.Boomerang, recipient age.Recipient, indent bool) (string, error) {
+	if o.Writer != nil {
+		return "", o.encodeArchive(o.Writer, b, recipient, indent)
+	}
+
+	file := o.Path
+	if file == "" {
+		var err error
+		if file, err = o.toFile(); err != nil {
+			return "", err
+		}
+	}
+
+	f, err := createAtomic(file)
+	if err != nil {
+		return "", err
+	}
+	if err := o.encodeArchive(f, b, recipient, indent); err != nil {
+		f.abort()
+		return "", err
+	}
+	return file, f.commit()
+}
+
+// encodeArchive writes the archive of b to w, see writeArchive. Entries are streamed, nothing
+// is held in memory beyond a single machine's JSON.
+func (o outCfg) encodeArchive(w io.Writer, b *boomerang.Boomerang, recipient age.Recipient, indent bool) error {
+	var enc io.WriteCloser
+	if recipient != nil {
+		var err error
+		if enc, err = age.Encrypt(w, recipient); err != nil {
+			return err
+		}
+		w = enc
+	}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	seen := make(map[string]int)
+	for _, m := range b.MachineData {
+		name := boomerang.SafeFileName(m.HostName)
+		if seen[name]++; seen[name] > 1 {
+			name = fmt.Sprintf("%s_%d", name, seen[name])
+		}
+
+		by, err := boomerang.MarshalBoomerang(&boomerang.Boomerang{MetaData: b.MetaData, MachineData: []boomerang.Machine{m}}, indent)
+		if err != nil {
+			return errors.Wrapf(err, "[%v] failed writing output", m.HostName)
+		}
+		hdr := &tar.Header{Name: name + ".json", Mode: 0644, Size: int64(len(by)), ModTime: o.DateTime}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrap(err, "failed writing archive")
+		}
+		if _, err := io.Copy(tw, bytes.NewReader(by)); err != nil {
+			return errors.Wrap(err, "failed writing archive")
+		}
+
+		for _, f := range downloads(m) {
+			if err := archiveFile(tw, path.Join(name, filepath.ToSlash(f.rel)), f.local); err != nil {
+				return errors.Wrapf(err, "[%v] failed archiving download %s", m.HostName, f.local)
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return errors.Wrap(err, "failed writing archive")
+	}
+	// the gzip footer must be written before the age writer is closed
+	if err := gz.Close(); err != nil {
+		return errors.Wrap(err, "failed closing gzip writer")
+	}
+	if enc != nil {
+		return enc.Close()
+	}
+	return nil
+}
+
+// downloaded is a file downloaded from a machine, at local, rel to raw/<hostname>/.
+type downloaded struct {
+	local, rel string
+}
+
+// downloads returns the files downloaded from m that are still on disk. A file missing, e.g.
+// removed since, is skipped with a warning. Files are found by the paths they were written to,
+// so an anonymized machine's downloads are still archived.
+func downloads(m boomerang.Machine) []downloaded {
+	dir := m.DownloadDir + string(filepath.Separator)
+
+	var out []downloaded
+	for _, s := range m.StreamData {
+		// only downloads record the file written, uploads have a local path too
+		if s.Transfer == nil || s.Transfer.File == "" || s.ExitCode != 0 {
+			continue
+		}
+		file := s.Transfer.File
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			log.Printf("Warning: [%v] download %s is missing, not archived\n", m.HostName, s.Transfer.Local)
+			continue
+		}
+		out = append(out, downloaded{local: file, rel: strings.TrimPrefix(file, dir)})
+	}
+	return out
+}
+
+// archiveFile copies the file at local into tw as name.
+func archiveFile(tw *tar.Writer, name, local string) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
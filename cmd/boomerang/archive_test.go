@@ -0,0 +1,68 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/mfridman/boomerang"
+)
+
+func TestArchiveAnonymizedDownloads(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db1")
+	if err := os.MkdirAll(filepath.Join(dir, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "logs", "app.log")
+	if err := os.WriteFile(file, []byte("log"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := boomerang.Machine{
+		SSHInfo: boomerang.SSHInfo{HostName: "db1", DownloadDir: dir},
+		StreamData: []boomerang.Stream{
+			{Name: "logs", Transfer: &boomerang.Transfer{Local: file, Remote: "/var/log/app.log", File: file}},
+			// an upload has a local path, but isn't archived
+			{Name: "upload", Transfer: &boomerang.Transfer{Local: "app.conf", Remote: "/etc/app.conf"}},
+		},
+	}
+	b := &boomerang.Boomerang{MachineData: []boomerang.Machine{m}}
+	mapping := boomerang.AnonymizeHosts(b.MachineData, "salt")
+
+	var buf bytes.Buffer
+	if err := (outCfg{}).encodeArchive(&buf, b, nil, false); err != nil {
+		t.Fatal(err)
+	}
+
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+
+	var p string
+	for k := range mapping {
+		p = k
+	}
+	want := []string{p + ".json", p + "/logs/app.log"}
+	if len(names) != len(want) || names[0] != want[0] || names[1] != want[1] {
+		t.Errorf("archive entries = %v, want %v", names, want)
+	}
+}
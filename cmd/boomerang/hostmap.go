@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// writeHostMap merges mapping into the pseudonym -> hostname mapping file, creating it if
+// necessary. The file is needed to de-anonymize output and should not be shared.
+func writeHostMap(file string, mapping map[string]string) error {
+	all := make(map[string]string)
+
+	if by, err := ioutil.ReadFile(file); err == nil {
+		if err := json.Unmarshal(by, &all); err != nil {
+			return errors.Wrapf(err, "could not decode host map [%v]", file)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	for p, h := range mapping {
+		all[p] = h
+	}
+
+	by, err := json.MarshalIndent(all, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "failed marshal")
+	}
+
+	return ioutil.WriteFile(file, by, 0600)
+}
+
+// saltFile returns the salt file kept next to the mapping file, e.g. hostmap.salt.
+func saltFile(mapFile string) string {
+	return strings.TrimSuffix(mapFile, filepath.Ext(mapFile)) + ".salt"
+}
+
+// readOrCreateSalt returns the salt in file, creating it with a random salt if necessary. Without
+// a salt, pseudonyms could be reversed by hashing known hostnames.
+func readOrCreateSalt(file string) (string, error) {
+	if by, err := ioutil.ReadFile(file); err == nil {
+		if salt := strings.TrimSpace(string(by)); salt != "" {
+			return salt, nil
+		}
+		return "", errors.Errorf("salt file is empty [%v]", file)
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "could not generate salt")
+	}
+	salt := hex.EncodeToString(b)
+	if err := ioutil.WriteFile(file, []byte(salt+"\n"), 0600); err != nil {
+		return "", errors.Wrapf(err, "could not write salt file [%v]", file)
+	}
+	return salt, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadOrCreateSalt(t *testing.T) {
+	file := saltFile(filepath.Join(t.TempDir(), "hostmap.json"))
+	if filepath.Base(file) != "hostmap.salt" {
+		t.Fatalf("saltFile = %q, want hostmap.salt", file)
+	}
+
+	salt, err := readOrCreateSalt(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(salt) != 64 {
+		t.Errorf("salt = %q, want 32 random bytes hex encoded", salt)
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("salt file mode = %v, want 0600", fi.Mode().Perm())
+	}
+
+	// pseudonyms stay stable across runs
+	again, err := readOrCreateSalt(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != salt {
+		t.Errorf("second read = %q, want %q", again, salt)
+	}
+
+	if err := os.WriteFile(file, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readOrCreateSalt(file); err == nil {
+		t.Error("empty salt file must be an error")
+	}
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/itchyny/gojq"
+	"github.com/mfridman/boomerang"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Inventory formats.
+const (
+	formatJSON = "json"
+	formatYAML = "yaml"
+	formatCSV  = "csv"
+)
+
+// formatFromName detects the inventory format from a file name or URL path extension,
+// defaulting to JSON.
+func formatFromName(name string) string {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".yaml", ".yml":
+		return formatYAML
+	case ".csv":
+		return formatCSV
+	default:
+		return formatJSON
+	}
+}
+
+// formatFromContentType detects the inventory format from a Content-Type header. It returns
+// an empty string if the header doesn't name a known format.
+func formatFromContentType(ct string) string {
+	t, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return ""
+	}
+	switch t {
+	case "application/json":
+		return formatJSON
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+		return formatYAML
+	case "text/csv":
+		return formatCSV
+	default:
+		return ""
+	}
+}
+
+// decodeDocument decodes an inventory document in the given format into generic JSON-like
+// values, i.e. maps, slices, strings, numbers and bools.
+func decodeDocument(r io.Reader, format string) (interface{}, error) {
+	by, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc interface{}
+	switch format {
+	case formatYAML:
+		if err := yaml.Unmarshal(by, &doc); err != nil {
+			return nil, errors.Wrap(err, "malformed yaml")
+		}
+	case formatCSV:
+		return decodeCSV(by)
+	default:
+		// numbers are kept as json.Number, so large ids in extras round trip exactly
+		d := json.NewDecoder(bytes.NewReader(by))
+		d.UseNumber()
+		if err := d.Decode(&doc); err != nil {
+			if e, ok := err.(*json.SyntaxError); ok {
+				return nil, errors.Wrapf(err, "malformed json on line %d", bytes.Count(by[:e.Offset], []byte("\n"))+1)
+			}
+			return nil, errors.Wrap(err, "malformed json")
+		}
+	}
+	return doc, nil
+}
+
+// csvFields are the CSV columns mapped to SSHInfo fields. port is accepted as an alias for ssh_port.
+var csvFields = map[string]string{
+	"hostname":      "hostname",
+	"username":      "username",
+	"ssh_port":      "ssh_port",
+	"port":          "ssh_port",
+	"jump_host":     "jump_host",
+	"auth":          "auth",
+	"key_location":  "key_location",
+	"cert_location": "cert_location",
+	"password":      "password",
+
+	"host_key_fingerprint": "host_key_fingerprint",
+}
+
+// decodeCSV decodes a CSV inventory with a header row into machine objects. Columns that
+// aren't SSHInfo fields are placed into extras.
+func decodeCSV(by []byte) (interface{}, error) {
+	cr := csv.NewReader(bytes.NewReader(by))
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed csv header")
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+
+	machines := make([]interface{}, 0)
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "malformed csv")
+		}
+		line, _ := cr.FieldPos(0)
+
+		m := make(map[string]interface{})
+		extras := make(map[string]interface{})
+		for i, col := range header {
+			if f, ok := csvFields[strings.ToLower(col)]; ok {
+				m[f] = record[i]
+				continue
+			}
+			extras[col] = record[i]
+		}
+		if len(extras) > 0 {
+			m["extras"] = extras
+		}
+
+		if m["hostname"] == nil || m["hostname"] == "" || m["username"] == nil || m["username"] == "" {
+			return nil, errors.Errorf("csv line %d: hostname and username are mandatory", line)
+		}
+		machines = append(machines, m)
+	}
+
+	return machines, nil
+}
+
+// machineObjects checks v is an array of machine objects, normalizing ssh_port to a string,
+// as YAML and transforms may produce a number.
+func machineObjects(v interface{}) ([]interface{}, error) {
+	machines, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.Errorf("inventory must be an array of machines, got %T", v)
+	}
+	for i, m := range machines {
+		o, ok := m.(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf("inventory must be an array of machine objects, item %d is %T", i, m)
+		}
+		if p, ok := o["ssh_port"]; ok && p != nil {
+			o["ssh_port"] = fmt.Sprint(p)
+		}
+	}
+	return machines, nil
+}
+
+// Inventory paging, set with inventoryPaging.
+const (
+	pagingOff  = "off"  // the inventory is a single document
+	pagingPage = "page" // the inventory URL is a template, {{.Page}} numbering pages from 1
+	pagingLink = "link" // pages are followed by their Link rel="next" header
+)
+
+// inventoryPaging returns the paging mode for the inventory at l. Without inventoryPaging, an
+// inventory URL containing {{.Page}} is paged.
+func inventoryPaging(l, paging string) (string, error) {
+	if paging == "" {
+		paging = pagingOff
+		if strings.Contains(l, "{{") {
+			paging = pagingPage
+		}
+	}
+	switch paging {
+	case pagingOff:
+		return paging, nil
+	case pagingLink:
+	case pagingPage:
+		if !strings.Contains(l, "{{") {
+			return "", errors.Errorf("inventoryPaging=page but the inventory has no {{.Page}}: %s", l)
+		}
+		if _, err := pageURL(l, 1); err != nil {
+			return "", err
+		}
+	default:
+		return "", errors.Errorf("unsupported inventoryPaging: %v\n\tmust use off, page or link", paging)
+	}
+	if !strings.HasPrefix(l, "http://") && !strings.HasPrefix(l, "https://") {
+		return "", errors.Errorf("inventoryPaging=%s requires the inventory to be a network address: %s", paging, l)
+	}
+	return paging, nil
+}
+
+// getInventoryPages fetches and decodes the inventory from url a page at a time, concatenating
+// the machines. With paging=page, url is a template executed with the page number, from 1,
+// until a page has no machines. With paging=link, the Link rel="next" header of each page is
+// followed until a page has none. Either stops after h.maxPages pages, 0 meaning no limit, with
+// a warning. Each page is retried and transformed on its own.
+func getInventoryPages(c *http.Client, url string, transform *gojq.Code, h inventoryHTTP) ([]boomerang.SSHInfo, error) {
+	paged := h.paging == pagingPage
+
+	origin := url
+	var inventory []boomerang.SSHInfo
+	seen := make(map[string]bool)
+	for page := 1; h.maxPages == 0 || page <= h.maxPages; page++ {
+		u := url
+		if paged {
+			var err error
+			if u, err = pageURL(url, page); err != nil {
+				return nil, err
+			}
+		}
+		// a server linking back to an earlier page would otherwise never stop
+		if seen[u] {
+			return inventory, nil
+		}
+		seen[u] = true
+
+		// inventoryHeaders, e.g. a token, are only sent to where the inventory was configured,
+		// not to another host a next link names
+		ph := h
+		if !paged && !sameOrigin(origin, u) {
+			log.Printf("Warning: inventory page %d is on another host [%v], fetched without inventoryHeaders or inventoryToken\n", page, u)
+			ph.headers = nil
+		}
+		p, err := fetchInventoryRetried(c, u, ph)
+		if err != nil {
+			return nil, errors.Wrapf(err, "page %d", page)
+		}
+		machines, err := decodeInventory(bytes.NewReader(p.body), p.format, transform)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not decode inventory from [%v]", u)
+		}
+		inventory = append(inventory, machines...)
+
+		switch {
+		case paged && len(machines) == 0:
+			return inventory, nil
+		case !paged && p.next == "":
+			return inventory, nil
+		case !paged:
+			url = p.next
+		}
+	}
+
+	log.Printf("Warning: stopped fetching the inventory after inventoryMaxPages (%d) pages, there may be more\n", h.maxPages)
+	return inventory, nil
+}
+
+// sameOrigin reports whether URLs a and b have the same scheme and host, including the port.
+func sameOrigin(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(ua.Scheme, ub.Scheme) && strings.EqualFold(ua.Host, ub.Host)
+}
+
+// pageURL returns the inventory URL template tmpl for page.
+func pageURL(tmpl string, page int) (string, error) {
+	t, err := template.New("inventory").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", errors.Wrap(err, "could not parse inventory URL template")
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, struct{ Page int }{page}); err != nil {
+		return "", errors.Wrap(err, "could not execute inventory URL template")
+	}
+	return b.String(), nil
+}
+
+// nextLink returns the URL of the rel="next" link in the Link headers of h, e.g.
+// Link: <https://api.example.com/hosts?page=2>; rel="next", resolved against base. Empty if
+// there is none.
+func nextLink(h http.Header, base *url.URL) string {
+	for _, v := range h.Values("Link") {
+		for _, link := range strings.Split(v, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range parts[1:] {
+				k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if !strings.EqualFold(strings.TrimSpace(k), "rel") {
+					continue
+				}
+				for _, rel := range strings.Fields(strings.Trim(strings.TrimSpace(v), `"`)) {
+					if strings.EqualFold(rel, "next") {
+						u, err := base.Parse(strings.Trim(target, "<>"))
+						if err != nil {
+							return ""
+						}
+						return u.String()
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// retrieveInventory retrieves an inventory of machine ssh info based on the location string.
+// The location string must be a local file or a network address.
+//
+// The inventory may be JSON, YAML or CSV, detected by file extension or, for a network
+// address, the Content-Type header.
+//
+// If supplying a network address, it must have the prefix http or https. The request is sent
+// with h's headers and timeout, 10s if not set.
+//
+// If supplying a filename, it must be located in the same directory as Boomerang.
+// Otherwise must supply the full path to the file. Avoid file names with the prefix
+// http or https.
+//
+// If transform is non-nil, it's applied to the inventory document to extract the array of
+// machines, e.g. .data.hosts for an API wrapping the inventory in other data.
+func retrieveInventory(l string, transform *gojq.Code, h inventoryHTTP) (boomerang.Inventory, error) {
+
+	re, err := regexp.Compile(`^(http|https)://`)
+	if err != nil {
+		return nil, errors.Wrap(err, "error compiling regex")
+	}
+
+	if re.MatchString(l) {
+		ssh, err := getInventoryFromURL(l, transform, h)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not get inventory from url")
+		}
+		return ssh, nil
+	}
+
+	ssh, err := getInventoryFromFile(l, transform)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get inventory from file")
+	}
+
+	return ssh, nil
+}
+
+// inventoryHTTP configures the request for an inventory at a network address.
+type inventoryHTTP struct {
+	headers  map[string]string // e.g. Authorization
+	timeout  time.Duration
+	retry    int    // retries after a connection error or 5xx response
+	paging   string // off, page or link, see getInventoryPages
+	maxPages int
+}
+
+// maxInventoryBytes bounds the inventory read from a network address.
+const maxInventoryBytes = 64 << 20
+
+// inventoryBackoff is the wait between inventory retries.
+var inventoryBackoff = boomerang.Backoff{Policy: "exponential", Wait: time.Second, Max: 30 * time.Second}
+
+func getInventoryFromURL(url string, transform *gojq.Code, h inventoryHTTP) ([]boomerang.SSHInfo, error) {
+
+	timeout := h.timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	// redirects are followed by the client
+	c := &http.Client{Timeout: timeout}
+
+	if h.paging == pagingPage || h.paging == pagingLink {
+		return getInventoryPages(c, url, transform, h)
+	}
+
+	p, err := fetchInventoryRetried(c, url, h)
+	if err != nil {
+		return nil, err
+	}
+
+	inventory, err := decodeInventory(bytes.NewReader(p.body), p.format, transform)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not decode inventory from [%v]", url)
+	}
+
+	return inventory, nil
+}
+
+// fetchInventoryRetried is fetchInventory, retried up to h.retry times with backoff when the
+// error may be transient.
+func fetchInventoryRetried(c *http.Client, url string, h inventoryHTTP) (inventoryPage, error) {
+	for n := 0; ; n++ {
+		p, retry, err := fetchInventory(c, url, h.headers)
+		if err == nil {
+			return p, nil
+		}
+		if !retry || n >= h.retry {
+			return inventoryPage{}, err
+		}
+		d := inventoryBackoff.Delay(n)
+		log.Printf("Retrying inventory in %v: %v\n", d-(d%time.Millisecond), err)
+		time.Sleep(d)
+	}
+}
+
+// inventoryPage is an inventory document fetched from a network address.
+type inventoryPage struct {
+	body   []byte
+	format string
+	next   string // the Link rel="next" URL, if any
+}
+
+// fetchInventory gets the inventory document at url and its format. retry reports whether the
+// error may be transient, a connection error or a 5xx or 429 response.
+func fetchInventory(c *http.Client, url string, headers map[string]string) (p inventoryPage, retry bool, err error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return p, false, errors.Wrap(err, "unable to create request")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return p, true, errors.Wrap(err, "unable to fetch url")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		err := errors.Errorf("server returned a [%v], expecting status code 200", resp.Status)
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return p, true, err
+		}
+		// the start of the body usually says what's wrong, e.g. a bad token
+		snippet, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		if s := strings.TrimSpace(string(snippet)); s != "" {
+			err = errors.Errorf("server returned a [%v], expecting status code 200: %s", resp.Status, s)
+		}
+		return p, false, err
+	}
+
+	p.body, err = ioutil.ReadAll(io.LimitReader(resp.Body, maxInventoryBytes+1))
+	if err != nil {
+		return p, true, errors.Wrap(err, "unable to read response")
+	}
+	if len(p.body) > maxInventoryBytes {
+		return p, false, errors.Errorf("inventory is larger than %d bytes", maxInventoryBytes)
+	}
+
+	// the Content-Type header takes precedence over the URL's extension
+	p.format = formatFromContentType(resp.Header.Get("Content-Type"))
+	if p.format == "" {
+		p.format = formatFromName(resp.Request.URL.Path)
+	}
+	p.next = nextLink(resp.Header, resp.Request.URL)
+	return p, false, nil
+}
+
+func getInventoryFromFile(file string, transform *gojq.Code) ([]boomerang.SSHInfo, error) {
+
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return nil, errors.Errorf("stat on file failed or file does not exist: check %v", file)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	inventory, err := decodeInventory(f, formatFromName(file), transform)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not decode inventory from [%v]", file)
+	}
+
+	return inventory, nil
+}
+
+// decodeInventory decodes an inventory in format, json, yaml or csv, from r. If transform is
+// non-nil it is applied to the document first and must produce a single array of machine objects.
+func decodeInventory(r io.Reader, format string, transform *gojq.Code) ([]boomerang.SSHInfo, error) {
+
+	doc, err := decodeDocument(r, format)
+	if err != nil {
+		return nil, err
+	}
+
+	if transform != nil {
+		iter := transform.Run(doc)
+		v, ok := iter.Next()
+		if !ok {
+			return nil, errors.New("inventoryTransform produced no result")
+		}
+		if err, ok := v.(error); ok {
+			return nil, errors.Wrap(err, "inventoryTransform failed")
+		}
+		if _, ok := iter.Next(); ok {
+			return nil, errors.New("inventoryTransform produced more than one result, wrap the expression in [...] to collect them")
+		}
+		doc = v
+	}
+
+	machines, err := machineObjects(doc)
+	if err != nil {
+		if transform != nil {
+			return nil, errors.Wrap(err, "inventoryTransform")
+		}
+		return nil, err
+	}
+
+	return toSSHInfo(machines)
+}
+
+// toSSHInfo converts machine objects to SSHInfo, round tripping through JSON to decode using
+// its struct tags.
+func toSSHInfo(machines []interface{}) ([]boomerang.SSHInfo, error) {
+	var inventory []boomerang.SSHInfo
+	by, err := json.Marshal(machines)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed marshal")
+	}
+	if err := json.Unmarshal(by, &inventory); err != nil {
+		return nil, err
+	}
+
+	return inventory, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mfridman/boomerang"
+)
+
+func TestGetInventoryPagesLink(t *testing.T) {
+	// other is another host a next link points to, it must not get the inventory token
+	var otherAuth string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		otherAuth = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `[{"hostname": "c", "username": "u"}]`)
+	}))
+	defer other.Close()
+
+	var auth []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Query().Get("page") {
+		case "":
+			w.Header().Set("Link", `</hosts?page=2>; rel="next", </hosts>; rel="first"`)
+			fmt.Fprint(w, `[{"hostname": "a", "username": "u"}]`)
+		case "2":
+			w.Header().Set("Link", fmt.Sprintf(`<%s/hosts>; rel="next"`, other.URL))
+			fmt.Fprint(w, `[{"hostname": "b", "username": "u"}]`)
+		}
+	}))
+	defer srv.Close()
+
+	h := inventoryHTTP{headers: map[string]string{"Authorization": "Bearer secret"}, paging: pagingLink}
+	inventory, err := getInventoryPages(srv.Client(), srv.URL+"/hosts", nil, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hosts []string
+	for _, s := range inventory {
+		hosts = append(hosts, s.HostName)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(hosts, want) {
+		t.Errorf("hosts = %q, want %q", hosts, want)
+	}
+	if want := []string{"Bearer secret", "Bearer secret"}; !reflect.DeepEqual(auth, want) {
+		t.Errorf("same host Authorization = %q, want the token on both pages", auth)
+	}
+	if otherAuth != "" {
+		t.Errorf("another host was sent Authorization %q", otherAuth)
+	}
+}
+
+func TestNextLink(t *testing.T) {
+	base, _ := http.NewRequest(http.MethodGet, "https://cmdb.example.com/api/hosts?page=1", nil)
+
+	tests := []struct {
+		link string
+		want string
+	}{
+		{``, ""},
+		{`<https://cmdb.example.com/api/hosts?page=2>; rel="next"`, "https://cmdb.example.com/api/hosts?page=2"},
+		{`</api/hosts?page=2>; rel=next`, "https://cmdb.example.com/api/hosts?page=2"},
+		{`<?page=1>; rel="prev", <?page=3>; rel="next last"`, "https://cmdb.example.com/api/hosts?page=3"},
+		{`<?page=1>; rel="prev"`, ""},
+		{`https://cmdb.example.com/api/hosts?page=2; rel="next"`, ""},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		if tt.link != "" {
+			h.Set("Link", tt.link)
+		}
+		if got := nextLink(h, base.URL); got != tt.want {
+			t.Errorf("nextLink(%q) = %q, want %q", tt.link, got, tt.want)
+		}
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"https://cmdb.example.com/a", "https://cmdb.example.com/b?page=2", true},
+		{"https://cmdb.example.com/a", "HTTPS://CMDB.example.com/b", true},
+		{"https://cmdb.example.com/a", "http://cmdb.example.com/a", false},
+		{"https://cmdb.example.com/a", "https://cmdb.example.com:8443/a", false},
+		{"https://cmdb.example.com/a", "https://evil.example.net/a", false},
+	}
+	for _, tt := range tests {
+		if got := sameOrigin(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameOrigin(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		csv     string
+		want    string // machines as JSON
+		wantErr bool
+	}{
+		{
+			"fields",
+			"hostname,username,port\nweb1,admin,2222\n",
+			`[{"hostname":"web1","ssh_port":"2222","username":"admin"}]`,
+			false,
+		},
+		{
+			"case and spaces in header",
+			"HostName, Username\nweb1, admin\n",
+			`[{"hostname":"web1","username":"admin"}]`,
+			false,
+		},
+		{
+			"other columns are extras",
+			"hostname,username,role\nweb1,admin,db\n",
+			`[{"extras":{"role":"db"},"hostname":"web1","username":"admin"}]`,
+			false,
+		},
+		{"header only", "hostname,username\n", `[]`, false},
+		{"missing username", "hostname,username\nweb1,\n", "", true},
+		{"missing column", "hostname\nweb1\n", "", true},
+		{"ragged row", "hostname,username\nweb1,admin,extra\n", "", true},
+		{"empty", "", "", true},
+	}
+	for _, tt := range tests {
+		v, err := decodeCSV([]byte(tt.csv))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error: %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		by, _ := json.Marshal(v)
+		if string(by) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, by, tt.want)
+		}
+	}
+}
+
+func TestGetInventoryFromURLRetry(t *testing.T) {
+	defer func(b boomerang.Backoff) { inventoryBackoff = b }(inventoryBackoff)
+	inventoryBackoff = boomerang.Backoff{Policy: "fixed", Wait: time.Millisecond}
+
+	tests := []struct {
+		name         string
+		status       int // returned before the inventory
+		failures     int // requests answered with status
+		retry        int
+		wantRequests int
+		wantErr      string // empty if the inventory is returned
+	}{
+		{"retried until 200", http.StatusServiceUnavailable, 2, 2, 3, ""},
+		{"retries exhausted", http.StatusServiceUnavailable, 2, 1, 2, "503 Service Unavailable"},
+		{"rate limited", http.StatusTooManyRequests, 1, 1, 2, ""},
+		{"not found is not retried", http.StatusNotFound, 1, 3, 1, "[404 Not Found], expecting status code 200: no such inventory"},
+	}
+	for _, tt := range tests {
+		var requests int
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests <= tt.failures {
+				http.Error(w, "no such inventory", tt.status)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `[{"hostname": "a", "username": "u"}]`)
+		}))
+
+		inventory, err := getInventoryFromURL(srv.URL, nil, inventoryHTTP{retry: tt.retry})
+		srv.Close()
+
+		if requests != tt.wantRequests {
+			t.Errorf("%s: %d requests, want %d", tt.name, requests, tt.wantRequests)
+		}
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.wantErr == "" && (len(inventory) != 1 || inventory[0].HostName != "a"):
+			t.Errorf("%s: inventory %+v, want host a", tt.name, inventory)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRetrieveInventoryHeaders(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		fmt.Fprint(w, `[{"hostname": "a", "username": "u"}]`)
+	}))
+	defer srv.Close()
+
+	// the URL, token and header values are expanded from the environment
+	t.Setenv("BOOMERANG_TEST_CMDB", srv.URL)
+	t.Setenv("BOOMERANG_TEST_TOKEN", "t0ken")
+	t.Setenv("BOOMERANG_TEST_TEAM", "ops")
+	s, err := loadTestState(t, `
+inventory: ${BOOMERANG_TEST_CMDB}/hosts.json
+inventoryToken: ${BOOMERANG_TEST_TOKEN}
+inventoryHeaders:
+  X-Team: ${BOOMERANG_TEST_TEAM}
+  Accept: application/json
+auth: password
+SSHpassword: secret
+commands:
+  - name: up
+    command: uptime
+`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inventory, err := retrieveInventory(s.inventory, s.inventoryTransform, s.inventoryHTTP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inventory) != 1 || inventory[0].HostName != "a" {
+		t.Errorf("inventory %+v, want host a", inventory)
+	}
+	want := map[string]string{"Authorization": "Bearer t0ken", "X-Team": "ops", "Accept": "application/json"}
+	for k, v := range want {
+		if got.Get(k) != v {
+			t.Errorf("header %s = %q, want %q", k, got.Get(k), v)
+		}
+	}
+}
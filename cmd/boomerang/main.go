@@ -3,62 +3,35 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
-	"io"
+	"context"
 	"log"
 	"os"
-	"sync"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/spf13/pflag"
+	"golang.org/x/term"
 
+	"github.com/mfridman/boomerang"
 	"github.com/pkg/errors"
 )
 
-// Boomerang is the parent struct written out as JSON to file
-type Boomerang struct {
-	MetaData    Meta      `json:"metadata"`
-	MachineData []Machine `json:"machine_data"`
-}
-
-func (b *Boomerang) writeJSON(w io.Writer) error {
-	by, err := json.Marshal(b)
-	if err != nil {
-		return errors.Wrap(err, "failed marshal")
-	}
-	if _, err := w.Write(by); err != nil {
-		return err
-	}
-	return nil
-}
-
-func (b *Boomerang) writeIndentJSON(w io.Writer) error {
-	by, err := json.MarshalIndent(b, "", "\t")
-	if err != nil {
-		return errors.Wrap(err, "failed marshal")
-	}
-	if _, err := w.Write(by); err != nil {
-		return err
-	}
-	return nil
-}
-
-// Meta structure holds all non machine-specific data
-type Meta struct {
-	// TODO remove BoomerangVersion once API becomes stable,
-	// used mainly for debugging as API change frequently.
-	// Think about replacing with an actual API version?
-	BoomerangVersion string `json:"boomerang_version"`
-	Type             string `json:"type"`
-	Timestamp        string `json:"timestamp"`
-	TotalMachines    int    `json:"total_items"`
-	TotalTime        string `json:"total_time"`
-}
-
 var (
-	version = pflag.Bool("version", false, "prints current version")
-	config  = pflag.String("c", "config", "specify config file")
+	version  = pflag.Bool("version", false, "prints current version")
+	config   = pflag.String("c", "config", "specify config file")
+	profile  = pflag.String("profile", "", "apply a profile from the config file, e.g. prod")
+	validate = pflag.String("validate", "", "check an output file matches the current output format, then exit")
+	_        = pflag.String("output", "", "write output to this file, or - for stdout, instead of the raw directory")
+	_        = pflag.Bool("gc", false, "remove stale boomerang temp files from machines in the inventory, without running commands")
+	_        = pflag.String("hosts", "", "run on a comma-separated list of user@host:port instead of the inventory")
+	_        = pflag.StringToString("labels", nil, "labels recorded in the metadata, e.g. env=prod,ticket=OPS-123, replacing labels in the config file")
+	_        = pflag.String("limit", "", "only run machines matching a selector, e.g. role=db,env=prod or 'web-*'")
+	_        = pflag.Bool("verbose", false, "log progress of each machine and command to stderr, same as logLevel: debug")
+	_        = pflag.Bool("dry-run", false, "print the commands and machines they would run on, checking auth, without connecting")
+	_        = pflag.Bool("progress", false, "report completed machines on stderr as the run progresses")
+	_        = pflag.Bool("preflight", false, "probe each machine's port before connecting, recording unreachable machines without retrying ssh")
 )
 
 func main() {
@@ -71,47 +44,117 @@ func main() {
 	state, err := setup()
 	chkErr(err)
 
-	inventory, err := retrieveInventory(state.inventory)
+	inventory := boomerang.Inventory(state.inlineInventory)
+	if inventory == nil {
+		inventory, err = retrieveInventory(state.inventory, state.inventoryTransform, state.inventoryHTTP)
+		chkErr(err)
+	}
+
+	if state.sshConfig != nil {
+		inventory, err = applySSHConfig(inventory, state.sshConfig)
+		chkErr(err)
+	}
+
+	chkErr(setHostCommands(inventory))
+	chkErr(inventory.NormalizePorts())
+
+	inventory, err = inventory.Dedupe(state.dedupeMode)
 	chkErr(err)
 
-	/*
-		boomerang gets populated throughout the main function and
-		passed to output pkg to get written out as a JSON file
-	*/
-	boomerang := &Boomerang{
-		MetaData: Meta{
-			BoomerangVersion: VER,
-			Type:             state.machineType,
-			TotalMachines:    len(inventory),
-			Timestamp:        start.Format(time.RFC3339),
-		},
-		MachineData: make([]Machine, 0),
+	if state.limit != "" {
+		n := inventory.Len()
+		inventory, err = inventory.Limit(state.limit)
+		chkErr(err)
+		if inventory.Len() == 0 {
+			chkErr(errors.Errorf("limit matched none of the %d machines in the inventory", n))
+		}
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(len(inventory))
+	inventory.Order(state.dispatchOrder, state.dispatchSortKey)
+	state.Inventory = inventory
 
-	var mut sync.Mutex
-	for _, ssh := range inventory {
-		go func(s SSHInfo, rc *State) {
+	if state.dryRun {
+		chkErr(boomerang.DryRun(os.Stdout, state.Options))
+		return
+	}
 
-			m := newMachine(s)
+	/*
+		the Boomerang result is populated by boomerang.Run and passed to output pkg to get written out
+		as a JSON file
+	*/
+	// On SIGINT or SIGTERM the run is cancelled: machines not yet started are recorded as
+	// cancelled, running commands are killed, and whatever completed is still written out.
+	// A second signal exits immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 
-			finalMachine := m.run(rc)
+	o := outCfg{
+		Dir:        outputDir,
+		FilePrefix: state.prefixJSON, // default is raw
+		DateTime:   start,
+		Ext:        ".json",
+		Path:       state.output,
+		Compress:   state.compress,
+		Template:   state.outputTemplate,
+		RunID:      state.RunID,
+		Type:       state.Type,
+	}
+	if state.outputMode == outputNDJSON {
+		o.Ext = ".ndjson"
+	}
+	// an archive is always gzipped
+	if state.outputMode == outputArchive {
+		o.Ext = ".tar.gz"
+	} else if state.compress {
+		o.Ext += ".gz"
+	}
+	if state.recipient != nil {
+		o.Ext += ".age"
+	}
+	if state.output == "-" {
+		o.Path, o.Writer = "", os.Stdout
+	}
 
-			mut.Lock()
-			{
-				boomerang.MachineData = append(boomerang.MachineData, *finalMachine)
-			}
-			mut.Unlock()
+	var onMachine []func(boomerang.Machine)
 
-			wg.Done()
+	// with ndjson, machines are written as they complete rather than once all have
+	var nd *ndjsonWriter
+	if state.outputMode == outputNDJSON {
+		nd, err = o.ndjson(state.recipient)
+		chkErr(err)
+		if state.anonymizeHosts {
+			nd.anonymizeSalt = &state.anonymizeSalt
+		}
+		nd.filter = state.outputFilter
+		nd.ordered, nd.orderedTimeout = state.ndjsonOrdered, state.ndjsonOrderedTimeout
+		onMachine = append(onMachine, nd.machine)
+	}
 
-		}(ssh, state)
+	var p *progress
+	if state.progress {
+		p = newProgress(os.Stderr, len(inventory), term.IsTerminal(int(os.Stderr.Fd())))
+		onMachine = append(onMachine, p.machine)
+		p.start()
 	}
 
-	// block until all goroutines have completed.
-	wg.Wait()
+	state.OnMachine = func(m boomerang.Machine) {
+		for _, f := range onMachine {
+			f(m)
+		}
+	}
+	result, err := boomerang.Run(ctx, state.Options)
+	chkErr(err)
+	if p != nil {
+		p.finish()
+	}
+	if ctx.Err() != nil {
+		log.Println("Boomerang interrupted, writing partial results")
+	} else if result.MetaData.Truncated != "" {
+		log.Printf("Boomerang stopped by %s, writing partial results\n", result.MetaData.Truncated)
+	}
 
 	/*
 		The bulk of the program has completed and all Machine data has been recorded.
@@ -121,39 +164,40 @@ func main() {
 
 	elapsed := time.Since(start)
 
-	boomerang.MetaData.TotalTime = fmt.Sprintf("%v", elapsed-(elapsed%time.Millisecond))
-
-	o := outCfg{
-		Dir:        "raw",
-		FilePrefix: state.prefixJSON, // default is raw
-		DateTime:   start,
+	if state.anonymizeHosts {
+		mapping := boomerang.AnonymizeHosts(result.MachineData, state.anonymizeSalt)
+		if err := writeHostMap(state.anonymizeMapFile, mapping); err != nil {
+			log.Fatalln(err)
+		}
 	}
 
-	outFile, err := o.toFile()
-	if err != nil {
-		log.Fatalln(err)
-	}
+	// typeFrom is only known once the run completes, ndjson is named before
+	o.Type = result.MetaData.Type
 
-	f, err := os.Create(outFile)
-	if err != nil {
-		log.Fatalln(err)
+	// the summary, notification and exit code still cover every machine
+	out := result
+	if state.outputFilter != outputFilterAll {
+		out = filtered(result, state.outputFilter)
 	}
-	switch state.indentJSON {
-	case true:
-		if err := boomerang.writeIndentJSON(f); err != nil {
-			log.Fatalln(err)
-		}
-	case false:
-		if err := boomerang.writeJSON(f); err != nil {
+
+	var outFiles []string
+	if nd != nil {
+		outFile, err := nd.close(out.MetaData)
+		if err != nil {
 			log.Fatalln(err)
 		}
+		outFiles = append(outFiles, outFile)
 	}
-	if err := f.Close(); err != nil {
+	files, err := o.writeFiles(state.outputMode, out, state.recipient, state.indentJSON)
+	if err != nil {
 		log.Fatalln(err)
 	}
+	outFiles = append(outFiles, files...)
 
-	if state.keepLatestFile {
-		errs := cleanUpExcept(o.Dir, outFile)
+	// only the default directory is cleaned up, and only if this run wrote to it
+	wroteDir := o.Writer == nil && o.Path == "" || state.outputMode == outputSplit || state.outputMode == outputBoth
+	if state.keepLatestFile && state.outputMode != outputNone && wroteDir {
+		errs := cleanUpExcept(o.Dir, outFiles...)
 		if len(errs) > 0 {
 			for _, e := range errs {
 				log.Printf("error cleaning up: %v\n", e)
@@ -161,7 +205,38 @@ func main() {
 		}
 	}
 
-	finished(&elapsed, len(inventory), len(boomerang.MachineData))
+	// a failed post is retried, then fails the run once everything else is done
+	var postErr error
+	if state.outputHTTP.url != "" {
+		if postErr = postOutput(out, state.outputHTTP, state.recipient, state.indentJSON, state.compress); postErr != nil {
+			log.Printf("error posting output to outputURL: %v\n", postErr)
+		}
+	}
+
+	if state.notifyURL != "" {
+		if err := notify(result, state.notifyURL, state.notifyWhen, state.notifyMessage); err != nil {
+			log.Printf("error sending notification: %v\n", err)
+		}
+	}
+
+	finished(&elapsed, len(inventory), len(result.MachineData))
+
+	summary := summarize(result)
+	summary.print()
+
+	if postErr != nil {
+		os.Exit(1)
+	}
+
+	// failFastThreshold means the fleet can't be reached, e.g. bad credentials
+	if strings.HasPrefix(result.MetaData.Truncated, boomerang.FailFastCause) {
+		os.Exit(1)
+	}
+
+	// for CI, exit non-zero if anything failed
+	if state.failOnError && summary.failed() {
+		os.Exit(1)
+	}
 }
 
 func chkErr(e error) {
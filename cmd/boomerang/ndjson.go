@@ -0,0 +1,221 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+	"github.com/mfridman/boomerang"
+	"github.com/pkg/errors"
+)
+
+// ndjsonWriter writes machines as they complete, one JSON object per line, and the metadata last
+// as {"metadata": {...}}. Writes are serialized and flushed, so results can be followed as they
+// come in, e.g. with tail -f. Encrypted output is only written in whole age chunks.
+//
+// With ordered set, machines are written in inventory order instead: a machine completing ahead
+// of one still running is held back until those before it are written. Once no machine has been
+// written for orderedTimeout, those held back are written regardless, and a machine they skipped
+// is written when it completes.
+type ndjsonWriter struct {
+	mu   sync.Mutex
+	w    io.Writer
+	gz   *gzip.Writer
+	enc  io.WriteCloser
+	file *os.File // nil when writing to o.Writer
+	err  error    // the first write error, returned by close
+
+	// anonymizeSalt, if set, replaces hostnames with pseudonyms, see anonymizeHosts
+	anonymizeSalt *string
+	// filter is the outputFilter, machines filtered out still count towards ordered output
+	filter string
+
+	ordered        bool
+	orderedTimeout time.Duration
+	next           int                        // order of the next machine to write
+	pending        map[int]*boomerang.Machine // held back until next reaches them, nil if filtered out
+	stall          *time.Timer                // writes pending once orderedTimeout passes without a write
+}
+
+// ndjson opens o's output for ndjson, gzipped if o.Compress and encrypted to recipient if
+// non-nil, the same way write does. Unlike write, the file is written in place so it can be
+// followed as machines complete.
+func (o outCfg) ndjson(recipient age.Recipient) (*ndjsonWriter, error) {
+	nd := &ndjsonWriter{w: o.Writer}
+	if o.Writer == nil {
+		file := o.Path
+		if file == "" {
+			var err error
+			if file, err = o.toFile(); err != nil {
+				return nil, err
+			}
+		}
+		f, err := os.Create(file)
+		if err != nil {
+			return nil, err
+		}
+		nd.file, nd.w = f, f
+	}
+
+	if recipient != nil {
+		enc, err := age.Encrypt(nd.w, recipient)
+		if err != nil {
+			return nil, err
+		}
+		nd.enc, nd.w = enc, enc
+	}
+	if o.Compress {
+		nd.gz = gzip.NewWriter(nd.w)
+		nd.w = nd.gz
+	}
+	return nd, nil
+}
+
+// machine writes m as a line, unless filtered out. It's an Options.OnMachine, errors are
+// returned by close.
+func (nd *ndjsonWriter) machine(m boomerang.Machine) {
+	var keep *boomerang.Machine
+	if keeps(m, nd.filter) {
+		if nd.anonymizeSalt != nil {
+			// AnonymizeHosts copies what it rewrites, m still shares StreamData etc. with the result
+			ms := []boomerang.Machine{m}
+			boomerang.AnonymizeHosts(ms, *nd.anonymizeSalt)
+			m = ms[0]
+		}
+		keep = &m
+	}
+
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+	if !nd.ordered {
+		if keep != nil {
+			nd.write(keep)
+		}
+		return
+	}
+
+	order := m.Order()
+	if order > nd.next {
+		if nd.pending == nil {
+			nd.pending = make(map[int]*boomerang.Machine)
+		}
+		nd.pending[order] = keep
+		if nd.stall == nil {
+			nd.stall = time.AfterFunc(nd.orderedTimeout, nd.flushPending)
+		}
+		return
+	}
+
+	// order < next was skipped by flushPending, it's written late
+	if keep != nil {
+		nd.write(keep)
+	}
+	if order < nd.next {
+		return
+	}
+	nd.next++
+	for {
+		p, ok := nd.pending[nd.next]
+		if !ok {
+			break
+		}
+		if p != nil {
+			nd.write(p)
+		}
+		delete(nd.pending, nd.next)
+		nd.next++
+	}
+	if nd.stall != nil {
+		nd.stall.Stop()
+		nd.stall = nil
+		if len(nd.pending) > 0 {
+			nd.stall = time.AfterFunc(nd.orderedTimeout, nd.flushPending)
+		}
+	}
+}
+
+// flushPending writes the machines held back in order, skipping those not yet completed.
+func (nd *ndjsonWriter) flushPending() {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+	nd.writePending()
+}
+
+// writePending is flushPending with nd.mu held.
+func (nd *ndjsonWriter) writePending() {
+	if nd.stall != nil {
+		nd.stall.Stop()
+		nd.stall = nil
+	}
+	orders := make([]int, 0, len(nd.pending))
+	for o := range nd.pending {
+		orders = append(orders, o)
+	}
+	sort.Ints(orders)
+	for _, o := range orders {
+		if p := nd.pending[o]; p != nil {
+			nd.write(p)
+		}
+		nd.next = o + 1
+	}
+	nd.pending = nil
+}
+
+// write writes v as a line of JSON and flushes it. nd.mu must be held.
+func (nd *ndjsonWriter) write(v interface{}) {
+	if nd.err != nil {
+		return
+	}
+
+	by, err := json.Marshal(v)
+	if err != nil {
+		nd.err = errors.Wrap(err, "failed marshal")
+		return
+	}
+	if _, err := nd.w.Write(append(by, '\n')); err != nil {
+		nd.err = errors.Wrap(err, "failed writing ndjson")
+		return
+	}
+	if nd.gz != nil {
+		if err := nd.gz.Flush(); err != nil {
+			nd.err = errors.Wrap(err, "failed flushing gzip writer")
+		}
+	}
+}
+
+// close writes meta as the last line, closes the output and returns the file written, empty
+// when writing to o.Writer.
+func (nd *ndjsonWriter) close(meta boomerang.Meta) (string, error) {
+	nd.mu.Lock()
+	// nothing held back is left out
+	nd.writePending()
+	nd.write(struct {
+		MetaData boomerang.Meta `json:"metadata"`
+	}{meta})
+	nd.mu.Unlock()
+
+	err := nd.err
+	// the gzip footer must be written before the age writer is closed
+	if nd.gz != nil {
+		if e := nd.gz.Close(); e != nil && err == nil {
+			err = errors.Wrap(e, "failed closing gzip writer")
+		}
+	}
+	if nd.enc != nil {
+		if e := nd.enc.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if nd.file == nil {
+		return "", err
+	}
+	if e := nd.file.Close(); e != nil && err == nil {
+		err = e
+	}
+	return nd.file.Name(), err
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mfridman/boomerang"
+)
+
+func TestNDJSONOrdered(t *testing.T) {
+	// u0 connects to a port that never answers, so it completes last; u1-u3 are refused at once
+	stalled, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("could not listen on 127.0.0.2: %v", err)
+	}
+	defer stalled.Close()
+	go func() {
+		for {
+			c, err := stalled.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	closed, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	var inventory boomerang.Inventory
+	for i, addr := range []net.Addr{stalled.Addr(), closed.Addr(), closed.Addr(), closed.Addr()} {
+		h, p, _ := net.SplitHostPort(addr.String())
+		inventory.Add(boomerang.SSHInfo{HostName: h, Port: p, Username: fmt.Sprintf("u%d", i)})
+	}
+
+	tests := []struct {
+		name    string
+		ordered bool
+		timeout time.Duration
+		want    []string
+	}{
+		{"completion order", false, 0, []string{"u1", "u2", "u3", "u0"}},
+		{"inventory order", true, 10 * time.Second, []string{"u0", "u1", "u2", "u3"}},
+		{"held back until timeout", true, 100 * time.Millisecond, []string{"u1", "u2", "u3", "u0"}},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		nd, err := outCfg{Writer: &buf}.ndjson(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nd.filter = outputFilterAll
+		nd.ordered, nd.orderedTimeout = tt.ordered, tt.timeout
+
+		b, err := boomerang.Run(context.Background(), boomerang.Options{
+			Inventory:   inventory,
+			Commands:    []boomerang.Command{{Name: "echo", Command: "echo hello"}},
+			ConnTimeout: 500 * time.Millisecond,
+			Auth:        boomerang.Auth{Methods: []string{"password"}, Password: "secret"},
+			HostKeyMode: boomerang.HostKeyInsecure,
+			DownloadDir: t.TempDir(),
+			// u0 holds one slot, u1-u3 run one at a time in the other
+			MaxConcurrency: 2,
+			OnMachine:      nd.machine,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := nd.close(b.MetaData); err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		var meta int
+		sc := bufio.NewScanner(&buf)
+		for sc.Scan() {
+			var line struct {
+				Username string          `json:"username"`
+				MetaData *boomerang.Meta `json:"metadata"`
+			}
+			if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+				t.Fatalf("%s: %v: %s", tt.name, err, sc.Bytes())
+			}
+			if line.MetaData != nil {
+				meta++
+				continue
+			}
+			if meta > 0 {
+				t.Errorf("%s: machine %s written after the metadata", tt.name, line.Username)
+			}
+			got = append(got, line.Username)
+		}
+		if !reflect.DeepEqual(got, tt.want) || meta != 1 {
+			t.Errorf("%s: wrote %v and %d metadata, want %v and 1", tt.name, got, meta, tt.want)
+		}
+	}
+}
+
+func TestNDJSONReadBack(t *testing.T) {
+	b := testOutput()
+	for _, compress := range []bool{false, true} {
+		o := outCfg{Dir: t.TempDir(), FilePrefix: "raw", DateTime: time.Now(), Ext: ".ndjson", Compress: compress}
+		if compress {
+			o.Ext += ".gz"
+		}
+		nd, err := o.ndjson(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nd.filter = outputFilterAll
+		for _, m := range b.MachineData {
+			nd.machine(m)
+		}
+		file, err := nd.close(b.MetaData)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := io.Reader(f)
+		if compress {
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatalf("%s: %v", file, err)
+			}
+			r = gz
+		}
+		var lines [][]byte
+		sc := bufio.NewScanner(r)
+		for sc.Scan() {
+			lines = append(lines, append([]byte(nil), sc.Bytes()...))
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		if len(lines) != len(b.MachineData)+1 {
+			t.Fatalf("compress %v: read %d lines, want one per machine and the metadata", compress, len(lines))
+		}
+
+		for i, want := range b.MachineData {
+			var got boomerang.Machine
+			if err := json.Unmarshal(lines[i], &got); err != nil {
+				t.Fatalf("compress %v: line %d: %v", compress, i+1, err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("compress %v: line %d read back %+v, want %+v", compress, i+1, got, want)
+			}
+		}
+		var meta struct {
+			MetaData boomerang.Meta `json:"metadata"`
+		}
+		if err := json.Unmarshal(lines[len(lines)-1], &meta); err != nil {
+			t.Fatalf("compress %v: metadata line: %v", compress, err)
+		}
+		if !reflect.DeepEqual(meta.MetaData, b.MetaData) {
+			t.Errorf("compress %v: metadata read back %+v, want %+v", compress, meta.MetaData, b.MetaData)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/mfridman/boomerang"
+	"github.com/pkg/errors"
+)
+
+// defaultNotifyMessage is used when notifyURL is set without a notifyMessage. It's a template
+// over Summary.
+const defaultNotifyMessage = "boomerang {{.Type}}: {{.Connected}}/{{.Total}} machines connected, " +
+	"{{.ConnectionFailed}} failed to connect, {{.CommandsFailed}} command(s) failed in {{.TotalTime}}"
+
+// notify posts a short templated message summarizing the run to url, e.g. a Slack incoming
+// webhook. Unlike the output file it carries no machine data. when controls whether the
+// message is sent: always, on_failure or on_success.
+func notify(b *boomerang.Boomerang, url, when string, tmpl *template.Template) error {
+	n := summarize(b)
+
+	switch {
+	case when == "on_failure" && !n.failed():
+		return nil
+	case when == "on_success" && n.failed():
+		return nil
+	}
+
+	var msg bytes.Buffer
+	if err := tmpl.Execute(&msg, n); err != nil {
+		return errors.Wrap(err, "could not render notifyMessage")
+	}
+
+	body, err := json.Marshal(map[string]string{"text": msg.String()})
+	if err != nil {
+		return errors.Wrap(err, "failed marshal")
+	}
+
+	c := &http.Client{Timeout: time.Duration(10 * time.Second)}
+	resp, err := c.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "unable to post notification")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("server returned a [%v], expecting a 2xx status code", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"text/template"
+
+	"github.com/mfridman/boomerang"
+)
+
+func TestNotifyWhen(t *testing.T) {
+	ok := &boomerang.Boomerang{
+		MetaData: boomerang.Meta{Type: "deploy", TotalTime: "3s"},
+		MachineData: []boomerang.Machine{
+			{Connection: true, StreamData: []boomerang.Stream{{Succeeded: true}}},
+		},
+	}
+	failed := &boomerang.Boomerang{
+		MetaData: boomerang.Meta{Type: "deploy", TotalTime: "3s"},
+		MachineData: []boomerang.Machine{
+			{Connection: true, StreamData: []boomerang.Stream{{Succeeded: true}, {}}},
+			{},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		b        *boomerang.Boomerang
+		when     string
+		wantText string // empty if nothing is sent
+	}{
+		{"always ok", ok, "always", "boomerang deploy: 1/1 machines connected, 0 failed to connect, 0 command(s) failed in 3s"},
+		{"always failed", failed, "always", "boomerang deploy: 1/2 machines connected, 1 failed to connect, 1 command(s) failed in 3s"},
+		{"on_failure ok", ok, "on_failure", ""},
+		{"on_failure failed", failed, "on_failure", "boomerang deploy: 1/2 machines connected, 1 failed to connect, 1 command(s) failed in 3s"},
+		{"on_success ok", ok, "on_success", "boomerang deploy: 1/1 machines connected, 0 failed to connect, 0 command(s) failed in 3s"},
+		{"on_success failed", failed, "on_success", ""},
+	}
+	tmpl := template.Must(template.New("notify").Parse(defaultNotifyMessage))
+	for _, tt := range tests {
+		var sent []string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var body struct{ Text string }
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			sent = append(sent, body.Text)
+		}))
+
+		err := notify(tt.b, srv.URL, tt.when, tmpl)
+		srv.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		switch {
+		case tt.wantText == "" && len(sent) != 0:
+			t.Errorf("%s: sent %q, want nothing sent", tt.name, sent)
+		case tt.wantText != "" && (len(sent) != 1 || sent[0] != tt.wantText):
+			t.Errorf("%s: sent %q, want %q", tt.name, sent, tt.wantText)
+		}
+	}
+}
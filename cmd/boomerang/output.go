@@ -1,11 +1,19 @@
 package main
 
 import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"text/template"
 	"time"
 
+	"filippo.io/age"
+	"github.com/mfridman/boomerang"
 	"github.com/pkg/errors"
 )
 
@@ -17,7 +25,27 @@ func finished(elapsed *time.Duration, machinesIn, machinesOut int) {
 		machinesOut)
 }
 
-// CleanUpExcept deletes all .json files in dir except specified files.
+// outputDir is the directory output files, and downloads, are written to.
+const outputDir = "raw"
+
+// outputExts are the file extensions boomerang writes output as.
+var outputExts = []string{
+	".json", ".json.age", ".json.gz", ".json.gz.age",
+	".ndjson", ".ndjson.age", ".ndjson.gz", ".ndjson.gz.age",
+	".tar.gz", ".tar.gz.age",
+}
+
+// isOutputFile reports whether name looks like a boomerang output file.
+func isOutputFile(name string) bool {
+	for _, ext := range outputExts {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// CleanUpExcept deletes all output files (.json, .json.gz, .tar.gz and encrypted .age) in dir except specified files.
 // File arguments can be just a name or a absolute path + name.
 // Will not panic in the even of an error cleaning up files(s),
 // instead the errors are stored in error slice and returned to caller.
@@ -43,11 +71,11 @@ func cleanUpExcept(dirName string, files ...string) []error {
 		if _, ok := lookup[f.Name()]; ok {
 			continue
 		}
-		// delete files ending in .json in dir
-		if f.Mode().IsRegular() && filepath.Ext(f.Name()) == ".json" {
+		// delete output files, e.g. ending in .json, in dir
+		if f.Mode().IsRegular() && isOutputFile(f.Name()) {
 			fn := filepath.Join(dirName, f.Name())
 			if err := os.Remove(fn); err != nil {
-				errs = append(errs, errors.Wrap(err, "removing JSON file"))
+				errs = append(errs, errors.Wrap(err, "removing output file"))
 			}
 		}
 	}
@@ -55,14 +83,281 @@ func cleanUpExcept(dirName string, files ...string) []error {
 	return errs
 }
 
+// Output modes, set with outputMode.
+const (
+	outputCombined = "combined" // one file for all machines
+	outputSplit    = "split"    // one file per machine
+	outputBoth     = "both"     // one file for all machines and one per machine
+	outputNDJSON   = "ndjson"   // one line per machine, written as each completes
+	outputNone     = "none"     // no file, only posted to outputURL
+	outputArchive  = "archive"  // one tar.gz with a file per machine and its downloads
+)
+
+// Output filters, set with outputFilter.
+const (
+	outputFilterAll       = "all"       // every machine
+	outputFilterFailed    = "failed"    // machines that failed to connect or had a command fail
+	outputFilterConnected = "connected" // machines that connected
+)
+
+// keeps reports whether m is kept by filter.
+func keeps(m boomerang.Machine, filter string) bool {
+	switch filter {
+	case outputFilterFailed:
+		return m.Failed()
+	case outputFilterConnected:
+		return m.Connection
+	default:
+		return true
+	}
+}
+
+// filtered returns a copy of b with only the machines kept by filter, recorded in the metadata.
+// b itself is unchanged, e.g. for the summary.
+func filtered(b *boomerang.Boomerang, filter string) *boomerang.Boomerang {
+	out := &boomerang.Boomerang{MetaData: b.MetaData, MachineData: make([]boomerang.Machine, 0)}
+	for _, m := range b.MachineData {
+		if keeps(m, filter) {
+			out.MachineData = append(out.MachineData, m)
+		}
+	}
+	out.MetaData.Filter = &boomerang.Filter{Mode: filter, Items: len(out.MachineData)}
+	return out
+}
+
 type outCfg struct {
 	Dir        string
 	FilePrefix string
 	DateTime   time.Time
+	Ext        string // defaults to .json
+
+	// Template, if set, names files instead of <FilePrefix>_<DateTime>, see parseOutputTemplate.
+	// RunID and Type are available to it.
+	Template *template.Template
+	RunID    string
+	Type     string
+
+	// Path, if set, is the exact file written instead of Dir/<FilePrefix>_<DateTime><Ext>.
+	Path string
+	// Writer, if set, is written to instead of a file, e.g. os.Stdout.
+	Writer io.Writer
+	// Compress gzips the JSON.
+	Compress bool
+}
+
+// write writes b as JSON, gzipped if o.Compress and encrypted to recipient if non-nil, and
+// returns the file written.
+// No file is written when o.Writer is set.
+func (o outCfg) write(b *boomerang.Boomerang, recipient age.Recipient, indent bool) (string, error) {
+	if o.Writer != nil {
+		return "", encodeOutput(o.Writer, b, recipient, indent, o.Compress)
+	}
+
+	file := o.Path
+	if file == "" {
+		var err error
+		if file, err = o.toFile(); err != nil {
+			return "", err
+		}
+	}
+
+	f, err := createAtomic(file)
+	if err != nil {
+		return "", err
+	}
+	if err := encodeOutput(f, b, recipient, indent, o.Compress); err != nil {
+		f.abort()
+		return "", err
+	}
+	return file, f.commit()
+}
+
+// writeFiles writes b to the files outputMode mode writes once the run completes, and returns
+// them: combined, split, both or archive. ndjson is written as machines complete, see
+// ndjsonWriter, and none writes no file.
+func (o outCfg) writeFiles(mode string, b *boomerang.Boomerang, recipient age.Recipient, indent bool) ([]string, error) {
+	var files []string
+	if mode == outputCombined || mode == outputBoth {
+		file, err := o.write(b, recipient, indent)
+		if err != nil {
+			return files, err
+		}
+		files = append(files, file)
+	}
+	if mode == outputSplit || mode == outputBoth {
+		split, err := o.writeSplit(b, recipient, indent)
+		files = append(files, split...)
+		if err != nil {
+			return files, err
+		}
+	}
+	if mode == outputArchive {
+		file, err := o.writeArchive(b, recipient, indent)
+		if err != nil {
+			return files, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// atomicFile is an output file written to a temp file in the same directory, and renamed into
+// place once complete. A reader watching the directory, or a crash mid-write, never leaves a
+// partial file under the output name.
+type atomicFile struct {
+	*os.File
+	name string // empty when written in place
+}
+
+// createAtomic creates the temp file for name. Its name, .<name>.<random>.tmp, isn't an
+// output file so cleanUpExcept leaves a write in progress alone.
+func createAtomic(name string) (*atomicFile, error) {
+	// a pipe or device, e.g. --output /dev/stdout, can't be renamed over and is written in place
+	if fi, err := os.Stat(name); err == nil && !fi.Mode().IsRegular() {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_TRUNC, 0)
+		if err != nil {
+			return nil, err
+		}
+		return &atomicFile{File: f}, nil
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	// temp files are created 0600, output files are readable as they were with os.Create
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &atomicFile{File: f, name: name}, nil
+}
+
+// commit flushes f to disk and renames it to its output name, replacing any file there.
+func (f *atomicFile) commit() error {
+	if f.name == "" {
+		return f.Close()
+	}
+	err := f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), f.name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return errors.Wrapf(err, "failed writing %s", f.name)
+	}
+	return nil
+}
+
+// abort discards f, nothing is written under its output name.
+func (f *atomicFile) abort() {
+	f.Close()
+	if f.name != "" {
+		os.Remove(f.Name())
+	}
+}
+
+// writeSplit writes each machine in b to its own file in o.Dir, named
+// <hostname>_<DateTime><Ext>, with b's metadata, and returns the files written. Machines
+// sharing a hostname are numbered, e.g. web1_2_<DateTime>.json.
+func (o outCfg) writeSplit(b *boomerang.Boomerang, recipient age.Recipient, indent bool) ([]string, error) {
+	o.Path, o.Writer = "", nil
+
+	files := make([]string, 0, len(b.MachineData))
+	seen := make(map[string]int)
+	written := make(map[string]bool)
+	for _, m := range b.MachineData {
+		name := boomerang.SafeFileName(m.HostName)
+		if seen[name]++; seen[name] > 1 {
+			name = fmt.Sprintf("%s_%d", name, seen[name])
+		}
+		o.FilePrefix = name
+
+		// a template without {{.Prefix}} names every machine's file the same
+		file, err := o.toFile()
+		if err != nil {
+			return files, errors.Wrapf(err, "[%v] failed writing output", m.HostName)
+		}
+		if written[file] {
+			return files, errors.Errorf("[%v] output file %s was already written, outputTemplate must include {{.Prefix}} with outputMode split", m.HostName, file)
+		}
+		written[file] = true
+		o.Path = file
+
+		mb := &boomerang.Boomerang{MetaData: b.MetaData, MachineData: []boomerang.Machine{m}}
+		f, err := o.write(mb, recipient, indent)
+		if err != nil {
+			return files, errors.Wrapf(err, "[%v] failed writing output", m.HostName)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// encodeOutput writes b as JSON to w. With a recipient, JSON is written through the age writer
+// and w only ever receives ciphertext. With compress, JSON is gzipped before it is encrypted;
+// ciphertext doesn't compress.
+func encodeOutput(w io.Writer, b *boomerang.Boomerang, recipient age.Recipient, indent, compress bool) error {
+	var enc io.WriteCloser
+	if recipient != nil {
+		var err error
+		if enc, err = age.Encrypt(w, recipient); err != nil {
+			return err
+		}
+		w = enc
+	}
+
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+
+	if err := writeJSON(w, b, indent); err != nil {
+		return err
+	}
+
+	// the gzip footer must be written before the age writer is closed
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return errors.Wrap(err, "failed closing gzip writer")
+		}
+	}
+	if enc != nil {
+		return enc.Close()
+	}
+	return nil
+}
+
+// writeJSON writes b to w as JSON, see boomerang.MarshalBoomerang.
+func writeJSON(w io.Writer, b *boomerang.Boomerang, indent bool) error {
+	by, err := boomerang.MarshalBoomerang(b, indent)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(by); err != nil {
+		return err
+	}
+	return nil
 }
 
 func (o outCfg) toFile() (string, error) {
-	filename := o.FilePrefix + "_" + o.DateTime.Format("20060102_150405") + ".json"
+	ext := o.Ext
+	if ext == "" {
+		ext = ".json"
+	}
+	filename := o.FilePrefix + "_" + o.DateTime.Format(outputTimestamp) + ext
+	if o.Template != nil {
+		name, err := o.fileName()
+		if err != nil {
+			return "", err
+		}
+		filename = name + ext
+	}
 
 	// Check if Dir exists. Create, if necessary, in the current working directory.
 	// Make sure Mkdir has permission bit 0744, namely 7. Otherwise os.Create will fail as
@@ -84,3 +379,51 @@ func (o outCfg) toFile() (string, error) {
 
 	return filepath.Join(o.Dir, filename), nil
 }
+
+// outputTimestamp is the layout of the timestamp in output file names.
+const outputTimestamp = "20060102_150405"
+
+// outputName is the data an outputTemplate is rendered with.
+type outputName struct {
+	Prefix    string // prefixJSON, or the hostname with outputMode split
+	Timestamp string // the run's start, e.g. 20170506_173824
+	RunID     string
+	Type      string // the metadata type
+}
+
+// parseOutputTemplate parses an outputTemplate, a text/template naming output files, without the
+// extension, e.g. {{.Prefix}}_{{.Type}}_{{now "2006-01-02"}}. now formats the run's start with a
+// Go time layout.
+func parseOutputTemplate(s string) (*template.Template, error) {
+	return template.New("outputTemplate").
+		Funcs(template.FuncMap{"now": time.Time{}.Format}).
+		Parse(s)
+}
+
+// fileName renders o.Template. The result must be a file name, not a path, so the template
+// can't write outside o.Dir. Values are made safe for a file name, e.g. a type derived from
+// extras, so a template that renders when parsed doesn't fail once the run completes.
+func (o outCfg) fileName() (string, error) {
+	t, err := o.Template.Clone()
+	if err != nil {
+		return "", err
+	}
+	t.Funcs(template.FuncMap{"now": o.DateTime.Format})
+
+	var b strings.Builder
+	err = t.Execute(&b, outputName{
+		Prefix:    o.FilePrefix,
+		Timestamp: o.DateTime.Format(outputTimestamp),
+		RunID:     o.RunID,
+		Type:      boomerang.SafeFileName(o.Type),
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "failed rendering outputTemplate")
+	}
+
+	name := b.String()
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", errors.Errorf("outputTemplate rendered [%v], must be a file name without a directory", name)
+	}
+	return name, nil
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mfridman/boomerang"
+)
+
+func TestFiltered(t *testing.T) {
+	b := &boomerang.Boomerang{
+		MetaData: boomerang.Meta{TotalMachines: 3},
+		MachineData: []boomerang.Machine{
+			{SSHInfo: boomerang.SSHInfo{HostName: "ok"}, Connection: true, StreamData: []boomerang.Stream{{Succeeded: true}}},
+			{SSHInfo: boomerang.SSHInfo{HostName: "cmd-failed"}, Connection: true, StreamData: []boomerang.Stream{{Succeeded: true}, {}}},
+			{SSHInfo: boomerang.SSHInfo{HostName: "conn-failed"}},
+		},
+	}
+
+	tests := []struct {
+		filter string
+		want   []boomerang.Machine // machines kept
+	}{
+		{outputFilterAll, b.MachineData},
+		{outputFilterFailed, b.MachineData[1:]},
+		{outputFilterConnected, b.MachineData[:2]},
+	}
+	for _, tt := range tests {
+		out := filtered(b, tt.filter)
+		if !reflect.DeepEqual(out.MachineData, tt.want) {
+			t.Errorf("%s: kept %+v, want %+v", tt.filter, out.MachineData, tt.want)
+		}
+		want := &boomerang.Filter{Mode: tt.filter, Items: len(tt.want)}
+		if !reflect.DeepEqual(out.MetaData.Filter, want) {
+			t.Errorf("%s: filter metadata %+v, want %+v", tt.filter, out.MetaData.Filter, want)
+		}
+		if out.MetaData.TotalMachines != 3 {
+			t.Errorf("%s: total_items %d, want 3", tt.filter, out.MetaData.TotalMachines)
+		}
+		// b itself is unchanged
+		if len(b.MachineData) != 3 || b.MetaData.Filter != nil {
+			t.Fatalf("%s: modified the unfiltered output", tt.filter)
+		}
+	}
+}
+
+func TestOutCfgFileName(t *testing.T) {
+	tests := []struct {
+		template string
+		typ      string
+		want     string
+		wantErr  bool
+	}{
+		{"{{.Prefix}}_{{.Timestamp}}", "", "web_20170506_173824", false},
+		{`{{.Prefix}}-{{.Type}}-{{now "2006-01-02"}}-{{.RunID}}`, "db", "web-db-2017-05-06-id", false},
+		{"{{.Type}}", "../etc/passwd", ".._etc_passwd", false}, // values are made safe
+		{"{{.Type}}", "..", "", true},
+		{"../{{.Prefix}}", "", "", true},
+		{`{{.Prefix}}\x`, "", "", true},
+		{"sub/{{.Prefix}}", "", "", true},
+		{"{{.Missing}}", "", "", true},
+		{"{{if false}}x{{end}}", "", "", true},
+	}
+	for _, tt := range tests {
+		tmpl, err := parseOutputTemplate(tt.template)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.template, err)
+		}
+		o := outCfg{
+			FilePrefix: "web",
+			DateTime:   time.Date(2017, 5, 6, 17, 38, 24, 0, time.UTC),
+			Template:   tmpl,
+			RunID:      "id",
+			Type:       tt.typ,
+		}
+		got, err := o.fileName()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q type %q: error %v, want error: %v", tt.template, tt.typ, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q type %q: got %q, want %q", tt.template, tt.typ, got, tt.want)
+		}
+	}
+}
+
+func TestCleanUpExcept(t *testing.T) {
+	files := []string{
+		"a.json", "b.json.gz.age", "web1_20170506_173824.json", "run.ndjson.gz", "run.tar.gz",
+		".a.json.123.tmp", "notes.txt", "a.json.bak",
+	}
+
+	tests := []struct {
+		name   string
+		except []string
+		want   []string // files left, sorted
+	}{
+		{"all output", nil, []string{".a.json.123.tmp", "a.json.bak", "d.json", "notes.txt"}},
+		{"by name", []string{"a.json"}, []string{".a.json.123.tmp", "a.json", "a.json.bak", "d.json", "notes.txt"}},
+		{
+			"by path",
+			[]string{"/elsewhere/run.tar.gz", "raw/web1_20170506_173824.json"},
+			[]string{".a.json.123.tmp", "a.json.bak", "d.json", "notes.txt", "run.tar.gz", "web1_20170506_173824.json"},
+		},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		for _, f := range files {
+			if err := os.WriteFile(filepath.Join(dir, f), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// only regular files are removed
+		if err := os.Mkdir(filepath.Join(dir, "d.json"), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if errs := cleanUpExcept(dir, tt.except...); len(errs) > 0 {
+			t.Errorf("%s: %v", tt.name, errs)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var left []string
+		for _, e := range entries {
+			left = append(left, e.Name())
+		}
+		sort.Strings(left)
+		if !reflect.DeepEqual(left, tt.want) {
+			t.Errorf("%s: left %q, want %q", tt.name, left, tt.want)
+		}
+	}
+
+	if errs := cleanUpExcept(filepath.Join(t.TempDir(), "missing")); len(errs) != 1 {
+		t.Errorf("missing directory: errors %v, want 1", errs)
+	}
+}
+
+func TestAtomicFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string // content of the output file before, none if empty
+		commit   bool
+		want     string // content after, no file if empty
+	}{
+		{"commit", "", true, "new"},
+		{"commit replaces", "old", true, "new"},
+		{"abort", "", false, ""},
+		{"abort keeps", "old", false, "old"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		name := filepath.Join(dir, "out.json")
+		if tt.existing != "" {
+			if err := os.WriteFile(name, []byte(tt.existing), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		f, err := createAtomic(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteString("new"); err != nil {
+			t.Fatal(err)
+		}
+		// nothing is under the output name while writing
+		if b, _ := os.ReadFile(name); string(b) != tt.existing {
+			t.Errorf("%s: %s is %q while writing, want %q", tt.name, name, b, tt.existing)
+		}
+		if isOutputFile(filepath.Base(f.Name())) {
+			t.Errorf("%s: temp file %s is an output file", tt.name, f.Name())
+		}
+
+		if tt.commit {
+			if err := f.commit(); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		} else {
+			f.abort()
+		}
+
+		b, err := os.ReadFile(name)
+		switch {
+		case tt.want == "" && !os.IsNotExist(err):
+			t.Errorf("%s: %s exists, want no file", tt.name, name)
+		case tt.want != "" && string(b) != tt.want:
+			t.Errorf("%s: %s is %q, %v, want %q", tt.name, name, b, err, tt.want)
+		}
+		if fi, err := os.Stat(name); tt.commit && err == nil && fi.Mode().Perm() != 0644 {
+			t.Errorf("%s: %s mode %v, want -rw-r--r--", tt.name, name, fi.Mode())
+		}
+		// the temp file is gone either way
+		var want []string
+		if tt.want != "" {
+			want = []string{"out.json"}
+		}
+		entries, _ := os.ReadDir(dir)
+		var left []string
+		for _, e := range entries {
+			left = append(left, e.Name())
+		}
+		if !reflect.DeepEqual(left, want) {
+			t.Errorf("%s: left %q in %s, want %q", tt.name, left, dir, want)
+		}
+	}
+}
+
+// testOutput is a run's output with two machines.
+func testOutput() *boomerang.Boomerang {
+	return &boomerang.Boomerang{
+		MetaData: boomerang.Meta{RunID: "run-1", Type: "deploy", TotalMachines: 2, Labels: map[string]string{"env": "prod"}},
+		MachineData: []boomerang.Machine{
+			{
+				SSHInfo:    boomerang.SSHInfo{HostName: "web1", Username: "u", Port: "22"},
+				Connection: true,
+				StreamData: []boomerang.Stream{{Name: "up", Stdout: "up 3 days", Succeeded: true}},
+			},
+			{SSHInfo: boomerang.SSHInfo{HostName: "web2", Username: "u", Port: "22"}, ConnectionErrors: []string{"refused"}},
+		},
+	}
+}
+
+// readOutput decodes the output file, gunzipping it first if compressed.
+func readOutput(t *testing.T, file string, compressed bool) *boomerang.Boomerang {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := io.Reader(f)
+	if compressed {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		r = gz
+	}
+	var b boomerang.Boomerang
+	if err := json.NewDecoder(r).Decode(&b); err != nil {
+		t.Fatalf("%s: %v", file, err)
+	}
+	return &b
+}
+
+func TestWriteCompressed(t *testing.T) {
+	b := testOutput()
+	for _, compress := range []bool{false, true} {
+		o := outCfg{Dir: t.TempDir(), FilePrefix: "raw", DateTime: time.Now(), Ext: ".json", Compress: compress}
+		if compress {
+			o.Ext += ".gz"
+		}
+		file, err := o.write(b, nil, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compress != strings.HasSuffix(file, ".json.gz") {
+			t.Errorf("compress %v: wrote %s", compress, file)
+		}
+		if got := readOutput(t, file, compress); !reflect.DeepEqual(got, b) {
+			t.Errorf("compress %v: read back %+v, want %+v", compress, got, b)
+		}
+	}
+}
+
+func TestWriteFiles(t *testing.T) {
+	b := testOutput()
+	now := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	ts := now.Format(outputTimestamp)
+	combined := &boomerang.Boomerang{MetaData: b.MetaData, MachineData: b.MachineData}
+	web1 := &boomerang.Boomerang{MetaData: b.MetaData, MachineData: b.MachineData[:1]}
+	web2 := &boomerang.Boomerang{MetaData: b.MetaData, MachineData: b.MachineData[1:]}
+	tests := []struct {
+		name string
+		mode string
+		want map[string]*boomerang.Boomerang
+	}{
+		{name: "combined", mode: outputCombined, want: map[string]*boomerang.Boomerang{"raw_" + ts + ".json": combined}},
+		{name: "split", mode: outputSplit, want: map[string]*boomerang.Boomerang{"web1_" + ts + ".json": web1, "web2_" + ts + ".json": web2}},
+		{name: "both", mode: outputBoth, want: map[string]*boomerang.Boomerang{"raw_" + ts + ".json": combined, "web1_" + ts + ".json": web1, "web2_" + ts + ".json": web2}},
+		{name: "none", mode: outputNone, want: map[string]*boomerang.Boomerang{}},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		o := outCfg{Dir: dir, FilePrefix: "raw", DateTime: now, Ext: ".json"}
+		files, err := o.writeFiles(tt.mode, b, nil, false)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(files) != len(tt.want) {
+			t.Errorf("%s: wrote %v, want %d files", tt.name, files, len(tt.want))
+		}
+		for _, file := range files {
+			want, ok := tt.want[filepath.Base(file)]
+			if !ok {
+				t.Errorf("%s: unexpected file %s", tt.name, file)
+				continue
+			}
+			if got := readOutput(t, file, false); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: %s read back %+v, want %+v", tt.name, file, got, want)
+			}
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != len(tt.want) {
+			t.Errorf("%s: %d files in the output directory, want %d", tt.name, len(entries), len(tt.want))
+		}
+	}
+}
+
+func TestWriteOutput(t *testing.T) {
+	b := testOutput()
+	now := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		stdout bool   // output: "-", main writes to os.Stdout
+		path   string // output: <file>, relative to the test's directory
+		want   string // the file written, relative to the test's directory
+	}{
+		{name: "stdout", stdout: true},
+		{name: "path", path: "out/run.json", want: "out/run.json"},
+		{name: "default", want: "raw/raw_" + now.Format(outputTimestamp) + ".json"},
+	}
+	for _, tt := range tests {
+		root := t.TempDir()
+		o := outCfg{Dir: filepath.Join(root, "raw"), FilePrefix: "raw", DateTime: now, Ext: ".json"}
+		var stdout bytes.Buffer
+		if tt.stdout {
+			o.Writer = &stdout
+		}
+		if tt.path != "" {
+			if err := os.MkdirAll(filepath.Join(root, filepath.Dir(tt.path)), 0755); err != nil {
+				t.Fatal(err)
+			}
+			o.Path = filepath.Join(root, tt.path)
+		}
+
+		file, err := o.write(b, nil, false)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		want := ""
+		if tt.want != "" {
+			want = filepath.Join(root, tt.want)
+		}
+		if file != want {
+			t.Errorf("%s: wrote %q, want %q", tt.name, file, want)
+		}
+
+		var got boomerang.Boomerang
+		if tt.stdout {
+			if err := json.Unmarshal(stdout.Bytes(), &got); err != nil {
+				t.Fatalf("%s: %v: %s", tt.name, err, stdout.Bytes())
+			}
+			// nothing is written to the output directory
+			if _, err := os.Stat(o.Dir); !os.IsNotExist(err) {
+				t.Errorf("%s: output directory exists, err %v", tt.name, err)
+			}
+		} else {
+			got = *readOutput(t, file, false)
+		}
+		if !reflect.DeepEqual(&got, b) {
+			t.Errorf("%s: read back %+v, want %+v", tt.name, got, b)
+		}
+	}
+}
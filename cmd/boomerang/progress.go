@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mfridman/boomerang"
+)
+
+// progress reports how many machines have completed, out of total, as they complete. On a
+// terminal a single line is updated in place, otherwise a line is printed every interval, so
+// logs captured from non-interactive runs aren't flooded.
+type progress struct {
+	w        io.Writer
+	total    int
+	tty      bool
+	interval time.Duration
+
+	completed, failed atomic.Int64
+
+	mu   sync.Mutex // serializes writes to w
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newProgress returns a progress reporting to w, usually os.Stderr so it stays out of output
+// written to stdout. tty is whether w is a terminal.
+func newProgress(w io.Writer, total int, tty bool) *progress {
+	return &progress{
+		w:        w,
+		total:    total,
+		tty:      tty,
+		interval: 10 * time.Second,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// start starts reporting, it must be followed by finish.
+func (p *progress) start() {
+	go func() {
+		defer close(p.done)
+		if p.tty {
+			p.print()
+			<-p.stop
+			return
+		}
+		t := time.NewTicker(p.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-t.C:
+				p.print()
+			}
+		}
+	}()
+}
+
+// machine records m as completed. It's an Options.OnMachine.
+func (p *progress) machine(m boomerang.Machine) {
+	p.completed.Add(1)
+	if m.Failed() {
+		p.failed.Add(1)
+	}
+	if p.tty {
+		p.print()
+	}
+}
+
+// finish stops reporting, printing the final count.
+func (p *progress) finish() {
+	close(p.stop)
+	<-p.done
+	p.print()
+	if p.tty {
+		p.mu.Lock()
+		fmt.Fprintln(p.w)
+		p.mu.Unlock()
+	}
+}
+
+// print writes the current count, over the previous one on a terminal.
+func (p *progress) print() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	line := fmt.Sprintf("completed %d/%d (%d failed)", p.completed.Load(), p.total, p.failed.Load())
+	if p.tty {
+		// return to the start of the line and clear it
+		fmt.Fprint(p.w, "\r\033[K"+line)
+		return
+	}
+	fmt.Fprintln(p.w, line)
+}
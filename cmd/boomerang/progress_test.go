@@ -0,0 +1,23 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mfridman/boomerang"
+)
+
+func TestProgress(t *testing.T) {
+	var buf bytes.Buffer
+	p := newProgress(&buf, 4, false)
+	p.start()
+	p.machine(boomerang.Machine{Connection: true})
+	p.machine(boomerang.Machine{Connection: true, StreamData: []boomerang.Stream{{Succeeded: false}}})
+	p.machine(boomerang.Machine{Connection: false})
+	p.finish()
+
+	// no interval passed, only the final count is printed
+	if got, want := buf.String(), "completed 3/4 (2 failed)\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
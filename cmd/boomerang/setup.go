@@ -3,22 +3,29 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"net"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
+	"time"
 
+	"filippo.io/age"
+	"github.com/itchyny/gojq"
+	"github.com/kevinburke/ssh_config"
+	"github.com/mfridman/boomerang"
 	"github.com/pkg/errors"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"golang.org/x/crypto/ssh"
-)
-
-var (
-	// VER holds version+build, which is defined at build time through -ldflags.
-	// Example: -ldflags="-X main.VERSION=$(git describe --always --abbrev=0 --tags)+$(git rev-parse --short=8 master)"
-	VER = "devel"
+	"golang.org/x/term"
 )
 
 func setup() (*State, error) {
@@ -32,19 +39,30 @@ func setup() (*State, error) {
 	// Uses each flag's long name as the config key
 	viper.BindPFlags(pflag.CommandLine)
 
-	if len(pflag.Args()) > 0 {
-		return nil, errors.New("boomerang does not accept args. Define state using flags or config file")
+	// Args after -- are treated as a single ad-hoc command, e.g. boomerang -- uptime
+	dash := pflag.CommandLine.ArgsLenAtDash()
+	if dash != 0 && len(pflag.Args()) > 0 {
+		return nil, errors.New("boomerang does not accept args. Define state using flags or config file, or pass a command after --")
 	}
 
 	if *version {
-		fmt.Fprintf(os.Stdout, "boomerang version+hash: %s\n", VER)
+		fmt.Fprintf(os.Stdout, "boomerang version+hash: %s\n", boomerang.Version)
+		os.Exit(0)
+	}
+
+	// validating an output file needs no config
+	if *validate != "" {
+		if err := validateFile(*validate); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(os.Stdout, "%s matches boomerang version %s output\n", *validate, boomerang.Version)
 		os.Exit(0)
 	}
 
 	// Before initializing State and converting all viper options to State, read in a config file.
 	// Most options can be specified through cli flags, but, config is a mandatory requirement
 	// because it contains a list of commands to execute.
-	if err := readConfig(*config); err != nil {
+	if err := readConfig(*config, *profile); err != nil {
 		return nil, err
 	}
 
@@ -60,56 +78,127 @@ func setup() (*State, error) {
 // setViperDefaults sets sensible defaults.
 func setViperDefaults() {
 	viper.SetDefault("hostKeyCheck", true)
+	viper.SetDefault("useSSHConfig", false)
+	viper.SetDefault("envStrict", false)
+	viper.SetDefault("sshConfigFile", filepath.Join(os.Getenv("HOME"), ".ssh", "config"))
 	viper.SetDefault("machineType", "")
 	viper.SetDefault("keepLatestFile", false)
 	viper.SetDefault("indentJSON", true)
 	viper.SetDefault("prefixJSON", "raw")
+	viper.SetDefault("outputTemplate", "")
+	viper.SetDefault("outputMode", outputCombined)
+	viper.SetDefault("outputFilter", outputFilterAll)
+	viper.SetDefault("outputTimeout", 30)
+	viper.SetDefault("ndjsonOrdered", false)
+	viper.SetDefault("ndjsonOrderedTimeout", 60)
+	viper.SetDefault("progress", false)
+	viper.SetDefault("preflight", false)
+	viper.SetDefault("preflightTimeout", 3)
+	viper.SetDefault("outputRetry", 3)
 	viper.SetDefault("connTimeout", 10)
 	viper.SetDefault("retry", 1)
 	viper.SetDefault("retryWait", 15)
+	viper.SetDefault("retryBackoff", "fixed")
+	viper.SetDefault("retryMaxWait", 300)
 	viper.SetDefault("agentSSHAuth", "SSH_AUTH_SOCK")
+	viper.SetDefault("waitForSSH", 0)
+	viper.SetDefault("commandTimeout", 0)
+	viper.SetDefault("keepaliveInterval", 0)
+	viper.SetDefault("globalTimeout", 0)
+	viper.SetDefault("maxConcurrency", 50)
+	viper.SetDefault("streamOutput", false)
+	viper.SetDefault("logLevel", "error")
+	viper.SetDefault("maxOutputBytes", 0)
+	viper.SetDefault("encryptOutput", false)
+	viper.SetDefault("compress", false)
+	viper.SetDefault("dispatchOrder", "inventory")
+	viper.SetDefault("outputOrder", boomerang.OutputOrderHostname)
+	viper.SetDefault("dedupeMode", "first")
+	viper.SetDefault("inventoryTimeout", 10)
+	viper.SetDefault("inventoryRetry", 3)
+	viper.SetDefault("inventoryMaxPages", 100)
+	viper.SetDefault("maxLineLength", 0)
+	viper.SetDefault("verifyChecksum", false)
+	viper.SetDefault("measureResources", false)
+	viper.SetDefault("remoteTmpDir", "/tmp")
+	viper.SetDefault("remoteTmpPrefix", "boomerang")
+	viper.SetDefault("gcMinAge", 86400)
+	viper.SetDefault("notifyMessage", defaultNotifyMessage)
+	viper.SetDefault("notifyWhen", "always")
+	viper.SetDefault("logToHostSyslog", false)
+	viper.SetDefault("templateCommands", false)
+	viper.SetDefault("templateStrict", true)
+	viper.SetDefault("failOnStderr", false)
+	viper.SetDefault("stopOnFailure", false)
+	viper.SetDefault("combineOutput", false)
+	viper.SetDefault("dupCommandNames", "suffix")
+	viper.SetDefault("trimOutput", true)
+	viper.SetDefault("parallelCommands", false)
+	viper.SetDefault("maxSessions", 4)
+	viper.SetDefault("failOnError", false)
+	viper.SetDefault("canaryMaxFailure", 0)
+	viper.SetDefault("failFastThreshold", 0)
+	viper.SetDefault("failFastMinHosts", 5)
+	viper.SetDefault("anonymizeHosts", false)
+	viper.SetDefault("anonymizeMapFile", "hostmap.json")
 }
 
-// State holds all necessary information for Boomerang to run.
-// Once setup no fields are mutable.
+// State holds all necessary information for Boomerang to run: the Options passed to
+// boomerang.Run, and how the inventory is read and the output written. Once setup no fields
+// are mutable.
 type State struct {
-	configFile       string         // mandatory
-	inventory        string         // mandatory
-	auth             ssh.AuthMethod // mandatory
-	privKeyLocation  string         // conditional
-	SSHpassword      string         // conditional
-	agentSSHAuth     string
-	machineType      string
-	prefixJSON       string
-	connTimeout      int64 // TODO, convert this to duration
-	retry, retryWait int64 // TODO, convert this to duration
-	hostKeyCheck     bool
-	keepLatestFile   bool
-	indentJSON       bool
-	commands         []command
-	uploads          []upload
-}
+	boomerang.Options
+
+	configFile         string              // mandatory
+	inventory          string              // mandatory
+	inlineInventory    []boomerang.SSHInfo // set instead of inventory when machines are listed in the config file
+	inventoryTransform *gojq.Code          // optional, jq expression extracting machines from the inventory
+	inventoryHTTP      inventoryHTTP       // headers and timeout when the inventory is a network address
+	prefixJSON         string
+	output             string             // "-" for stdout, a file, or empty for raw/<prefixJSON>_<timestamp>.json
+	outputMode         string             // combined, split, both, ndjson, archive or none
+	outputFilter       string             // all, failed or connected, machines written out
+	outputHTTP         outputHTTP         // posts the output when url is set
+	progress           bool               // report completed machines on stderr
+	sshConfig          *ssh_config.Config // fills in machine defaults with useSSHConfig, nil if not set
+	keepLatestFile     bool
+	indentJSON         bool
+	compress           bool               // gzip the output file
+	recipient          age.Recipient      // set when encryptOutput is true
+	limit              string             // only machines matching the selector are run
+	dedupeMode         string             // strict, first or off
+	dispatchOrder      string             // inventory, random or sorted
+	dispatchSortKey    string             // Extras key used when dispatchOrder=sorted, defaults to hostname
+	outputTemplate     *template.Template // names output files instead of <prefixJSON>_<timestamp>
+	dryRun             bool               // print what would run without connecting
+	notifyURL          string
+	notifyWhen         string // always, on_failure or on_success
+	notifyMessage      *template.Template
+	failOnError        bool // exit 1 if any machine failed to connect or any command failed
+	anonymizeHosts     bool // replace hostnames in output with pseudonyms
+	anonymizeSalt      string
+	anonymizeMapFile   string
 
-type upload struct {
-	src       string
-	dest      string
-	filename  string
-	content   []byte
-	overwrite bool
+	ndjsonOrdered        bool          // write ndjson in inventory order rather than completion order
+	ndjsonOrderedTimeout time.Duration // how long ndjsonOrdered holds machines back for one still running
 }
 
-type command struct {
-	name string
-	cmd  string
-	sudo bool
+// parseDeadline parses d as either an absolute RFC3339 time, e.g. 2017-05-06T22:00:00Z, or a
+// duration from start, e.g. 45m.
+func parseDeadline(d string, start time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, d); err == nil {
+		return t, nil
+	}
+	dur, err := time.ParseDuration(d)
+	if err != nil || dur <= 0 {
+		return time.Time{}, errors.Errorf("invalid deadline: %s\n\tmust be an RFC3339 time or a positive duration, e.g. 45m", d)
+	}
+	return start.Add(dur), nil
 }
 
 // newState returns State.
 func newState() *State {
-	s := &State{
-		commands: make([]command, 0),
-	}
-	return s
+	return &State{}
 }
 
 // fromViper updates State based on viper options
@@ -117,70 +206,484 @@ func (s *State) importFromViper() error {
 
 	// config
 	s.configFile = viper.GetString("config") // from cli flag or from current dir
+	s.RunID = boomerang.NewRunID()
+	s.Profile = viper.GetString("profile")
 
-	// inventory
-	if !viper.IsSet("inventory") {
+	// inventory, --hosts takes its place for a one-off run. The inventory is either a path or URL,
+	// or a list of machines inline in the config file
+	switch machines, inline := viper.Get("inventory").([]interface{}); {
+	case viper.GetString("hosts") != "":
+		hosts, err := parseHosts(viper.GetString("hosts"))
+		if err != nil {
+			return errors.Wrap(err, "could not parse hosts")
+		}
+		s.inlineInventory = hosts
+	case !viper.IsSet("inventory"):
 		return errors.New("missing inventory option")
+	case inline:
+		listed, err := parseInlineInventory(machines)
+		if err != nil {
+			return err
+		}
+		s.inlineInventory = listed
+	default:
+		s.inventory = viper.GetString("inventory")
+	}
+
+	if t := viper.GetString("inventoryTransform"); t != "" {
+		q, err := gojq.Parse(t)
+		if err != nil {
+			return errors.Wrapf(err, "could not parse inventoryTransform: %s", t)
+		}
+		c, err := gojq.Compile(q)
+		if err != nil {
+			return errors.Wrapf(err, "could not compile inventoryTransform: %s", t)
+		}
+		s.inventoryTransform = c
+	}
+
+	// environment variables in header values are expanded by readConfig
+	s.inventoryHTTP.headers = make(map[string]string)
+	for k, v := range viper.GetStringMapString("inventoryHeaders") {
+		s.inventoryHTTP.headers[k] = v
+	}
+	if t := viper.GetString("inventoryToken"); t != "" {
+		s.inventoryHTTP.headers["Authorization"] = "Bearer " + t
+	}
+	if viper.GetInt64("inventoryTimeout") <= 0 {
+		return errors.New("inventoryTimeout must be a positive value")
+	}
+	s.inventoryHTTP.timeout = time.Duration(viper.GetInt64("inventoryTimeout")) * time.Second
+	if s.inventoryHTTP.retry = viper.GetInt("inventoryRetry"); s.inventoryHTTP.retry < 0 {
+		return errors.New("inventoryRetry must be a positive value")
+	}
+	if s.inventoryHTTP.maxPages = viper.GetInt("inventoryMaxPages"); s.inventoryHTTP.maxPages < 0 {
+		return errors.New("inventoryMaxPages must be a positive value")
+	}
+	if s.inlineInventory == nil {
+		paging, err := inventoryPaging(s.inventory, viper.GetString("inventoryPaging"))
+		if err != nil {
+			return err
+		}
+		s.inventoryHTTP.paging = paging
 	}
-	s.inventory = viper.GetString("inventory")
 
 	// authentication method
 	if !viper.IsSet("auth") {
-		return errors.New("missing valid auth option. Available options: key, agent or password")
+		return errors.New("missing valid auth option. Available options: key, cert, agent or password")
 	}
 
-	opts := authOpt{
-		auth:  viper.GetString("auth"),
-		key:   viper.GetString("privKeyLocation"),
-		pass:  viper.GetString("SSHpassword"),
-		agent: viper.GetString("agentSSHAuth"),
+	s.SudoPassword = viper.GetString("sudoPassword")
+
+	// auth may list several methods, tried in order. A listed method missing what it needs,
+	// e.g. a password, is skipped with a warning, a single method must be usable.
+	s.Auth = boomerang.Auth{
+		Methods:     toStrings(viper.Get("auth")),
+		PrivateKey:  viper.GetString("privKeyLocation"),
+		Certificate: viper.GetString("certLocation"),
+		KeyDir:      viper.GetString("keyDir"),
+		Agent:       viper.GetString("agentSSHAuth"),
+	}
+	if contains(s.Auth.Methods, "password") {
+		// a password is only prompted for when it's the sole method, a listed one is skipped
+		var prompt string
+		if len(s.Auth.Methods) == 1 {
+			prompt = "SSH password: "
+		}
+		p, err := getPassword(passwordOpt{
+			pass:     viper.GetString("SSHpassword"),
+			passFile: viper.GetString("SSHpasswordFile"),
+			prompt:   prompt,
+		})
+		if err != nil && len(s.Auth.Methods) == 1 {
+			return err
+		}
+		s.Auth.Password = p
 	}
 
-	a, err := setAuth(opts)
-	if err != nil {
-		return err
+	s.JumpHost = viper.GetString("jumpHost")
+
+	// jumpAuth is optional, without it the bastion uses the same auth as the machine
+	if viper.IsSet("jumpAuth") {
+		a := &boomerang.Auth{
+			Methods:     []string{viper.GetString("jumpAuth")},
+			PrivateKey:  viper.GetString("jumpPrivKeyLocation"),
+			Certificate: viper.GetString("jumpCertLocation"),
+			Agent:       viper.GetString("agentSSHAuth"),
+		}
+		if a.Methods[0] == "password" {
+			p, err := getPassword(passwordOpt{
+				pass:     viper.GetString("jumpSSHpassword"),
+				passFile: viper.GetString("jumpSSHpasswordFile"),
+				prompt:   "Jump host SSH password: ",
+			})
+			if err != nil {
+				return errors.Wrap(err, "jumpAuth")
+			}
+			a.Password = p
+		}
+		s.JumpAuth = a
 	}
-	s.auth = a
 
-	s.machineType = viper.GetString("machineType")
+	s.Type = viper.GetString("machineType")
+	s.TypeFrom = viper.GetString("typeFrom")
 	s.prefixJSON = viper.GetString("prefixJSON")
+	s.output = viper.GetString("output")
+	if t := viper.GetString("outputTemplate"); t != "" {
+		tmpl, err := parseOutputTemplate(t)
+		if err != nil {
+			return errors.Wrap(err, "outputTemplate")
+		}
+		// rendered now, so an unknown field or a path fails before connecting
+		o := outCfg{FilePrefix: s.prefixJSON, DateTime: time.Now(), Template: tmpl, RunID: s.RunID, Type: s.Type}
+		if _, err := o.fileName(); err != nil {
+			return err
+		}
+		s.outputTemplate = tmpl
+	}
+	s.Labels = viper.GetStringMapString("labels")
+
+	s.outputHTTP.url = viper.GetString("outputURL")
+	s.outputHTTP.headers = viper.GetStringMapString("outputHeaders")
+	if viper.GetInt64("outputTimeout") <= 0 {
+		return errors.New("outputTimeout must be a positive value")
+	}
+	s.outputHTTP.timeout = time.Duration(viper.GetInt64("outputTimeout")) * time.Second
+	if s.outputHTTP.retry = viper.GetInt("outputRetry"); s.outputHTTP.retry < 0 {
+		return errors.New("outputRetry must be a positive value")
+	}
+
+	switch mode := viper.GetString("outputMode"); mode {
+	case outputCombined, outputBoth, outputNDJSON, outputArchive:
+		s.outputMode = mode
+	case outputNone:
+		if s.outputHTTP.url == "" {
+			return errors.New("outputMode none needs an outputURL, otherwise the output is not written anywhere")
+		}
+		s.outputMode = mode
+	case outputSplit:
+		if s.output != "" {
+			return errors.New("output cannot be used with outputMode split, per machine files are written to the raw directory")
+		}
+		s.outputMode = mode
+	default:
+		return errors.Errorf("unsupported outputMode: %v\n\tmust use combined, split, both, ndjson, archive or none", mode)
+	}
+	s.ndjsonOrdered = viper.GetBool("ndjsonOrdered")
+	if s.ndjsonOrdered && s.outputMode != outputNDJSON {
+		return errors.New("ndjsonOrdered can only be used with outputMode ndjson")
+	}
+	if viper.GetInt64("ndjsonOrderedTimeout") <= 0 {
+		return errors.New("ndjsonOrderedTimeout must be a positive value")
+	}
+	s.ndjsonOrderedTimeout = seconds("ndjsonOrderedTimeout")
+	if s.outputTemplate != nil && (s.outputMode == outputSplit || s.outputMode == outputBoth) {
+		// each machine's file is named with its hostname as the prefix
+		o := outCfg{DateTime: time.Now(), Template: s.outputTemplate, RunID: s.RunID, Type: s.Type}
+		o.FilePrefix = "a"
+		a, _ := o.fileName()
+		o.FilePrefix = "b"
+		if b, _ := o.fileName(); a == b {
+			return errors.New("outputTemplate must include {{.Prefix}} with outputMode split or both")
+		}
+	}
+
+	switch f := viper.GetString("outputFilter"); f {
+	case outputFilterAll, outputFilterFailed, outputFilterConnected:
+		s.outputFilter = f
+	default:
+		return errors.Errorf("unsupported outputFilter: %v\n\tmust use all, failed or connected", f)
+	}
 
 	if viper.GetInt64("connTimeout") < 0 || viper.GetInt64("retry") < 0 || viper.GetInt64("retryWait") < 0 {
 		return errors.New("connTimeout, retryWait or retry must be a positive value")
 	}
-	s.connTimeout = viper.GetInt64("connTimeout")
-	s.retry = viper.GetInt64("retry")
-	s.retryWait = viper.GetInt64("retryWait")
+	s.ConnTimeout = seconds("connTimeout")
+	s.Retry = viper.GetInt("retry")
+
+	switch viper.GetString("retryBackoff") {
+	case "fixed", "exponential":
+		s.Backoff.Policy = viper.GetString("retryBackoff")
+	default:
+		return errors.Errorf("unsupported retryBackoff: %v\n\tmust use fixed or exponential", viper.GetString("retryBackoff"))
+	}
+	if viper.GetInt64("retryMaxWait") < 0 {
+		return errors.New("retryMaxWait must be a positive value")
+	}
+	s.Backoff.Wait = seconds("retryWait")
+	s.Backoff.Max = seconds("retryMaxWait")
+
+	if viper.GetInt64("waitForSSH") < 0 {
+		return errors.New("waitForSSH must be a positive value")
+	}
+	s.WaitForSSH = seconds("waitForSSH")
+
+	s.Preflight = viper.GetBool("preflight")
+	if viper.GetInt64("preflightTimeout") <= 0 {
+		return errors.New("preflightTimeout must be a positive value")
+	}
+	s.PreflightTimeout = seconds("preflightTimeout")
+
+	// on a multi-homed host, connections can be made from the interface reaching the machines
+	if b := viper.GetString("bindAddress"); b != "" {
+		ip := net.ParseIP(b)
+		if ip == nil {
+			return errors.Errorf("bindAddress [%v] must be an IP address, e.g. 10.0.0.5", b)
+		}
+		s.BindAddress = ip
+	}
+
+	if viper.GetInt64("commandTimeout") < 0 {
+		return errors.New("commandTimeout must be a positive value")
+	}
+	s.CommandTimeout = seconds("commandTimeout")
+
+	if viper.GetInt64("keepaliveInterval") < 0 {
+		return errors.New("keepaliveInterval must be a positive value")
+	}
+	s.KeepaliveInterval = seconds("keepaliveInterval")
+
+	if viper.GetInt64("globalTimeout") < 0 {
+		return errors.New("globalTimeout must be a positive value")
+	}
+	s.GlobalTimeout = seconds("globalTimeout")
+
+	s.FailFastThreshold = viper.GetFloat64("failFastThreshold")
+	if s.FailFastThreshold < 0 || s.FailFastThreshold > 100 {
+		return errors.New("failFastThreshold must be a percentage between 0 and 100")
+	}
+	if s.FailFastMinHosts = viper.GetInt("failFastMinHosts"); s.FailFastMinHosts < 1 {
+		return errors.New("failFastMinHosts must be at least 1")
+	}
+	s.MaxConcurrency = viper.GetInt("maxConcurrency")
+
+	s.progress = viper.GetBool("progress")
+	s.StreamOutput = viper.GetBool("streamOutput")
+
+	level := viper.GetString("logLevel")
+	if viper.GetBool("verbose") {
+		level = "debug"
+	}
+	logger, err := newLogger(os.Stderr, level)
+	if err != nil {
+		return err
+	}
+	s.Logger = logger
+	if viper.GetInt("maxOutputBytes") < 0 {
+		return errors.New("maxOutputBytes must be a positive value")
+	}
+	s.MaxOutputBytes = viper.GetInt("maxOutputBytes")
+
+	if d := viper.GetString("deadline"); d != "" {
+		t, err := parseDeadline(d, time.Now())
+		if err != nil {
+			return err
+		}
+		s.Deadline = t
+	}
+
+	// hostKeyCheck predates hostKeyMode and is only used when hostKeyMode is not set
+	switch mode := viper.GetString("hostKeyMode"); mode {
+	case boomerang.HostKeyStrict, boomerang.HostKeyInsecure, boomerang.HostKeyTOFU:
+		s.HostKeyMode = mode
+	case "":
+		s.HostKeyMode = boomerang.HostKeyStrict
+		if !viper.GetBool("hostKeyCheck") {
+			s.HostKeyMode = boomerang.HostKeyInsecure
+		}
+	default:
+		return errors.Errorf("unsupported hostKeyMode: %v\n\tmust use strict, insecure or tofu", mode)
+	}
+	if viper.GetBool("useSSHConfig") {
+		f := viper.GetString("sshConfigFile")
+		cfg, err := readSSHConfig(f)
+		if err != nil {
+			return errors.Wrap(err, "useSSHConfig")
+		}
+		s.sshConfig = cfg
+	}
 
-	s.hostKeyCheck = viper.GetBool("hostKeyCheck")
+	// ~/.ssh/known_hosts and /etc/ssh/ssh_known_hosts if not set
+	s.KnownHosts = toStrings(viper.Get("knownHosts"))
+	if viper.IsSet("knownHosts") && len(s.KnownHosts) == 0 {
+		return errors.New("knownHosts must list at least one file")
+	}
+
+	// algorithms for hosts that only offer ones outside the defaults, e.g. older or hardened
+	supported, insecure := ssh.SupportedAlgorithms(), ssh.InsecureAlgorithms()
+	for _, a := range []struct {
+		key                 string
+		supported, insecure []string
+		set                 *[]string
+	}{
+		{"hostKeyAlgorithms", supported.HostKeys, insecure.HostKeys, &s.HostKeyAlgorithms},
+		{"ciphers", supported.Ciphers, insecure.Ciphers, &s.Algorithms.Ciphers},
+		{"kexAlgorithms", supported.KeyExchanges, insecure.KeyExchanges, &s.Algorithms.KeyExchanges},
+		{"macs", supported.MACs, insecure.MACs, &s.Algorithms.MACs},
+	} {
+		algos, err := parseAlgorithms(a.key, a.supported, a.insecure)
+		if err != nil {
+			return err
+		}
+		*a.set = algos
+	}
 	s.keepLatestFile = viper.GetBool("keepLatestFile")
 	s.indentJSON = viper.GetBool("indentJSON")
+	s.compress = viper.GetBool("compress")
+	s.VerifyChecksum = viper.GetBool("verifyChecksum")
+	s.MeasureResources = viper.GetBool("measureResources")
+
+	if viper.GetBool("encryptOutput") {
+		r := viper.GetString("encryptRecipient")
+		if r == "" {
+			return errors.New("must include encryptRecipient when encryptOutput=true")
+		}
+		rec, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return errors.Wrapf(err, "could not parse encryptRecipient: %s", r)
+		}
+		s.recipient = rec
+	}
+
+	switch o := viper.GetString("dispatchOrder"); o {
+	case "inventory", "random", "sorted":
+		s.dispatchOrder = o
+	default:
+		return errors.Errorf("unsupported dispatchOrder: %v\n\tmust use inventory, random or sorted", o)
+	}
+	s.dispatchSortKey = viper.GetString("dispatchSortKey")
+
+	switch o := viper.GetString("outputOrder"); o {
+	case boomerang.OutputOrderHostname, boomerang.OutputOrderInventory, boomerang.OutputOrderCompletion:
+		s.OutputOrder = o
+	default:
+		return errors.Errorf("unsupported outputOrder: %v\n\tmust use hostname, inventory or completion", o)
+	}
+
+	// checked now, before the inventory is read
+	s.limit = viper.GetString("limit")
+	if _, err := (boomerang.Inventory{}).Limit(s.limit); err != nil {
+		return err
+	}
+
+	switch d := viper.GetString("dedupeMode"); d {
+	case "strict", "first", "off":
+		s.dedupeMode = d
+	default:
+		return errors.Errorf("unsupported dedupeMode: %v\n\tmust use strict, first or off", d)
+	}
+
+	if viper.GetInt("maxLineLength") < 0 {
+		return errors.New("maxLineLength must be a positive value")
+	}
+	s.MaxLineLength = viper.GetInt("maxLineLength")
+
+	s.RemoteTmpDir = viper.GetString("remoteTmpDir")
+	s.RemoteTmpPrefix = viper.GetString("remoteTmpPrefix")
+	if s.RemoteTmpDir == "" || s.RemoteTmpPrefix == "" {
+		return errors.New("remoteTmpDir and remoteTmpPrefix must not be empty")
+	}
+	s.GC = viper.GetBool("gc")
+	if s.GCMinAge = seconds("gcMinAge"); s.GCMinAge < 0 {
+		return errors.New("gcMinAge must not be negative")
+	}
+	s.dryRun = viper.GetBool("dry-run")
+
+	s.LogToHostSyslog = viper.GetBool("logToHostSyslog")
+
+	s.TemplateCommands = viper.GetBool("templateCommands")
+	s.TemplateStrict = viper.GetBool("templateStrict")
+	s.FailOnStderr = viper.GetBool("failOnStderr")
+	s.StopOnFailure = viper.GetBool("stopOnFailure")
+	s.CombineOutput = viper.GetBool("combineOutput")
+	s.TrimOutput = viper.GetBool("trimOutput")
+	s.failOnError = viper.GetBool("failOnError")
+
+	s.Canary = viper.GetString("canary")
+	s.CanaryMaxFailure = viper.GetFloat64("canaryMaxFailure")
+	if s.CanaryMaxFailure < 0 || s.CanaryMaxFailure > 100 {
+		return errors.New("canaryMaxFailure must be a percentage between 0 and 100")
+	}
+
+	s.anonymizeHosts = viper.GetBool("anonymizeHosts")
+	s.anonymizeSalt = viper.GetString("anonymizeSalt")
+	s.anonymizeMapFile = viper.GetString("anonymizeMapFile")
+	if s.anonymizeHosts && s.anonymizeSalt == "" {
+		salt, err := readOrCreateSalt(saltFile(s.anonymizeMapFile))
+		if err != nil {
+			return errors.Wrap(err, "anonymizeSalt")
+		}
+		s.anonymizeSalt = salt
+	}
+
+	s.notifyURL = viper.GetString("notifyURL")
+	switch w := viper.GetString("notifyWhen"); w {
+	case "always", "on_failure", "on_success":
+		s.notifyWhen = w
+	default:
+		return errors.Errorf("unsupported notifyWhen: %v\n\tmust use always, on_failure or on_success", w)
+	}
+	t, err := template.New("notify").Parse(viper.GetString("notifyMessage"))
+	if err != nil {
+		return errors.Wrap(err, "could not parse notifyMessage")
+	}
+	s.notifyMessage = t
 
 	if viper.IsSet("commands") {
 		c := viper.Get("commands")
-		v, ok := c.([]command)
+		v, ok := c.([]boomerang.Command)
 		if !ok {
 			return errors.New("could not assert command list")
 		}
-		s.commands = v
+		s.Commands = v
+	}
+
+	s.ParallelCommands = viper.GetBool("parallelCommands")
+	s.MaxSessions = viper.GetInt("maxSessions")
+
+	if viper.IsSet("finally") {
+		c := viper.Get("finally")
+		v, ok := c.([]boomerang.Command)
+		if !ok {
+			return errors.New("could not assert finally command list")
+		}
+		s.Finally = v
+	}
+
+	if args := pflag.Args(); len(args) > 0 {
+		cli := boomerang.CommandFromArgs("cli", args...)
+		s.CLI = &cli
+	}
+
+	switch mode := viper.GetString("dupCommandNames"); mode {
+	case "suffix", "strict":
+		s.DupCommandNames = mode
+	default:
+		return errors.Errorf("unsupported dupCommandNames: %v\n\tmust use suffix or strict", mode)
 	}
 
 	if viper.IsSet("uploads") {
 		u := viper.Get("uploads")
-		up, ok := u.([]upload)
+		up, ok := u.([]boomerang.Upload)
 		if !ok {
 			return errors.New("could not assert upload list")
 		}
-		s.uploads = up
+		s.Uploads = up
 	}
 
 	return nil
 }
 
+// seconds returns the option key, a number of seconds, as a duration.
+func seconds(key string) time.Duration {
+	return time.Duration(viper.GetInt64(key)) * time.Second
+}
+
 // readConfig reads config file and stores commands and suser options in viper.
-func readConfig(f string) error {
+// If profile is non-empty, its values are overlaid over the base config.
+func readConfig(f, profile string) error {
 
-	viper.SetConfigType("yaml")
+	viper.SetConfigType(configType(f))
 
 	cfg, err := os.Stat(f)
 	if err != nil {
@@ -196,7 +699,24 @@ func readConfig(f string) error {
 		return errors.Wrap(err, "viper could not read in config")
 	}
 
-	if err := parseCommands(); err != nil {
+	if err := applyProfile(profile); err != nil {
+		return err
+	}
+
+	if err := expandConfigEnv(viper.GetBool("envStrict")); err != nil {
+		return err
+	}
+
+	// with output on stdout, keep it pure JSON by logging to stderr
+	if viper.GetString("output") == "-" {
+		log.SetOutput(os.Stderr)
+	}
+
+	if err := parseCommands("commands"); err != nil {
+		return err
+	}
+
+	if err := parseCommands("finally"); err != nil {
 		return err
 	}
 
@@ -207,11 +727,178 @@ func readConfig(f string) error {
 	return nil
 }
 
+// configType returns the format of config file f from its extension: yaml, json or toml.
+// Files without a known extension, e.g. the default config, are yaml.
+func configType(f string) string {
+	switch strings.ToLower(filepath.Ext(f)) {
+	case ".json":
+		return "json"
+	case ".toml":
+		return "toml"
+	default:
+		return "yaml"
+	}
+}
+
+// envKeys are the options whose values expand environment variables, so secrets needn't be in
+// the config file. Commands are not expanded, their variables are for the machine's shell.
+var envKeys = []string{
+	"SSHpassword", "jumpSSHpassword", "SSHpasswordFile", "jumpSSHpasswordFile", "sudoPassword",
+	"privKeyLocation", "jumpPrivKeyLocation", "certLocation", "jumpCertLocation", "inventory",
+	"inventoryToken", "inventoryHeaders", "notifyURL", "encryptRecipient", "outputURL", "outputHeaders",
+}
+
+// expandConfigEnv expands environment variables in the envKeys options, and in the password of
+// machines in an inline inventory. See expandEnv.
+func expandConfigEnv(strict bool) error {
+	for _, k := range envKeys {
+		if !viper.IsSet(k) {
+			continue
+		}
+		switch v := viper.Get(k).(type) {
+		case string:
+			e, err := expandEnv(v, strict)
+			if err != nil {
+				return errors.Wrap(err, k)
+			}
+			if e != v {
+				viper.Set(k, e)
+			}
+		case map[string]interface{}:
+			for mk, mv := range v {
+				s, ok := mv.(string)
+				if !ok {
+					continue
+				}
+				e, err := expandEnv(s, strict)
+				if err != nil {
+					return errors.Wrapf(err, "%s.%s", k, mk)
+				}
+				v[mk] = e
+			}
+			viper.Set(k, v)
+		case []interface{}:
+			// an inline inventory
+			for i, item := range v {
+				m, ok := item.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if p, ok := m["password"].(string); ok {
+					e, err := expandEnv(p, strict)
+					if err != nil {
+						return errors.Wrapf(err, "inline inventory item %d password", i)
+					}
+					m["password"] = e
+				}
+			}
+			viper.Set(k, v)
+		}
+	}
+	return nil
+}
+
+// expandEnv expands $VAR and ${VAR} in s from the environment, $$ is a literal $. With strict, a
+// variable that isn't set is an error, otherwise it expands to empty.
+func expandEnv(s string, strict bool) (string, error) {
+	var unset []string
+	out := os.Expand(s, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			unset = append(unset, name)
+		}
+		return v
+	})
+	if strict && len(unset) > 0 {
+		return "", errors.Errorf("environment variable %s is not set", unset[0])
+	}
+	return out, nil
+}
+
+// applyProfile merges the options under profiles.<name> into the base config, so a single
+// config file can hold e.g. dev, staging and prod variants. Profile values take precedence
+// over the base config, but cli flags still take precedence over both.
+func applyProfile(name string) error {
+	if name == "" {
+		return nil
+	}
+
+	p := viper.Sub("profiles." + name)
+	if p == nil {
+		return errors.Errorf("unknown profile: %s", name)
+	}
+
+	if err := viper.MergeConfigMap(p.AllSettings()); err != nil {
+		return errors.Wrapf(err, "could not apply profile: %s", name)
+	}
+
+	return nil
+}
+
+// parseInlineInventory parses machines listed directly under inventory in the config file.
+func parseInlineInventory(in []interface{}) ([]boomerang.SSHInfo, error) {
+	machines, err := machineObjects(in)
+	if err != nil {
+		return nil, errors.Wrap(err, "inline inventory")
+	}
+	inventory, err := toSSHInfo(machines)
+	if err != nil {
+		return nil, errors.Wrap(err, "inline inventory")
+	}
+	for i, m := range inventory {
+		// the username may come from ssh_config instead, see applySSHConfig
+		if m.HostName == "" || (m.Username == "" && !viper.GetBool("useSSHConfig")) {
+			return nil, errors.Errorf("inline inventory item %d: hostname and username are mandatory", i)
+		}
+	}
+	return inventory, nil
+}
+
+// parseHosts parses a comma-separated list of user@host:port into machines, e.g.
+// "admin@10.0.0.1,admin@web1:2222,root@[::1]:22". The port may be omitted, defaulting to 22,
+// and the user only when ssh_config supplies it, see applySSHConfig.
+func parseHosts(s string) ([]boomerang.SSHInfo, error) {
+	var out []boomerang.SSHInfo
+	for _, h := range strings.Split(s, ",") {
+		if h = strings.TrimSpace(h); h == "" {
+			continue
+		}
+
+		var info boomerang.SSHInfo
+		host := h
+		if i := strings.LastIndex(host, "@"); i >= 0 {
+			info.Username, host = host[:i], host[i+1:]
+		}
+		// a bare IPv6 address has colons but no port
+		if hst, port, err := net.SplitHostPort(host); err == nil {
+			host, info.Port = hst, port
+		} else if strings.Contains(host, ":") && net.ParseIP(strings.Trim(host, "[]")) == nil {
+			return nil, errors.Errorf("[%v] %v", h, err)
+		}
+		info.HostName = strings.Trim(host, "[]")
+
+		if info.HostName == "" {
+			return nil, errors.Errorf("[%v] is missing a host", h)
+		}
+		if info.Username == "" && !viper.GetBool("useSSHConfig") {
+			return nil, errors.Errorf("[%v] is missing a user, use user@host", h)
+		}
+		out = append(out, info)
+	}
+	if len(out) == 0 {
+		return nil, errors.New("no hosts listed")
+	}
+	return out, nil
+}
+
 func parseUploads() error {
 
 	var in [][]string
 
-	var out []upload
+	var out []boomerang.Upload
 
 	if !viper.InConfig("uploads") {
 		return nil
@@ -227,17 +914,12 @@ func parseUploads() error {
 			continue
 		}
 
+		// an upload that can't be read is skipped, rather than failing the run
 		f, err := os.Open(u[0])
 		if err != nil {
 			log.Println(err)
 			continue
 		}
-
-		by, err := ioutil.ReadAll(f)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
 		f.Close()
 
 		var o bool
@@ -245,13 +927,7 @@ func parseUploads() error {
 			o = true
 		}
 
-		out = append(out, upload{
-			src:       u[0],
-			dest:      u[1],
-			filename:  filepath.Base(u[0]),
-			content:   by,
-			overwrite: o,
-		})
+		out = append(out, boomerang.Upload{Src: u[0], Dest: u[1], Overwrite: o})
 
 	}
 
@@ -260,45 +936,457 @@ func parseUploads() error {
 	return nil
 }
 
-func parseCommands() error {
+// parseCommands parses the list of commands stored under key, e.g. commands or finally.
+// Commands run in the order they are listed. Each command is an object with a name and a command:
+//
+//   - name: uptime
+//     command: /usr/bin/uptime
+//
+// The older name: command form is still accepted, but deprecated, because several pairs in a
+// single list item have no guaranteed order.
+func parseCommands(key string) error {
 
-	i := make([]map[interface{}]interface{}, 0)
+	i := make([]map[string]interface{}, 0)
 
-	out := make([]command, 0)
+	out := make([]boomerang.Command, 0)
 
-	if !viper.InConfig("commands") {
+	if !viper.InConfig(key) {
 		return nil
 	}
 
-	if err := viper.UnmarshalKey("commands", &i); err != nil {
-		return errors.Wrap(err, "unable to unmarshal commands into struct")
+	if err := viper.UnmarshalKey(key, &i); err != nil {
+		return errors.Wrapf(err, "unable to unmarshal %s into struct", key)
 	}
 
+	var deprecated bool
 	for _, m := range i {
-		for k, v := range m {
-			if key, ok := k.(string); ok {
-				if value, ok := v.(string); ok {
-					b := strings.Contains(value, "sudo")
-					out = append(out, command{key, value, b})
-				} else {
-					log.Printf("Warning: [%v] is not a string. Command will be ignored, check config file\n", v)
-					continue
-				}
-			} else {
-				log.Printf("Warning: [%v] is not a string. Command name will be ignored, check config file\n", k)
+		if isCommandObject(m) {
+			// a rejected command fails the config, dropping it would still run those after it
+			c, err := parseCommand(m)
+			if err != nil {
+				return errors.Wrap(err, key)
+			}
+			out = append(out, c)
+			continue
+		}
+
+		// deprecated name: command form. Sort names so that several pairs in one
+		// item are at least run in a stable order.
+		deprecated = true
+		names := make([]string, 0, len(m))
+		for k := range m {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+
+		for _, k := range names {
+			value, ok := m[k].(string)
+			if !ok {
+				log.Printf("Warning: [%v] is not a string. Command will be ignored, check config file\n", m[k])
 				continue
 			}
+			out = append(out, boomerang.Command{Name: k, Command: value})
 		}
 	}
 
-	viper.Set("commands", out)
+	if deprecated {
+		log.Printf("Warning: %s uses the deprecated name: command form. Use a list of name and command objects to guarantee order\n", key)
+	}
+
+	viper.Set(key, out)
 
 	return nil
 }
 
-type authOpt struct {
-	auth  string
-	key   string
-	pass  string
-	agent string
+// setHostCommands sets the commands of each machine in inventory with a commands list in its
+// extras, in the same form as the config file's. They replace the global commands or, with
+// extras commands_mode: append, run after them.
+func setHostCommands(inventory []boomerang.SSHInfo) error {
+	for i := range inventory {
+		s := &inventory[i]
+		v, ok := s.Extras["commands"]
+		if !ok {
+			continue
+		}
+		list, ok := v.([]interface{})
+		if !ok {
+			return errors.Errorf("[%v] extras commands must be a list of commands", s.HostName)
+		}
+
+		cs := make([]boomerang.Command, 0, len(list))
+		for j, item := range list {
+			m, ok := item.(map[string]interface{})
+			if !ok {
+				return errors.Errorf("[%v] extras commands item %d must be a command object, with a name and command", s.HostName, j)
+			}
+			// keys are matched lowercased, as they are from the config file
+			lower := make(map[string]interface{}, len(m))
+			for k, v := range m {
+				lower[strings.ToLower(k)] = v
+			}
+			if !isCommandObject(lower) {
+				return errors.Errorf("[%v] extras commands item %d must be a command object, with a name and command", s.HostName, j)
+			}
+			c, err := parseCommand(lower)
+			if err != nil {
+				return errors.Wrapf(err, "[%v] extras commands", s.HostName)
+			}
+			cs = append(cs, c)
+		}
+
+		switch mode := s.Extras["commands_mode"]; mode {
+		case nil, "replace":
+		case "append":
+			s.AppendCommands = true
+		default:
+			return errors.Errorf("[%v] unsupported extras commands_mode: %v\n\tmust use replace or append", s.HostName, mode)
+		}
+		s.Commands = cs
+	}
+	return nil
+}
+
+// isCommandObject reports whether m is a command object, rather than the deprecated name: command form.
+func isCommandObject(m map[string]interface{}) bool {
+	for _, k := range []string{"command", "upload", "download"} {
+		if _, ok := m[k]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCommand parses a single command object. Instead of a command, it may have an upload or a
+// download with local and remote paths.
+func parseCommand(m map[string]interface{}) (boomerang.Command, error) {
+	name, ok := m["name"].(string)
+	if !ok || name == "" {
+		return boomerang.Command{}, errors.Errorf("command [%v] must have a name", m["command"])
+	}
+
+	var c boomerang.Command
+	switch {
+	case m["upload"] != nil:
+		t, err := parseTransfer(name, false, m["upload"])
+		if err != nil {
+			return boomerang.Command{}, err
+		}
+		c = boomerang.Command{Name: name, Transfer: t}
+	case m["download"] != nil:
+		t, err := parseTransfer(name, true, m["download"])
+		if err != nil {
+			return boomerang.Command{}, err
+		}
+		c = boomerang.Command{Name: name, Transfer: t}
+	default:
+		cmd, ok := m["command"].(string)
+		if !ok || cmd == "" {
+			return boomerang.Command{}, errors.Errorf("command [%v] is not a string", name)
+		}
+		c = boomerang.Command{Name: name, Command: cmd}
+	}
+
+	// keys are lowercased by viper, stopOnFailure is read as stoponfailure
+	if v, ok := m["stoponfailure"]; ok {
+		b, ok := v.(bool)
+		if !ok {
+			return boomerang.Command{}, errors.Errorf("command [%v] stopOnFailure must be true or false", name)
+		}
+		c.StopOnFailure = &b
+	}
+
+	if v, ok := m["combineoutput"]; ok {
+		b, ok := v.(bool)
+		if !ok {
+			return boomerang.Command{}, errors.Errorf("command [%v] combineOutput must be true or false", name)
+		}
+		c.CombineOutput = &b
+	}
+
+	if v, ok := m["failonstderr"]; ok {
+		b, ok := v.(bool)
+		if !ok {
+			return boomerang.Command{}, errors.Errorf("command [%v] failOnStderr must be true or false", name)
+		}
+		c.FailOnStderr = &b
+	}
+
+	if v, ok := m["measureresources"]; ok {
+		b, ok := v.(bool)
+		if !ok {
+			return boomerang.Command{}, errors.Errorf("command [%v] measureResources must be true or false", name)
+		}
+		c.MeasureResources = &b
+	}
+
+	// sudo must be set explicitly, a command only mentioning sudo, e.g. cat /etc/sudoers, isn't
+	// given the password
+	if v, ok := m["sudo"]; ok {
+		b, ok := v.(bool)
+		if !ok {
+			return boomerang.Command{}, errors.Errorf("command [%v] sudo must be true or false", name)
+		}
+		c.Sudo = b
+	}
+
+	if v, ok := m["timeout"]; ok {
+		t, err := toInt(v)
+		if err != nil || t < 0 {
+			return boomerang.Command{}, errors.Errorf("command [%v] timeout must be a positive number of seconds", name)
+		}
+		c.Timeout = time.Duration(t) * time.Second
+	}
+
+	if v, ok := m["retries"]; ok {
+		r, err := toInt(v)
+		if err != nil || r < 0 {
+			return boomerang.Command{}, errors.Errorf("command [%v] retries must be a positive number", name)
+		}
+		c.Retries = r
+	}
+
+	if v, ok := m["retrywait"]; ok {
+		w, err := toInt(v)
+		if err != nil || w < 0 {
+			return boomerang.Command{}, errors.Errorf("command [%v] retryWait must be a positive number of seconds", name)
+		}
+		c.RetryWait = time.Duration(w) * time.Second
+	}
+
+	if v, ok := m["retryonexit"]; ok {
+		for _, s := range toStrings(v) {
+			code, err := strconv.Atoi(s)
+			if err != nil {
+				return boomerang.Command{}, errors.Errorf("command [%v] retryOnExit must be a list of exit codes", name)
+			}
+			c.RetryOnExit = append(c.RetryOnExit, code)
+		}
+	}
+
+	if v, ok := m["env"]; ok {
+		env, err := parseEnv(v)
+		if err != nil {
+			return boomerang.Command{}, errors.Wrapf(err, "command [%v]", name)
+		}
+		c.Env = env
+	}
+
+	if v, ok := m["dir"]; ok {
+		dir, ok := v.(string)
+		if !ok || dir == "" {
+			return boomerang.Command{}, errors.Errorf("command [%v] dir must be a path", name)
+		}
+		c.Dir = dir
+	}
+
+	if v, ok := m["shell"]; ok {
+		s, ok := v.(string)
+		if !ok {
+			return boomerang.Command{}, errors.Errorf("command [%v] shell must be a string, e.g. bash -lc", name)
+		}
+		c.Shell = parseShell(s)
+	}
+
+	if v, ok := m["local"]; ok {
+		b, ok := v.(bool)
+		if !ok {
+			return boomerang.Command{}, errors.Errorf("command [%v] local must be true or false", name)
+		}
+		c.Local = b
+	}
+
+	if v, ok := m["localshell"]; ok {
+		b, ok := v.(bool)
+		if !ok {
+			return boomerang.Command{}, errors.Errorf("command [%v] localShell must be true or false", name)
+		}
+		c.LocalShell = b
+	}
+	if err := c.Validate(); err != nil {
+		return boomerang.Command{}, err
+	}
+
+	return c, nil
+}
+
+// parseTransfer parses the local and remote paths of an upload or download command.
+// A download's local path is relative to raw/<hostname>/ and defaults to the remote file's name.
+// The paths are checked by Command.Validate.
+func parseTransfer(name string, download bool, v interface{}) (*boomerang.FileTransfer, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf("command [%v] transfer must have local and remote paths", name)
+	}
+	local, _ := m["local"].(string)
+	remote, _ := m["remote"].(string)
+
+	if download && local == "" && remote != "" {
+		local = path.Base(remote)
+	}
+	if download && local != "" {
+		local = filepath.Clean(local)
+	}
+	return &boomerang.FileTransfer{Download: download, Local: local, Remote: remote}, nil
+}
+
+// parseShell parses a command's shell, a shell and its flags ending with the one that takes the
+// command, e.g. bash -lc or sh -c. none, or empty, runs the command as-is. It's checked by
+// Command.Validate.
+func parseShell(s string) []string {
+	if s == "none" {
+		return nil
+	}
+	return strings.Fields(s)
+}
+
+// parseEnv parses a command's env, either a list of NAME=value strings or a map of names to
+// values. viper lowercases map keys, so names in the map form are uppercased; use the list form
+// for names that aren't all uppercase.
+func parseEnv(v interface{}) (map[string]string, error) {
+	env := make(map[string]string)
+	switch e := v.(type) {
+	case []interface{}:
+		for _, kv := range e {
+			s, ok := kv.(string)
+			i := strings.Index(s, "=")
+			if !ok || i < 1 {
+				return nil, errors.Errorf("env [%v] must be NAME=value", kv)
+			}
+			env[s[:i]] = s[i+1:]
+		}
+	case map[string]interface{}:
+		for k, v := range e {
+			env[strings.ToUpper(k)] = fmt.Sprint(v)
+		}
+	default:
+		return nil, errors.New("env must be a list of NAME=value or a map of names to values")
+	}
+	return env, nil
+}
+
+// toInt converts a number decoded from config, which may be an int or a float depending on
+// the config format, to an int.
+func toInt(v interface{}) (int, error) {
+	switch n := v.(type) {
+	case int:
+		return n, nil
+	case int64:
+		return int(n), nil
+	case float64:
+		return int(n), nil
+	case string:
+		return strconv.Atoi(n)
+	default:
+		return 0, errors.Errorf("[%v] is not a number", v)
+	}
+}
+
+// parseAlgorithms returns the algorithms listed by the option key, which must each be one of
+// supported or insecure. Insecure algorithms are only used when listed, e.g. for an old host.
+func parseAlgorithms(key string, supported, insecure []string) ([]string, error) {
+	algos := toStrings(viper.Get(key))
+	for _, a := range algos {
+		if !contains(supported, a) && !contains(insecure, a) {
+			return nil, errors.Errorf("unsupported %s: %v\n\tmust use %s", key, a, strings.Join(append(supported[:len(supported):len(supported)], insecure...), ", "))
+		}
+	}
+	return algos, nil
+}
+
+// contains reports whether s is in list.
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// toStrings converts a list decoded from config, either a list or a comma-separated string, to
+// a slice of strings. Blank entries are dropped.
+func toStrings(v interface{}) []string {
+	var items []string
+	switch l := v.(type) {
+	case string:
+		items = strings.Split(l, ",")
+	case []string:
+		items = l
+	case []interface{}:
+		for _, i := range l {
+			items = append(items, fmt.Sprint(i))
+		}
+	}
+
+	var out []string
+	for _, i := range items {
+		if i = strings.TrimSpace(i); i != "" {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+// passwordOpt is where a password is read from, in order.
+type passwordOpt struct {
+	pass     string
+	passFile string
+	prompt   string // prompts for the password on the terminal if neither pass nor passFile is set
+}
+
+// promptPassword reads a password from the terminal without echoing it, showing prompt. It
+// fails if stdin isn't a terminal, e.g. when run from cron.
+var promptPassword = func(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", errors.New("stdin is not a terminal")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	p, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return string(p), err
+}
+
+// getPassword returns the password set in a, else the first line of its password file, else
+// prompts for it.
+func getPassword(a passwordOpt) (string, error) {
+	if a.pass != "" {
+		return a.pass, nil
+	}
+
+	if a.passFile != "" {
+		b, err := ioutil.ReadFile(a.passFile)
+		if err != nil {
+			return "", errors.Wrap(err, "could not read password file")
+		}
+		p, _, _ := strings.Cut(string(b), "\n")
+		p = strings.TrimSuffix(p, "\r")
+		if p == "" {
+			return "", errors.Errorf("password file %s is empty", a.passFile)
+		}
+		return p, nil
+	}
+
+	if a.prompt == "" {
+		return "", errors.New("must include SSHpassword or SSHpasswordFile when auth=password")
+	}
+	p, err := promptPassword(a.prompt)
+	if err != nil {
+		return "", errors.Wrap(err, "must include SSHpassword or SSHpasswordFile when auth=password and not run from a terminal")
+	}
+	if p == "" {
+		return "", errors.New("empty password entered")
+	}
+	return p, nil
+}
+
+// newLogger returns a logger writing progress, per machine and command, to w at level and above:
+// debug, info, warn or error. The handler serializes writes, so lines from machines running
+// concurrently don't interleave.
+func newLogger(w io.Writer, level string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(strings.TrimSpace(level))); err != nil {
+		return nil, errors.Errorf("unsupported logLevel: %v\n\tmust use debug, info, warn or error", level)
+	}
+	return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: l})), nil
 }
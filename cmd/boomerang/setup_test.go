@@ -0,0 +1,533 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mfridman/boomerang"
+	"github.com/spf13/viper"
+)
+
+// readTestConfig resets viper and reads the yaml config.
+func readTestConfig(t *testing.T, config string) {
+	t.Helper()
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// loadTestState reads config, with profile applied, into a State as setup does, without flags.
+func loadTestState(t *testing.T, config, profile string) (*State, error) {
+	t.Helper()
+	f := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(f, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	setViperDefaults()
+	if err := readConfig(f, profile); err != nil {
+		return nil, err
+	}
+	s := newState()
+	if err := s.importFromViper(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func TestParseCommandsOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{
+			"objects in listed order",
+			`
+commands:
+  - name: zeta
+    command: uptime
+  - name: alpha
+    command: hostname
+  - name: mid
+    command: df
+`,
+			[]string{"zeta", "alpha", "mid"},
+		},
+		{
+			"deprecated pairs sorted within an item",
+			`
+commands:
+  - zeta: uptime
+    alpha: hostname
+  - beta: df
+`,
+			[]string{"alpha", "zeta", "beta"},
+		},
+		{
+			"mixed forms",
+			`
+commands:
+  - b: uptime
+  - name: a
+    command: hostname
+`,
+			[]string{"b", "a"},
+		},
+	}
+	for _, tt := range tests {
+		readTestConfig(t, tt.config)
+		if err := parseCommands("commands"); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		cs, _ := viper.Get("commands").([]boomerang.Command)
+		var names []string
+		for _, c := range cs {
+			names = append(names, c.Name)
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("%s: commands %q, want %q", tt.name, names, tt.want)
+		}
+	}
+}
+
+func TestReadConfigInvalidCommand(t *testing.T) {
+	// a rejected command fails the config rather than being dropped from the sequence
+	tests := []struct {
+		name    string
+		command string // yaml of the second command, indented under commands
+		wantErr string
+	}{
+		{"stopOnFailure", "command: make\n    stopOnFailure: yes please", "stopOnFailure must be true or false"},
+		{"sudo", "command: make\n    sudo: 1", "sudo must be true or false"},
+		{"timeout", "command: make\n    timeout: -5", "timeout must be a positive number of seconds"},
+		{"shell", "command: make\n    shell: bash", "unsupported shell"},
+		{"download path traversal", "download:\n      remote: /etc/passwd\n      local: ../../passwd", "must be relative to raw/<hostname>"},
+		{"finally", "command: make\n    localShell: true", "localShell requires local: true"},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		key := "commands"
+		if tt.name == "finally" {
+			key = "finally"
+		}
+		config := fmt.Sprintf("%s:\n  - name: build\n    command: make\n  - name: bad\n    %s\n  - name: deploy\n    command: make deploy\n", key, tt.command)
+		f := filepath.Join(dir, "config.yaml")
+		if err := os.WriteFile(f, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		viper.Reset()
+		err := readConfig(f, "")
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !strings.Contains(err.Error(), "command [bad]") {
+			t.Errorf("%s: error %v, want command [bad] %q", tt.name, err, tt.wantErr)
+		}
+	}
+	viper.Reset()
+}
+
+func TestReadConfigType(t *testing.T) {
+	tests := []struct {
+		file   string
+		config string
+	}{
+		{"config.yaml", "retryWait: 3\ncommands:\n  - name: up\n    command: uptime\n"},
+		{"config.YML", "retryWait: 3\ncommands:\n  - name: up\n    command: uptime\n"},
+		{"config", "retryWait: 3\ncommands:\n  - name: up\n    command: uptime\n"},
+		{"config.json", `{"retryWait": 3, "commands": [{"name": "up", "command": "uptime"}]}`},
+		{"config.toml", "retryWait = 3\n\n[[commands]]\nname = \"up\"\ncommand = \"uptime\"\n"},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		viper.Reset()
+		t.Cleanup(viper.Reset)
+		f := filepath.Join(dir, tt.file)
+		if err := os.WriteFile(f, []byte(tt.config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := readConfig(f, ""); err != nil {
+			t.Errorf("%s: %v", tt.file, err)
+			continue
+		}
+		if n := viper.GetInt("retryWait"); n != 3 {
+			t.Errorf("%s: retryWait = %d, want 3", tt.file, n)
+		}
+		cs, _ := viper.Get("commands").([]boomerang.Command)
+		if len(cs) != 1 || cs[0].Name != "up" || cs[0].Command != "uptime" {
+			t.Errorf("%s: commands %+v, want up: uptime", tt.file, cs)
+		}
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("BOOMERANG_TEST_PASS", "s3cret")
+	t.Setenv("BOOMERANG_TEST_EMPTY", "")
+
+	tests := []struct {
+		in      string
+		strict  bool
+		want    string
+		wantErr bool
+	}{
+		{"plain", false, "plain", false},
+		{"$BOOMERANG_TEST_PASS", true, "s3cret", false},
+		{"${BOOMERANG_TEST_PASS}-x", true, "s3cret-x", false},
+		{"pa$$word", true, "pa$word", false},
+		{"$$BOOMERANG_TEST_PASS", true, "$BOOMERANG_TEST_PASS", false},
+		{"$BOOMERANG_TEST_EMPTY", true, "", false}, // set but empty
+		{"a$BOOMERANG_TEST_UNSET", false, "a", false},
+		{"a$BOOMERANG_TEST_UNSET", true, "", true},
+	}
+	for _, tt := range tests {
+		got, err := expandEnv(tt.in, tt.strict)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q strict=%v: error %v, want error: %v", tt.in, tt.strict, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q strict=%v: got %q, want %q", tt.in, tt.strict, got, tt.want)
+		}
+	}
+}
+
+func TestParseHosts(t *testing.T) {
+	tests := []struct {
+		hosts        string
+		useSSHConfig bool
+		want         []boomerang.SSHInfo
+		wantErr      bool
+	}{
+		{"admin@10.0.0.1", false, []boomerang.SSHInfo{{Username: "admin", HostName: "10.0.0.1"}}, false},
+		{"admin@web1:2222, root@web2", false, []boomerang.SSHInfo{{Username: "admin", HostName: "web1", Port: "2222"}, {Username: "root", HostName: "web2"}}, false},
+		{"root@[::1]:22", false, []boomerang.SSHInfo{{Username: "root", HostName: "::1", Port: "22"}}, false},
+		{"root@::1", false, []boomerang.SSHInfo{{Username: "root", HostName: "::1"}}, false},
+		{"root@[::1]", false, []boomerang.SSHInfo{{Username: "root", HostName: "::1"}}, false},
+		{"a@b@web1", false, []boomerang.SSHInfo{{Username: "a@b", HostName: "web1"}}, false},
+		{"web1,,", true, []boomerang.SSHInfo{{HostName: "web1"}}, false},
+		{"web1", false, nil, true},
+		{"admin@", false, nil, true},
+		{"admin@web1:22:", false, nil, true},
+		{" , ", false, nil, true},
+	}
+	for _, tt := range tests {
+		viper.Reset()
+		viper.Set("useSSHConfig", tt.useSSHConfig)
+		got, err := parseHosts(tt.hosts)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error %v, want error: %v", tt.hosts, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %+v, want %+v", tt.hosts, got, tt.want)
+		}
+	}
+	viper.Reset()
+}
+
+func TestParseShell(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"none", nil},
+		{"", nil},
+		{"bash -lc", []string{"bash", "-lc"}},
+		{"  sh \t -c ", []string{"sh", "-c"}},
+	}
+	for _, tt := range tests {
+		// nil and empty are the same, no shell
+		if got := parseShell(tt.in); len(got)+len(tt.want) > 0 && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestProfile(t *testing.T) {
+	const config = `
+inventory: dev_machines.json
+auth: password
+SSHpassword: secret
+connTimeout: 5
+machineType: dev
+commands:
+  - name: up
+    command: uptime
+profiles:
+  prod:
+    inventory: https://cmdb.example.com/api/v1/machines
+    connTimeout: 20
+    commands:
+      - name: df
+        command: df -h
+`
+	tests := []struct {
+		profile     string
+		inventory   string
+		connTimeout time.Duration
+		commands    []string
+		wantErr     string
+	}{
+		{"", "dev_machines.json", 5 * time.Second, []string{"up"}, ""},
+		// the profile's values win, those it doesn't set are the base config's
+		{"prod", "https://cmdb.example.com/api/v1/machines", 20 * time.Second, []string{"df"}, ""},
+		{"staging", "", 0, nil, "unknown profile: staging"},
+	}
+	for _, tt := range tests {
+		s, err := loadTestState(t, config, tt.profile)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%q: error %v, want %q", tt.profile, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", tt.profile, err)
+		}
+		var commands []string
+		for _, c := range s.Commands {
+			commands = append(commands, c.Name)
+		}
+		if s.inventory != tt.inventory || s.ConnTimeout != tt.connTimeout || !reflect.DeepEqual(commands, tt.commands) {
+			t.Errorf("%q: inventory %q connTimeout %v commands %v, want %q %v %v",
+				tt.profile, s.inventory, s.ConnTimeout, commands, tt.inventory, tt.connTimeout, tt.commands)
+		}
+		if s.Type != "dev" {
+			t.Errorf("%q: type %q, want dev from the base config", tt.profile, s.Type)
+		}
+	}
+}
+
+func TestInlineInventoryRun(t *testing.T) {
+	// nothing listens on the port, the machines fail to connect but are still in the output
+	l, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("could not listen on 127.0.0.2: %v", err)
+	}
+	l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	s, err := loadTestState(t, fmt.Sprintf(`
+inventory:
+  - hostname: 127.0.0.2
+    username: alice
+    ssh_port: "%[1]s"
+    extras:
+      role: db
+  - hostname: 127.0.0.2
+    username: bob
+    ssh_port: "%[1]s"
+  - hostname: 127.0.0.2
+    username: carol
+    ssh_port: "%[1]s"
+auth: password
+SSHpassword: secret
+hostKeyMode: insecure
+retry: 0
+commands:
+  - name: up
+    command: uptime
+`, port), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.inventory != "" || len(s.inlineInventory) != 3 {
+		t.Fatalf("inventory %q with %d inline machines, want 3 inline", s.inventory, len(s.inlineInventory))
+	}
+
+	s.Inventory = boomerang.Inventory(s.inlineInventory)
+	s.DownloadDir = t.TempDir()
+	b, err := boomerang.Run(context.Background(), s.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []boomerang.SSHInfo
+	for _, m := range b.MachineData {
+		// set by Run, a directory per machine under s.DownloadDir
+		m.DownloadDir = ""
+		got = append(got, m.SSHInfo)
+	}
+	want := []boomerang.SSHInfo{
+		{HostName: "127.0.0.2", Port: port, Username: "alice", Extras: map[string]interface{}{"role": "db"}},
+		{HostName: "127.0.0.2", Port: port, Username: "bob", Extras: map[string]interface{}{}},
+		{HostName: "127.0.0.2", Port: port, Username: "carol", Extras: map[string]interface{}{}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("machine data %+v, want %+v", got, want)
+	}
+}
+
+func TestGetPassword(t *testing.T) {
+	dir := t.TempDir()
+	file := func(name, content string) string {
+		f := filepath.Join(dir, name)
+		if err := os.WriteFile(f, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	// stdin is a pipe, not a terminal, as when run from cron
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(stdin *os.File) { os.Stdin = stdin; r.Close(); w.Close() }(os.Stdin)
+	os.Stdin = r
+
+	tests := []struct {
+		name    string
+		opt     passwordOpt
+		want    string
+		wantErr string
+	}{
+		{"password", passwordOpt{pass: "s3cret", passFile: file("unused", "other\n")}, "s3cret", ""},
+		{"first line of file", passwordOpt{passFile: file("pass", "p@ss word\r\nsecond line\n")}, "p@ss word", ""},
+		{"empty file", passwordOpt{passFile: file("empty", "\n")}, "", "is empty"},
+		{"missing file", passwordOpt{passFile: filepath.Join(dir, "missing")}, "", "could not read password file"},
+		{"no prompt", passwordOpt{}, "", "must include SSHpassword or SSHpasswordFile"},
+		{"no terminal", passwordOpt{prompt: "SSH password: "}, "", "not run from a terminal: stdin is not a terminal"},
+	}
+	for _, tt := range tests {
+		got, err := getPassword(tt.opt)
+		switch {
+		case tt.wantErr == "" && (err != nil || got != tt.want):
+			t.Errorf("%s: got %q, %v, want %q", tt.name, got, err, tt.want)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+
+	// read from SSHpasswordFile in the config
+	s, err := loadTestState(t, fmt.Sprintf(`
+inventory: machines.json
+auth: password
+SSHpasswordFile: %s
+commands:
+  - name: up
+    command: uptime
+`, file("config_pass", "from-file\n")), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Auth.Password != "from-file" {
+		t.Errorf("password %q, want from-file", s.Auth.Password)
+	}
+}
+
+func TestLabelsRoundTrip(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("could not listen on 127.0.0.2: %v", err)
+	}
+	l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	s, err := loadTestState(t, fmt.Sprintf(`
+inventory:
+  - hostname: 127.0.0.2
+    username: alice
+    ssh_port: "%s"
+auth: password
+SSHpassword: secret
+hostKeyMode: insecure
+retry: 0
+labels:
+  env: prod
+  ticket: OPS-123
+  note: "deploy, then restart"
+commands:
+  - name: up
+    command: uptime
+`, port), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"env": "prod", "ticket": "OPS-123", "note": "deploy, then restart"}
+	if !reflect.DeepEqual(s.Labels, want) {
+		t.Fatalf("labels %v, want %v", s.Labels, want)
+	}
+
+	s.Inventory = boomerang.Inventory(s.inlineInventory)
+	s.DownloadDir = t.TempDir()
+	b, err := boomerang.Run(context.Background(), s.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := outCfg{Dir: t.TempDir(), FilePrefix: "raw", DateTime: time.Now()}.write(b, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := readOutput(t, file, false).MetaData
+	if !reflect.DeepEqual(got.Labels, want) {
+		t.Errorf("labels read back %v, want %v", got.Labels, want)
+	}
+	if got.RunID != s.RunID || got.RunID == "" {
+		t.Errorf("run_id read back %q, want %q", got.RunID, s.RunID)
+	}
+}
+
+func TestSetHostCommands(t *testing.T) {
+	commands := []interface{}{
+		map[string]interface{}{"name": "up", "command": "uptime"},
+		map[string]interface{}{"Name": "df", "Command": "df -h"},
+	}
+	tests := []struct {
+		name       string
+		mode       interface{} // extras commands_mode, nil if unset
+		wantAppend bool
+		wantErr    bool
+	}{
+		{"default", nil, false, false},
+		{"replace", "replace", false, false},
+		{"append", "append", true, false},
+		{"invalid mode", "merge", false, true},
+	}
+	for _, tt := range tests {
+		extras := map[string]interface{}{"commands": commands}
+		if tt.mode != nil {
+			extras["commands_mode"] = tt.mode
+		}
+		inventory := []boomerang.SSHInfo{{HostName: "web1", Extras: extras}, {HostName: "web2"}}
+		err := setHostCommands(inventory)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error: %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		var got []string
+		for _, c := range inventory[0].Commands {
+			got = append(got, c.Name+": "+c.Command)
+		}
+		if want := []string{"up: uptime", "df: df -h"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: commands %q, want %q", tt.name, got, want)
+		}
+		if inventory[0].AppendCommands != tt.wantAppend {
+			t.Errorf("%s: append %v, want %v", tt.name, inventory[0].AppendCommands, tt.wantAppend)
+		}
+		// a machine without extras commands runs the top-level commands
+		if len(inventory[1].Commands) != 0 || inventory[1].AppendCommands {
+			t.Errorf("%s: web2 commands %+v, want none", tt.name, inventory[1].Commands)
+		}
+	}
+
+	// a list of plain strings isn't accepted
+	inventory := []boomerang.SSHInfo{{HostName: "web1", Extras: map[string]interface{}{"commands": []interface{}{"uptime"}}}}
+	if err := setHostCommands(inventory); err == nil {
+		t.Error("commands not objects, want an error")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kevinburke/ssh_config"
+	"github.com/mfridman/boomerang"
+	"github.com/pkg/errors"
+)
+
+// readSSHConfig reads the ssh_config file f, e.g. ~/.ssh/config.
+func readSSHConfig(f string) (*ssh_config.Config, error) {
+	file, err := os.Open(f)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	cfg, err := ssh_config.Decode(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed parsing ssh_config %s", f)
+	}
+	return cfg, nil
+}
+
+// applySSHConfig fills in the username, port, key and jump host of machines in inventory that
+// don't have them from the ssh_config stanzas matching their hostname, e.g. User, Port,
+// IdentityFile and ProxyJump. Inventory values always take precedence. The hostname itself is
+// not replaced by a HostName alias. Every machine must have a username afterwards.
+func applySSHConfig(inventory []boomerang.SSHInfo, cfg *ssh_config.Config) ([]boomerang.SSHInfo, error) {
+	for i := range inventory {
+		s := &inventory[i]
+
+		get := func(key string) (string, error) {
+			v, err := cfg.Get(s.HostName, key)
+			return v, errors.Wrapf(err, "[%v] ssh_config %s", s.HostName, key)
+		}
+
+		if s.Username == "" {
+			v, err := get("User")
+			if err != nil {
+				return nil, err
+			}
+			s.Username = v
+		}
+		if s.Port == "" {
+			v, err := get("Port")
+			if err != nil {
+				return nil, err
+			}
+			s.Port = v
+		}
+		// a key from ssh_config is only used if the machine doesn't override auth
+		if s.KeyLocation == "" && s.CertLocation == "" && s.Auth == "" && s.Password == "" {
+			v, err := get("IdentityFile")
+			if err != nil {
+				return nil, err
+			}
+			if v != "" {
+				s.KeyLocation = expandSSHPath(v, *s)
+			}
+		}
+		if s.JumpHost == "" {
+			v, err := get("ProxyJump")
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case v == "" || v == "none":
+			case strings.Contains(v, ","):
+				log.Printf("Warning: [%v] ssh_config ProxyJump %s has several hops, only one jump host is supported, ignoring it\n", s.HostName, v)
+			default:
+				s.JumpHost = v
+			}
+		}
+
+		if s.Username == "" {
+			return nil, errors.Errorf("[%v] has no username in the inventory or ssh_config", s.HostName)
+		}
+	}
+	return inventory, nil
+}
+
+// expandSSHPath expands ~ and the %d (home), %h (hostname) and %r (username) tokens in an
+// ssh_config path, e.g. ~/.ssh/%h.key.
+func expandSSHPath(p string, s boomerang.SSHInfo) string {
+	home := os.Getenv("HOME")
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		p = filepath.Join(home, p[1:])
+	}
+	return strings.NewReplacer("%d", home, "%h", s.HostName, "%r", s.Username, "%%", "%").Replace(p)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mfridman/boomerang"
+)
+
+func TestApplySSHConfig(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "config")
+	config := "Host web1\n  User deploy\n  Port 2222\n"
+	if err := os.WriteFile(f, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := readSSHConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		in       boomerang.SSHInfo
+		wantUser string
+		wantPort string
+	}{
+		{"from ssh_config", boomerang.SSHInfo{HostName: "web1"}, "deploy", "2222"},
+		{"inventory wins", boomerang.SSHInfo{HostName: "web1", Username: "admin", Port: "22"}, "admin", "22"},
+		{"inventory user only", boomerang.SSHInfo{HostName: "web1", Username: "admin"}, "admin", "2222"},
+		{"no stanza", boomerang.SSHInfo{HostName: "web2", Username: "admin"}, "admin", ""},
+	}
+	for _, tt := range tests {
+		got, err := applySSHConfig([]boomerang.SSHInfo{tt.in}, cfg)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got[0].Username != tt.wantUser || got[0].Port != tt.wantPort {
+			t.Errorf("%s: user %q port %q, want user %q port %q", tt.name, got[0].Username, got[0].Port, tt.wantUser, tt.wantPort)
+		}
+	}
+
+	// without a User anywhere the machine can't be connected to
+	if _, err := applySSHConfig([]boomerang.SSHInfo{{HostName: "web2"}}, cfg); err == nil {
+		t.Error("no username in the inventory or ssh_config, want an error")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+
+	"github.com/mfridman/boomerang"
+)
+
+// Summary holds the outcome of a run, as counts of machines and commands.
+type Summary struct {
+	Type             string `json:"type"`
+	Total            int    `json:"total"`
+	Connected        int    `json:"connected"`
+	ConnectionFailed int    `json:"failed"`
+	CommandsFailed   int    `json:"commands_failed"`
+	TotalTime        string `json:"total_time"`
+}
+
+// summarize counts machines that connected or failed to connect, and commands that did not
+// succeed, e.g. exited non-zero, on connected machines.
+func summarize(b *boomerang.Boomerang) Summary {
+	n := Summary{
+		Type:      b.MetaData.Type,
+		Total:     len(b.MachineData),
+		TotalTime: b.MetaData.TotalTime,
+	}
+	for _, m := range b.MachineData {
+		if !m.Connection {
+			n.ConnectionFailed++
+			continue
+		}
+		n.Connected++
+		for _, s := range m.StreamData {
+			if !s.Succeeded {
+				n.CommandsFailed++
+			}
+		}
+	}
+	return n
+}
+
+// failed reports whether any machine failed to connect or any command failed.
+func (n Summary) failed() bool { return n.ConnectionFailed > 0 || n.CommandsFailed > 0 }
+
+// print writes the summary to the log.
+func (n Summary) print() {
+	log.Printf("Machines: %d connected, %d failed to connect. Commands failed: %d\n",
+		n.Connected,
+		n.ConnectionFailed,
+		n.CommandsFailed)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mfridman/boomerang"
+)
+
+func TestSummarize(t *testing.T) {
+	b := &boomerang.Boomerang{
+		MetaData: boomerang.Meta{Type: "test", TotalTime: "1s"},
+		MachineData: []boomerang.Machine{
+			{Connection: true, StreamData: []boomerang.Stream{{Succeeded: true}, {Succeeded: true}}},
+			{Connection: true, StreamData: []boomerang.Stream{{Succeeded: true}, {Succeeded: false}}},
+			{ConnectionErrors: []string{"failed client connection: ssh: handshake failed"}},
+			{ConnectionErrors: []string{"preflight: port closed/unreachable [web4:22]"}},
+		},
+	}
+
+	got := summarize(b)
+	want := Summary{Type: "test", Total: 4, Connected: 2, ConnectionFailed: 2, CommandsFailed: 1, TotalTime: "1s"}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if !got.failed() {
+		t.Error("failed() false, want true")
+	}
+
+	b.MachineData = b.MachineData[:1]
+	if got := summarize(b); got.failed() {
+		t.Errorf("%+v: failed() true, want false", got)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/mfridman/boomerang"
+	"github.com/pkg/errors"
+)
+
+// ValidateOutput checks b is boomerang JSON output matching the current Boomerang struct, so
+// downstream tooling can pin the format. Fields the struct doesn't have, e.g. one that was
+// renamed, and values of the wrong type are reported by name; the first mismatch is returned.
+func ValidateOutput(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+
+	var out boomerang.Boomerang
+	if err := dec.Decode(&out); err != nil {
+		if e, ok := err.(*json.UnmarshalTypeError); ok {
+			return errors.Errorf("field %s: %s is not a %v", e.Field, e.Value, e.Type)
+		}
+		return errors.Wrap(err, "output does not match")
+	}
+	if dec.More() {
+		return errors.New("output does not match: unexpected data after the JSON object")
+	}
+
+	// unknown fields are caught by the decoder, missing top-level ones are not
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(b, &top); err != nil {
+		return errors.Wrap(err, "output does not match")
+	}
+	for _, k := range []string{"metadata", "machine_data"} {
+		if _, ok := top[k]; !ok {
+			return errors.Errorf("output does not match: missing field %q", k)
+		}
+	}
+	return nil
+}
+
+// validateFile checks output file f with ValidateOutput. Gzipped output is decompressed first,
+// encrypted output must be decrypted before it can be checked.
+func validateFile(f string) error {
+	if strings.HasSuffix(f, ".age") {
+		return errors.Errorf("%s is encrypted, decrypt it with age first", f)
+	}
+
+	file, err := os.Open(f)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = bufio.NewReader(file)
+	// gzip streams start with 0x1f 0x8b, whatever the file is named
+	if magic, _ := r.(*bufio.Reader).Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return errors.Wrapf(err, "%s: failed reading gzip", f)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.Wrapf(err, "%s: failed reading", f)
+	}
+	return errors.Wrap(ValidateOutput(b), f)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/mfridman/boomerang"
+)
+
+func TestValidateOutput(t *testing.T) {
+	full, err := json.Marshal(boomerang.Boomerang{MachineData: []boomerang.Machine{{
+		SSHInfo:    boomerang.SSHInfo{HostName: "web1"},
+		StreamData: []boomerang.Stream{{Name: "up"}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		output  string
+		wantErr string // empty if the output is valid
+	}{
+		{"marshalled", string(full), ""},
+		{"missing fields are valid", `{"metadata": {}, "machine_data": [{"hostname": "web1"}]}`, ""},
+		{"unknown top-level field", `{"metadata": {}, "machine_data": [], "extra": 1}`, `unknown field "extra"`},
+		{"renamed machine field", `{"metadata": {}, "machine_data": [{"host_name": "web1"}]}`, `unknown field "host_name"`},
+		{"renamed stream field", `{"metadata": {}, "machine_data": [{"stream_data": [{"out": ""}]}]}`, `unknown field "out"`},
+		{"wrong type", `{"metadata": {}, "machine_data": [{"run_length": "1s"}]}`, "is not a"},
+		{"missing machine_data", `{"metadata": {}}`, `missing field "machine_data"`},
+		{"trailing data", `{"metadata": {}, "machine_data": []} {}`, "unexpected data"},
+		{"not JSON", `metadata: {}`, "output does not match"},
+	}
+	for _, tt := range tests {
+		err := ValidateOutput([]byte(tt.output))
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: %v, want valid", tt.name, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
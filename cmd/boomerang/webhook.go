@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/mfridman/boomerang"
+	"github.com/pkg/errors"
+)
+
+// outputHTTP configures posting the output to outputURL.
+type outputHTTP struct {
+	url     string
+	headers map[string]string
+	timeout time.Duration
+	retry   int // retries after a connection error or 5xx response
+}
+
+// outputBackoff is the wait between retries posting the output.
+var outputBackoff = boomerang.Backoff{Policy: "exponential", Wait: time.Second, Max: 30 * time.Second}
+
+// postOutput posts b to h.url, encoded like the output file: indented, gzipped and encrypted to
+// recipient as configured. Connection errors and 5xx or 429 responses are retried, any other
+// non-2xx response is an error.
+func postOutput(b *boomerang.Boomerang, h outputHTTP, recipient age.Recipient, indent, compress bool) error {
+	var body bytes.Buffer
+	if err := encodeOutput(&body, b, recipient, indent, compress); err != nil {
+		return errors.Wrap(err, "failed encoding output")
+	}
+
+	c := &http.Client{Timeout: h.timeout}
+	for n := 0; ; n++ {
+		retry, err := sendOutput(c, h, body.Bytes(), recipient != nil, compress)
+		if err == nil {
+			return nil
+		}
+		if !retry || n >= h.retry {
+			return err
+		}
+		d := outputBackoff.Delay(n)
+		log.Printf("Retrying output post in %v: %v\n", d-(d%time.Millisecond), err)
+		time.Sleep(d)
+	}
+}
+
+// sendOutput posts body to h.url once. retry reports whether the error may be transient.
+func sendOutput(c *http.Client, h outputHTTP, body []byte, encrypted, compressed bool) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.Wrap(err, "unable to create request")
+	}
+	switch {
+	case encrypted:
+		req.Header.Set("Content-Type", "application/octet-stream")
+	case compressed:
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
+	default:
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range h.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return true, errors.Wrap(err, "unable to post output")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := errors.Errorf("server returned a [%v], expecting a 2xx status code", resp.Status)
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return true, err
+		}
+		snippet, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		if s := strings.TrimSpace(string(snippet)); s != "" {
+			err = errors.Errorf("server returned a [%v], expecting a 2xx status code: %s", resp.Status, s)
+		}
+		return false, err
+	}
+	return false, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mfridman/boomerang"
+)
+
+func TestPostOutput(t *testing.T) {
+	defer func(b boomerang.Backoff) { outputBackoff = b }(outputBackoff)
+	outputBackoff = boomerang.Backoff{Policy: "fixed", Wait: time.Millisecond}
+
+	b := &boomerang.Boomerang{
+		MetaData: boomerang.Meta{RunID: "run-1", TotalMachines: 1},
+		MachineData: []boomerang.Machine{{
+			SSHInfo:    boomerang.SSHInfo{HostName: "web1", Username: "u"},
+			Connection: true,
+			StreamData: []boomerang.Stream{{Name: "up", Stdout: "up 3 days", Succeeded: true}},
+		}},
+	}
+
+	tests := []struct {
+		name     string
+		compress bool
+	}{
+		{"json", false},
+		{"gzipped", true},
+	}
+	for _, tt := range tests {
+		var requests int
+		var body []byte
+		var header http.Header
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			// the first post fails, the retry is accepted
+			if requests == 1 {
+				http.Error(w, "try later", http.StatusServiceUnavailable)
+				return
+			}
+			header = r.Header
+			body, _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusAccepted)
+		}))
+
+		h := outputHTTP{url: srv.URL, headers: map[string]string{"X-Token": "t0ken"}, timeout: time.Second, retry: 1}
+		err := postOutput(b, h, nil, false, tt.compress)
+		srv.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if requests != 2 {
+			t.Errorf("%s: %d requests, want 2", tt.name, requests)
+		}
+		if header.Get("X-Token") != "t0ken" || header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s: headers %v, want X-Token and Content-Type application/json", tt.name, header)
+		}
+
+		r := io.Reader(bytes.NewReader(body))
+		if tt.compress {
+			if header.Get("Content-Encoding") != "gzip" {
+				t.Errorf("%s: Content-Encoding %q, want gzip", tt.name, header.Get("Content-Encoding"))
+			}
+			if r, err = gzip.NewReader(r); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		var got boomerang.Boomerang
+		if err := json.NewDecoder(r).Decode(&got); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(got.MetaData, b.MetaData) || !reflect.DeepEqual(got.MachineData, b.MachineData) {
+			t.Errorf("%s: posted %+v, want %+v", tt.name, got, *b)
+		}
+	}
+}
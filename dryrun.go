@@ -0,0 +1,80 @@
+package boomerang
+
+import (
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// DryRun writes what Run would do with opts to w, the commands and the machines they'd run on,
+// without connecting to any machine. Each machine's port and auth are checked as they would be
+// before connecting, e.g. its private key must parse, and the first failure is returned.
+func DryRun(w io.Writer, opts Options) error {
+	st, err := newState(opts)
+	if err != nil {
+		return err
+	}
+	inventory := st.Inventory
+
+	if len(st.uploads) > 0 {
+		fmt.Fprintln(w, "Uploads:")
+		for _, u := range st.uploads {
+			fmt.Fprintf(w, "  %s -> %s\n", u.src, path.Join(u.dest, u.filename))
+		}
+	}
+
+	printCommands(w, "", "Commands:", st.commands)
+	printCommands(w, "", "Finally:", st.finally)
+
+	fmt.Fprintf(w, "Machines (%d):\n", len(inventory))
+	for _, s := range inventory {
+		m := NewMachine(s)
+		if err := m.setSSHPort(); err != nil {
+			return errors.Wrapf(err, "[%v] failed port validation", m.HostName)
+		}
+		if _, _, err := st.machineAuth(m, nil); err != nil {
+			return errors.Wrapf(err, "[%v] failed auth setup", m.HostName)
+		}
+
+		line := fmt.Sprintf("  %s@%s", m.Username, m.address())
+		if j := m.JumpHost; j != "" {
+			line += " via " + j
+		} else if st.JumpHost != "" {
+			line += " via " + st.JumpHost
+		}
+		fmt.Fprintln(w, line)
+
+		// a machine's own commands are listed under it
+		if s.Commands != nil {
+			cs, err := st.hostCommands(s)
+			if err != nil {
+				return errors.Wrapf(err, "[%v] failed command setup", m.HostName)
+			}
+			printCommands(w, "    ", "Commands:", cs)
+		}
+	}
+	return nil
+}
+
+// printCommands writes cs, in the order they run, under title with each line prefixed by indent.
+// Nothing is written for no commands.
+func printCommands(w io.Writer, indent, title string, cs []Command) {
+	if len(cs) == 0 {
+		return
+	}
+	fmt.Fprintln(w, indent+title)
+	for i, c := range cs {
+		switch {
+		case c.Transfer != nil && c.Transfer.Download:
+			fmt.Fprintf(w, "%s  %d. %s: download %s -> %s\n", indent, i+1, c.Name, c.Transfer.Remote, c.Transfer.Local)
+		case c.Transfer != nil:
+			fmt.Fprintf(w, "%s  %d. %s: upload %s -> %s\n", indent, i+1, c.Name, c.Transfer.Local, c.Transfer.Remote)
+		case c.Local:
+			fmt.Fprintf(w, "%s  %d. %s: local %s\n", indent, i+1, c.Name, c.Command)
+		default:
+			fmt.Fprintf(w, "%s  %d. %s: %s\n", indent, i+1, c.Name, c.wrapShell(c.Command))
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package boomerang
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDryRunDoesNotConnect(t *testing.T) {
+	s := startFakeSSH(t, &fakeSSH{})
+
+	opts := Options{
+		Inventory: Inventory{
+			{HostName: s.host, Port: s.port, Username: "u1"},
+			{HostName: s.host, Port: s.port, Username: "u2", JumpHost: "ops@" + s.host + ":" + s.port},
+		},
+		Commands:    []Command{{Name: "echo", Command: "echo hello"}},
+		Auth:        Auth{Methods: []string{"password"}, Password: "secret"},
+		HostKeyMode: HostKeyInsecure,
+		DownloadDir: t.TempDir(),
+	}
+
+	var buf bytes.Buffer
+	if err := DryRun(&buf, opts); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.conns.Load(); n != 0 {
+		t.Errorf("dry run connected %d times, want none", n)
+	}
+	for _, want := range []string{
+		"1. echo: echo hello",
+		"Machines (2):",
+		"u1@" + s.host + ":" + s.port + "\n",
+		"u2@" + s.host + ":" + s.port + " via ops@" + s.host + ":" + s.port,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("dry run output missing %q:\n%s", want, buf.String())
+		}
+	}
+
+	// the same options do connect when run, u2 through the bastion as well
+	if _, err := Run(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.conns.Load(); n != 3 {
+		t.Errorf("run connected %d times, want 3", n)
+	}
+}
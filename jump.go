@@ -0,0 +1,208 @@
+package boomerang
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// jumpHost is a bastion that connections to a machine are tunneled through.
+type jumpHost struct {
+	user string // empty means the machine's username
+	addr string // host:port
+}
+
+// parseJumpHost parses a jump host of the form [user@]host[:port]. The port defaults to 22.
+func parseJumpHost(s string) (*jumpHost, error) {
+	j := &jumpHost{}
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		j.user, s = s[:i], s[i+1:]
+	}
+
+	host, port := s, "22"
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		host, port = h, p
+	}
+	if host == "" {
+		return nil, errors.Errorf("jump host [%v] is missing a host", s)
+	}
+	if i, err := strconv.Atoi(port); err != nil || i < 1 || i > 65535 {
+		return nil, errors.Errorf("jump host [%v] has an invalid port: [%v]", s, port)
+	}
+
+	j.addr = net.JoinHostPort(host, port)
+	return j, nil
+}
+
+// dialSSH connects to the machine, through its jump host if one is set. Errors distinguish between
+// a failure connecting to the bastion and a failure connecting to the machine through it.
+//
+// A successful connection's timing is recorded in m.timing. Through a jump host, connecting to
+// the bastion, and the tunnel through it, count as the dial.
+func (m *Machine) dialSSH(ctx context.Context, conf *ssh.ClientConfig) (*ssh.Client, error) {
+	if m.jump == nil {
+		return dialContext(ctx, m.dialer(conf.Timeout), m.address(), conf, m.timing)
+	}
+
+	start := time.Now()
+	bastion, err := dialContext(ctx, m.dialer(m.jumpConf.Timeout), m.jump.addr, m.jumpConf, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "bastion connect failed [%v]", m.jump.addr)
+	}
+
+	// The tunnel doesn't support deadlines, so it's closed instead once conf.Timeout passes or ctx
+	// is cancelled, as a target accepting the connection but stalling the handshake would
+	// otherwise hang. The timeout covers both dialing and the handshake through the bastion.
+	tctx := ctx
+	if conf.Timeout > 0 {
+		var cancel context.CancelFunc
+		tctx, cancel = context.WithTimeout(ctx, conf.Timeout)
+		defer cancel()
+	}
+	// tunnelErr replaces err if the tunnel was closed by tctx, the cause of the failure
+	tunnelErr := func(err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if tctx.Err() != nil {
+			return errors.Errorf("timed out after %v", conf.Timeout)
+		}
+		return err
+	}
+
+	conn, err := bastion.DialContext(tctx, "tcp", m.address())
+	if err != nil {
+		bastion.Close()
+		return nil, errors.Wrapf(tunnelErr(err), "target connect failed through bastion [%v]", m.jump.addr)
+	}
+	dialed := time.Now()
+
+	stop := context.AfterFunc(tctx, func() { conn.Close() })
+	c, chans, reqs, err := ssh.NewClientConn(conn, m.address(), conf)
+	// the tunnel may have been closed just as the handshake completed
+	if !stop() && err == nil {
+		c.Close()
+		err = tctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		bastion.Close()
+		return nil, errors.Wrapf(tunnelErr(err), "target connect failed through bastion [%v]", m.jump.addr)
+	}
+	m.timing.record(dialed.Sub(start), time.Since(dialed))
+
+	client := ssh.NewClient(c, chans, reqs)
+
+	// the bastion connection lives as long as the tunneled client
+	go func() {
+		client.Wait()
+		bastion.Close()
+	}()
+
+	return client, nil
+}
+
+// dialContext is ssh.Dial over a TCP connection from d, aborting the dial or handshake if ctx is
+// cancelled. The time spent dialing, including resolving addr, and in the handshake, including
+// auth, is recorded in t if non-nil.
+func dialContext(ctx context.Context, d *net.Dialer, addr string, conf *ssh.ClientConfig, t *connTiming) (*ssh.Client, error) {
+	start := time.Now()
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	dialed := time.Now()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, conf)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	t.record(dialed.Sub(start), time.Since(dialed))
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// connTiming records the time a machine's successful connection attempt spent dialing and in
+// the SSH handshake. Attempts may outlive Dial, see connect, so it's safe for concurrent use.
+type connTiming struct {
+	mu              sync.Mutex
+	dial, handshake time.Duration
+}
+
+// record sets the timing, a nil connTiming records nothing.
+func (c *connTiming) record(dial, handshake time.Duration) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.dial, c.handshake = dial, handshake
+	c.mu.Unlock()
+}
+
+func (c *connTiming) get() (dial, handshake time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dial, c.handshake
+}
+
+// setJumpHost configures the machine's jump host, the machine's jump_host taking precedence
+// over the global JumpHost. The bastion uses JumpAuth if set, otherwise the machine's auth.
+func (m *Machine) setJumpHost(st *runState, conf *ssh.ClientConfig) error {
+	spec := st.JumpHost
+	if m.JumpHost != "" {
+		spec = m.JumpHost
+	}
+	if spec == "" {
+		return nil
+	}
+
+	j, err := parseJumpHost(spec)
+	if err != nil {
+		return err
+	}
+	if j.user == "" {
+		j.user = m.Username
+	}
+
+	host, port, _ := net.SplitHostPort(j.addr)
+	hostChecking, algos, err := st.hostKeyCallback(host, port)
+	if err != nil {
+		return err
+	}
+
+	auth := conf.Auth
+	if st.jumpAuth != nil {
+		auth = st.jumpAuth
+	}
+
+	if len(st.HostKeyAlgorithms) > 0 {
+		algos = st.HostKeyAlgorithms
+	}
+
+	m.jump = j
+	m.jumpConf = &ssh.ClientConfig{
+		Config:            conf.Config,
+		User:              j.user,
+		Auth:              auth,
+		HostKeyCallback:   hostChecking,
+		HostKeyAlgorithms: algos,
+		Timeout:           conf.Timeout,
+	}
+	return nil
+}
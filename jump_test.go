@@ -0,0 +1,98 @@
+package boomerang
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stalledPort returns the host and port of an address on 127.0.0.2 accepting connections but
+// never sending anything, e.g. a machine hung mid-boot.
+func stalledPort(t *testing.T) (string, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("could not listen on 127.0.0.2: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { c.Close() })
+		}
+	}()
+	h, p, _ := net.SplitHostPort(l.Addr().String())
+	return h, p
+}
+
+func TestRunJumpHost(t *testing.T) {
+	target := startFakeSSH(t, &fakeSSH{})
+	_, closed := closedPort(t)
+	_, stalled := stalledPort(t)
+
+	tests := []struct {
+		name        string
+		bastion     bool // a bastion is listening, otherwise its port is closed
+		port        string
+		connTimeout time.Duration
+		cancelAfter time.Duration // cancel the run, 0 if not
+		wantErr     string        // in the connection error, empty if connected
+	}{
+		{"through bastion", true, target.port, 0, 0, ""},
+		{"bastion down", false, target.port, time.Second, 0, "bastion connect failed"},
+		{"target down", true, closed, time.Second, 0, "target connect failed through bastion"},
+		{"target stalls handshake", true, stalled, 500 * time.Millisecond, 0, "target connect failed through bastion [%s]: timed out after 500ms"},
+		{"target stalls handshake, cancelled", true, stalled, 0, 300 * time.Millisecond, "target connect failed through bastion [%s]: context canceled"},
+	}
+	for _, tt := range tests {
+		bastion := &fakeSSH{host: "127.0.0.2", port: closed}
+		if tt.bastion {
+			bastion = startFakeSSH(t, &fakeSSH{})
+		}
+		addr := net.JoinHostPort(bastion.host, bastion.port)
+		wantErr := strings.Replace(tt.wantErr, "%s", addr, 1)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if tt.cancelAfter > 0 {
+			time.AfterFunc(tt.cancelAfter, cancel)
+		}
+		start := time.Now()
+		b, err := Run(ctx, Options{
+			Inventory:   Inventory{{HostName: target.host, Port: tt.port, Username: "u"}},
+			Commands:    []Command{{Name: "echo", Command: "echo hello"}},
+			JumpHost:    "jump@" + addr,
+			ConnTimeout: tt.connTimeout,
+			Auth:        Auth{Methods: []string{"password"}, Password: "secret"},
+			HostKeyMode: HostKeyInsecure,
+			DownloadDir: t.TempDir(),
+		})
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("%s: took %v, want it bounded by the timeout or cancellation", tt.name, elapsed)
+		}
+
+		m := b.MachineData[0]
+		if tt.wantErr == "" {
+			if !m.Connection || len(m.StreamData) != 1 || m.StreamData[0].Stdout != "hello\n" {
+				t.Errorf("%s: connection %v streams %+v, want it connected: %v", tt.name, m.Connection, m.StreamData, m.ConnectionErrors)
+			}
+			bastion.mu.Lock()
+			if want := []string{net.JoinHostPort(target.host, target.port)}; len(bastion.forwarded) != 1 || bastion.forwarded[0] != want[0] {
+				t.Errorf("%s: bastion forwarded %v, want %v", tt.name, bastion.forwarded, want)
+			}
+			bastion.mu.Unlock()
+			continue
+		}
+		if m.Connection || len(m.ConnectionErrors) != 1 || !strings.Contains(m.ConnectionErrors[0], wantErr) {
+			t.Errorf("%s: connection %v errors %q, want %q", tt.name, m.Connection, m.ConnectionErrors, wantErr)
+		}
+	}
+}
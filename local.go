@@ -0,0 +1,189 @@
+package boomerang
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// executeLocal runs c, a local command, on this machine rather than on info, recording the
+// result in sd. The command is always rendered as a template against info, e.g.
+// nslookup {{ .HostName }}.
+//
+// The command is split into arguments like a shell would, honouring quotes, and each argument
+// rendered on its own, so a value such as a hostname can't add arguments or run other commands.
+// Pipes, redirects and other shell syntax aren't interpreted. With localShell the rendered
+// command is instead run with sh -c, values inserted as-is.
+func executeLocal(ctx context.Context, info SSHInfo, c Command, results map[string]Stream, st *runState, sd *Stream) {
+	args, err := localArgs(c, commandData{SSHInfo: info, Results: results}, st.TemplateStrict)
+	if err != nil {
+		sd.StreamErrors = append(sd.StreamErrors, fmt.Sprintf("Failed to render command: %v", err))
+		sd.ExitCode = -1
+		return
+	}
+
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = st.CommandTimeout
+	}
+	runCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(runCtx, args[0], args[1:]...)
+	cmd.Dir = c.Dir
+	if len(c.Env) > 0 {
+		cmd.Env = os.Environ()
+		for _, k := range sortedKeys(c.Env) {
+			cmd.Env = append(cmd.Env, k+"="+c.Env[k])
+		}
+	}
+	// a child left holding stdout, e.g. a backgrounded process, doesn't hold up the command
+	cmd.WaitDelay = 5 * time.Second
+
+	var stout, sterr bytes.Buffer
+	outCap := &capWriter{w: &stout, max: st.MaxOutputBytes}
+	errCap := &capWriter{w: &sterr, max: st.MaxOutputBytes}
+	// the same writer for both is written to from a single pipe, in order
+	combine := c.combines(st)
+	if combine {
+		errCap = outCap
+	}
+	cmd.Stdout, cmd.Stderr = outCap, errCap
+
+	start := time.Now()
+	err = cmd.Run()
+	sd.timed(start)
+
+	if err != nil {
+		switch e := err.(type) {
+		case *exec.ExitError:
+			switch {
+			case ctx.Err() != nil:
+				sd.StreamErrors = append(sd.StreamErrors, (&cancelError{reason: cancelledMsg(ctx, "while running")}).Error())
+				sd.ExitCode = -1
+				sd.Interrupted = interruptedCancelled
+			case runCtx.Err() != nil:
+				sd.StreamErrors = append(sd.StreamErrors, (&timeoutError{timeout: timeout}).Error())
+				sd.ExitCode = -1
+				sd.Interrupted = interruptedTimeout
+			default:
+				sd.StreamErrors = append(sd.StreamErrors, fmt.Sprintf("Command completed unsuccessfully: [%T]: %v", e, e))
+				// -1 when killed by a signal
+				sd.ExitCode = e.ExitCode()
+			}
+		default:
+			sd.StreamErrors = append(sd.StreamErrors, fmt.Sprintf("Failed local Run: [%T]: %v", errors.Cause(err), err))
+			sd.ExitCode = -1
+		}
+	}
+
+	sd.truncated(outCap, errCap, combine, st.MaxOutputBytes)
+	sd.setOutput(c, stout.String(), sterr.String(), st)
+}
+
+// localArgs returns the arguments of c, a local command, rendered against data.
+func localArgs(c Command, data commandData, strict bool) ([]string, error) {
+	if c.LocalShell {
+		cmd, err := renderCommand(c.Command, data, strict)
+		if err != nil {
+			return nil, err
+		}
+		return []string{"sh", "-c", cmd}, nil
+	}
+
+	args, err := splitArgs(c.Command)
+	if err != nil {
+		return nil, err
+	}
+	for i, a := range args {
+		if args[i], err = renderCommand(a, data, strict); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+// splitArgs splits s into arguments at unquoted whitespace, as a shell would. Single quotes keep
+// everything literally, double quotes allow \" and \\, and outside quotes a backslash escapes the
+// next character. Template actions, {{ ... }}, are kept whole so spaces in them don't split.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var b strings.Builder
+	var inArg bool
+
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case strings.HasPrefix(s[i:], "{{"):
+			end := strings.Index(s[i:], "}}")
+			if end < 0 {
+				return nil, errors.Errorf("unclosed {{ in [%v]", s)
+			}
+			b.WriteString(s[i : i+end+2])
+			i += end + 1
+			inArg = true
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			if inArg {
+				args = append(args, b.String())
+				b.Reset()
+				inArg = false
+			}
+		case ch == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.Errorf("unclosed ' in [%v]", s)
+			}
+			b.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			inArg = true
+		case ch == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, errors.Errorf("unclosed \" in [%v]", s)
+			}
+			inArg = true
+		case ch == '\\' && i+1 < len(s):
+			i++
+			b.WriteByte(s[i])
+			inArg = true
+		default:
+			b.WriteByte(ch)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, b.String())
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return args, nil
+}
+
+// localCommands returns the local commands in cs, run for a machine that couldn't be connected
+// to, e.g. a DNS lookup or ping to help tell why.
+func localCommands(cs []Command) []Command {
+	var out []Command
+	for _, c := range cs {
+		if c.Local {
+			out = append(out, c)
+		}
+	}
+	return out
+}
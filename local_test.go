@@ -0,0 +1,70 @@
+package boomerang
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{"ping -c 1 host", []string{"ping", "-c", "1", "host"}, false},
+		{"  dig\t+short \n host ", []string{"dig", "+short", "host"}, false},
+		{`echo 'a "b" \c'`, []string{"echo", `a "b" \c`}, false},
+		{`echo "a \"b\" \\ \c"`, []string{"echo", `a "b" \ \c`}, false},
+		{`echo a\ b`, []string{"echo", "a b"}, false},
+		{`echo x'y'"z"`, []string{"echo", "xyz"}, false},
+		{`echo '' ""`, []string{"echo", "", ""}, false},
+		{`ping {{ .HostName }}`, []string{"ping", "{{ .HostName }}"}, false},
+		{`ping -W{{ index .Extras "wait" }}s`, []string{"ping", `-W{{ index .Extras "wait" }}s`}, false},
+		{`echo 'a`, nil, true},
+		{`echo "a`, nil, true},
+		{`echo {{ .HostName`, nil, true},
+		{"   ", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := splitArgs(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error %v, want error: %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLocalArgs(t *testing.T) {
+	data := commandData{
+		SSHInfo: SSHInfo{HostName: "web 1", Extras: map[string]interface{}{"region": "eu"}},
+		Results: map[string]Stream{"ver": {Stdout: "1.2"}},
+	}
+
+	tests := []struct {
+		c       Command
+		strict  bool
+		want    []string
+		wantErr bool
+	}{
+		{Command{Command: "ping -c 1 {{ .HostName }}"}, false, []string{"ping", "-c", "1", "web 1"}, false},
+		{Command{Command: "echo {{ .Extras.region }}-{{ .Results.ver.Stdout }}"}, false, []string{"echo", "eu-1.2"}, false},
+		{Command{Command: "echo {{ .HostName }} | wc -c", LocalShell: true}, false, []string{"sh", "-c", "echo web 1 | wc -c"}, false},
+		{Command{Command: "echo {{ .Extras.zone }}"}, false, []string{"echo", "<no value>"}, false},
+		{Command{Command: "echo {{ .Extras.zone }}"}, true, nil, true},
+		{Command{Command: "echo {{ .Extras.zone }}", LocalShell: true}, true, nil, true},
+		{Command{Command: "echo 'a"}, false, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := localArgs(tt.c, data, tt.strict)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q strict=%v: error %v, want error: %v", tt.c.Command, tt.strict, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q strict=%v: got %q, want %q", tt.c.Command, tt.strict, got, tt.want)
+		}
+	}
+}
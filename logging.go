@@ -0,0 +1,17 @@
+package boomerang
+
+import (
+	"io"
+	"log/slog"
+)
+
+// discardLogger is used when Options has no Logger.
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError + 1}))
+
+// log returns the progress logger, discarding everything if none was set.
+func (s *runState) log() *slog.Logger {
+	if s.Logger == nil {
+		return discardLogger
+	}
+	return s.Logger
+}
@@ -0,0 +1,1930 @@
+package boomerang
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+)
+
+// SSHInfo stores machine-specific information required for establishing an SSH connection.
+// Username & hostname are mandatory. If left unspecified, port will default to 22.
+// Extras are optional and will be written out as-is.
+type SSHInfo struct {
+	HostName string                 `json:"hostname"`
+	Username string                 `json:"username"`
+	Port     string                 `json:"ssh_port"`
+	JumpHost string                 `json:"jump_host,omitempty"`
+	Extras   map[string]interface{} `json:"extras"`
+
+	// Commands, if not nil, are the machine's own commands, replacing Options.Commands or, with
+	// AppendCommands, run after them. cmd/boomerang reads them from extras commands.
+	Commands       []Command `json:"-"`
+	AppendCommands bool      `json:"-"`
+
+	// DownloadDir, if set, is where the machine's downloads are written, set by Run to
+	// <Options.DownloadDir>/<hostname> if empty.
+	DownloadDir string `json:"-"`
+
+	// Optional auth override, see runState.machineAuth. Password is moved out of SSHInfo by
+	// NewMachine, so it's never written out.
+	Auth        string `json:"auth,omitempty"`
+	KeyLocation string `json:"key_location,omitempty"`
+	Password    string `json:"password,omitempty"`
+
+	// CertLocation is the OpenSSH certificate for KeyLocation when auth=cert, defaulting to
+	// <key_location>-cert.pub.
+	CertLocation string `json:"cert_location,omitempty"`
+
+	// HostKeyFingerprint, if set, is the SHA256 fingerprint the machine's host key must have,
+	// e.g. SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8, checked instead of known_hosts.
+	HostKeyFingerprint string `json:"host_key_fingerprint,omitempty"`
+}
+
+// The Machine struct contains all information related to a specific machine.
+//
+// This includes the initial machine ssh information required for establsihing a connection and
+// all subsequent data related to command(s) execution.
+type Machine struct {
+	Connection         bool     `json:"connection"`
+	RunLength          float64  `json:"run_length"`
+	SSHWait            float64  `json:"ssh_wait"`
+	DialDuration       float64  `json:"dial_duration"`      // seconds the connection took to dial, through any jump host
+	HandshakeDuration  float64  `json:"handshake_duration"` // seconds in the SSH handshake, including auth
+	CommandsDuration   float64  `json:"commands_duration"`  // seconds running uploads and commands once connected
+	KeyFile            string   `json:"key_file"`
+	AuthMethod         string   `json:"auth_method,omitempty"`    // the auth method that succeeded
+	ServerVersion      string   `json:"server_version,omitempty"` // e.g. SSH-2.0-OpenSSH_8.9
+	Banner             string   `json:"banner,omitempty"`         // sent by the server before auth, e.g. a legal notice
+	ConnectionAttempts int      `json:"connection_attempts"`
+	ConnectionErrors   []string `json:"connection_errors"`
+	StreamData         []Stream `json:"stream_data"`
+	SSHInfo
+
+	jump     *jumpHost
+	jumpConf *ssh.ClientConfig
+	password string // SSHInfo.Password
+	order    int    // position in the inventory, see sortMachines
+	timing   *connTiming
+	bindAddr *net.TCPAddr // local address to connect from, see dialer
+}
+
+// Stream captures data from each ssh session run
+type Stream struct {
+	Name         string     `json:"name"`
+	Stdout       string     `json:"stdout"`
+	Stderr       string     `json:"stderr"`
+	Combined     string     `json:"combined,omitempty"` // stdout and stderr as received, with combineOutput
+	ExitCode     int        `json:"exit_code"`
+	Succeeded    bool       `json:"succeeded"`
+	StreamErrors []string   `json:"stream_errors"`
+	Finalizer    bool       `json:"finalizer"`
+	Resources    *Resources `json:"resources"`
+	Transfer     *Transfer  `json:"transfer,omitempty"`
+	Attempts     []Attempt  `json:"attempts,omitempty"`    // every run of a retried command, the last is the result
+	Interrupted  string     `json:"interrupted,omitempty"` // why the command didn't run to completion, its output is what was received until then
+	Signal       *Signal    `json:"signal,omitempty"`      // the signal that killed the remote command
+	StartTime    string     `json:"start_time"`            // empty if the command didn't run
+	EndTime      string     `json:"end_time"`
+	Duration     float64    `json:"duration"` // seconds
+}
+
+// Signal records the signal a remote command was killed by, as reported by the server.
+type Signal struct {
+	Name    string `json:"name"` // without the SIG prefix, e.g. KILL
+	Message string `json:"message,omitempty"`
+	Lang    string `json:"lang,omitempty"` // language tag of message
+}
+
+// NewMachine returns a pointer to an initialized Machine struct for s, e.g. to Dial.
+func NewMachine(s SSHInfo) *Machine {
+	m := Machine{
+		ConnectionErrors: make([]string, 0),
+		StreamData:       make([]Stream, 0),
+		SSHInfo:          s,
+	}
+	if m.Extras == nil {
+		m.Extras = make(map[string]interface{}, 0)
+	}
+	// the password is kept unexported so it's never written out
+	m.password, m.Password = m.Password, ""
+	return &m
+}
+
+// Order returns the machine's position in the inventory, the order it was dispatched in.
+func (m *Machine) Order() int { return m.order }
+
+// Failed reports whether the machine failed to connect or any of its commands did not succeed.
+func (m *Machine) Failed() bool {
+	if !m.Connection {
+		return true
+	}
+	for _, s := range m.StreamData {
+		if !s.Succeeded {
+			return true
+		}
+	}
+	return false
+}
+
+// Inventory is the set of machines a run connects to. It's a plain slice, so converts to and from
+// []SSHInfo, with methods for the operations run on it before connecting. Methods returning an
+// Inventory don't modify the receiver, though the result may share its backing array.
+type Inventory []SSHInfo
+
+// Len returns the number of machines in inv.
+func (inv Inventory) Len() int { return len(inv) }
+
+// Add appends s to inv.
+func (inv *Inventory) Add(s SSHInfo) { *inv = append(*inv, s) }
+
+// Filter returns the machines in inv for which pred returns true, in inventory order.
+func (inv Inventory) Filter(pred func(SSHInfo) bool) Inventory {
+	var out Inventory
+	for _, s := range inv {
+		if pred(s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Limit returns the machines in inv matching selector, see parseLimit. An empty selector
+// matches every machine.
+func (inv Inventory) Limit(selector string) (Inventory, error) {
+	terms, err := parseLimit(selector)
+	if err != nil {
+		return nil, err
+	}
+	return inv.limit(terms), nil
+}
+
+// limitTerm is one term of a limit selector. A term with a key matches the machine's Extras
+// field of that name, otherwise it matches the hostname. The value is a glob, e.g. web-*.
+type limitTerm struct {
+	key, value string
+}
+
+// parseLimit parses a limit selector, comma-separated terms all of which a machine must match,
+// e.g. role=db,env=prod or web-*.
+func parseLimit(s string) ([]limitTerm, error) {
+	var terms []limitTerm
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		var lt limitTerm
+		if i := strings.Index(t, "="); i >= 0 {
+			lt.key, lt.value = strings.TrimSpace(t[:i]), strings.TrimSpace(t[i+1:])
+			if lt.key == "" {
+				return nil, errors.Errorf("limit term [%v] is missing a key", t)
+			}
+		} else {
+			lt.value = t
+		}
+		if _, err := path.Match(lt.value, ""); err != nil {
+			return nil, errors.Wrapf(err, "limit term [%v]", t)
+		}
+		terms = append(terms, lt)
+	}
+	return terms, nil
+}
+
+// matches reports whether s matches the term. Extras keys are compared case-insensitively, as
+// an inventory inline in the config file has its keys lowercased.
+func (t limitTerm) matches(s SSHInfo) bool {
+	if t.key == "" {
+		ok, _ := path.Match(t.value, s.HostName)
+		return ok
+	}
+	if v, ok := s.extra(t.key); ok {
+		ok, _ := path.Match(t.value, fmt.Sprint(v))
+		return ok
+	}
+	return false
+}
+
+// extra returns the value of s's extras field key, compared case-insensitively as an inventory
+// inline in the config file has its keys lowercased. An exact match is preferred.
+func (s SSHInfo) extra(key string) (interface{}, bool) {
+	if v, ok := s.Extras[key]; ok {
+		return v, true
+	}
+	for k, v := range s.Extras {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// limit returns the machines in inv matching all terms, in inventory order.
+func (inv Inventory) limit(terms []limitTerm) Inventory {
+	if len(terms) == 0 {
+		return inv
+	}
+	return inv.Filter(func(s SSHInfo) bool {
+		for _, t := range terms {
+			if !t.matches(s) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Dedupe removes machines listed more than once in inv, e.g. after merging sources, so each is
+// only connected to once. Machines are the same if their hostname, port and username are.
+// Identical duplicates are dropped. Duplicates that differ otherwise, e.g. in auth or extras, are
+// an error with mode=strict, and with mode=first a warning is logged and the first is kept.
+// mode=off keeps all machines.
+func (inv Inventory) Dedupe(mode string) (Inventory, error) {
+	if mode == "off" {
+		return inv, nil
+	}
+
+	// machines without a port connect to 22
+	key := func(s SSHInfo) SSHInfo {
+		if s.Port == "" {
+			s.Port = "22"
+		}
+		s.HostName = strings.ToLower(s.HostName)
+		return s
+	}
+
+	seen := make(map[string]SSHInfo)
+	out := make(Inventory, 0, len(inv))
+	for _, s := range inv {
+		k := key(s)
+		id := k.Username + "@" + net.JoinHostPort(k.HostName, k.Port)
+		first, ok := seen[id]
+		if !ok {
+			seen[id] = k
+			out = append(out, s)
+			continue
+		}
+		if reflect.DeepEqual(first, k) {
+			continue
+		}
+		if mode == "strict" {
+			return nil, errors.Errorf("[%v] is listed more than once with conflicting fields", id)
+		}
+		log.Printf("Warning: [%v] is listed more than once with conflicting fields, keeping the first\n", id)
+	}
+	return out, nil
+}
+
+// Output orders, set with outputOrder.
+const (
+	OutputOrderHostname   = "hostname"   // by hostname, then port and username
+	OutputOrderInventory  = "inventory"  // the order machines were dispatched in
+	OutputOrderCompletion = "completion" // the order machines completed in
+)
+
+// sortMachines sorts machines, the results of a run, by order. Machines complete in a different
+// order every run, so sorting them keeps output stable to diff between runs.
+func sortMachines(machines []Machine, order string) {
+	switch order {
+	case OutputOrderHostname:
+		sort.SliceStable(machines, func(i, j int) bool {
+			a, b := machines[i], machines[j]
+			if a.HostName != b.HostName {
+				return a.HostName < b.HostName
+			}
+			if a.Port != b.Port {
+				// ports are normalized, so numeric unless invalid
+				pa, errA := strconv.Atoi(a.Port)
+				pb, errB := strconv.Atoi(b.Port)
+				if errA == nil && errB == nil {
+					return pa < pb
+				}
+				return a.Port < b.Port
+			}
+			if a.Username != b.Username {
+				return a.Username < b.Username
+			}
+			return a.order < b.order
+		})
+	case OutputOrderInventory:
+		sort.SliceStable(machines, func(i, j int) bool {
+			return machines[i].order < machines[j].order
+		})
+	}
+}
+
+// Order reorders inv in place to control the order machines are dispatched in.
+//
+// order=inventory keeps the inventory as-is, order=random shuffles it to avoid always hitting
+// the same hosts first, and order=sorted sorts by key, an Extras field, or hostname if key is empty.
+func (inv Inventory) Order(order, key string) {
+	inventory := inv
+	switch order {
+	case "random":
+		rand.Shuffle(len(inventory), func(i, j int) {
+			inventory[i], inventory[j] = inventory[j], inventory[i]
+		})
+	case "sorted":
+		// machines without the key sort last, in inventory order
+		sortValue := func(s SSHInfo) (string, bool) {
+			if key == "" || key == "hostname" {
+				return s.HostName, true
+			}
+			v, ok := s.extra(key)
+			return fmt.Sprint(v), ok
+		}
+		sort.SliceStable(inventory, func(i, j int) bool {
+			a, aok := sortValue(inventory[i])
+			b, bok := sortValue(inventory[j])
+			if aok != bok {
+				return aok
+			}
+			return a < b
+		})
+	}
+}
+
+func fileExists(f string) bool {
+	_, err := os.Stat(f)
+	return !os.IsNotExist(err)
+}
+
+// connect is a wrapper around ssh.Dial using TCP.
+//
+// Although ssh.ClientConfig supports a zero timeout, i.e., no timeout, it's recommended to include
+// a timeout to prevent Boomerang from hanging indefintely. A successful client connection may still get
+// hung up by a downstream processes such as authentication, leaving Boomerang hanging.
+//
+// Retry specifies the number of times to retry the conection and wait specifies how long to wait
+// before trying again, either fixed or backing off exponentially. On each subsequent retry, up until
+// the last, Boomerang will wait at most (ssh.ClientConfig.Timeout + wait)s.
+//
+// The deadline is the total number of seconds Boomerang will spend trying to connect.
+//
+// If until is non-zero it overrides retry: connect retries, waiting wait seconds between
+// attempts, until then.
+//
+// Connecting, including waiting between retries, stops once ctx is cancelled.
+func (m *Machine) connect(ctx context.Context, conf *ssh.ClientConfig, retry int64, wait Backoff, until time.Time) (*ssh.Client, error) {
+
+	if !until.IsZero() {
+		return m.connectUntil(ctx, conf, wait, until)
+	}
+
+	if conf.Timeout == 0 {
+		m.ConnectionAttempts = 1
+		client, err := m.dialSSH(ctx, conf)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not establish machine connection")
+		}
+		return client, nil
+	}
+
+	deadline := conf.Timeout + wait.total(retry) + (time.Duration(retry) * conf.Timeout)
+
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, deadline+(1*time.Second))
+	defer cancel()
+
+	ch := make(chan *ssh.Client, 1)
+	ec := make(chan error, 1)
+
+	// attempts is shared with the dialing goroutine, which may outlive a ctx timeout.
+	var attempts int64
+	defer func() { m.ConnectionAttempts = int(atomic.LoadInt64(&attempts)) }()
+
+	go func(r int64) {
+		for n := 0; ; n++ {
+			atomic.AddInt64(&attempts, 1)
+			client, err := m.dialSSH(ctx, conf)
+			if err != nil && r > 0 {
+				if !sleepContext(ctx, wait.Delay(n)) {
+					return
+				}
+				r--
+				continue
+			}
+			if err != nil {
+				ec <- err
+				return
+			}
+
+			ch <- client
+			return
+		}
+	}(retry)
+
+	select {
+	case c := <-ch:
+		return c, nil
+	case e := <-ec:
+		return nil, e
+	case <-ctx.Done():
+		if parent.Err() != nil {
+			return nil, errors.Wrap(parent.Err(), cancelledMsg(parent, ""))
+		}
+		return nil, errors.Errorf("Retried %v time(s) with a %v. No more retries!", retry, wait)
+	}
+}
+
+// connectUntil retries ssh.Dial until it succeeds or deadline is reached.
+func (m *Machine) connectUntil(ctx context.Context, conf *ssh.ClientConfig, wait Backoff, deadline time.Time) (*ssh.Client, error) {
+	for n := 0; ; n++ {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, errors.Errorf("%s: %v after %d attempt(s)", deadlineReached, deadline.Format(time.RFC3339), m.ConnectionAttempts)
+		}
+
+		// never let a single attempt run past the deadline
+		c := *conf
+		if c.Timeout == 0 || c.Timeout > remaining {
+			c.Timeout = remaining
+		}
+
+		m.ConnectionAttempts++
+		client, err := m.dialSSH(ctx, &c)
+		if err == nil {
+			return client, nil
+		}
+		if ctx.Err() != nil {
+			return nil, errors.Wrap(ctx.Err(), cancelledMsg(ctx, ""))
+		}
+
+		d := wait.Delay(n)
+		if time.Now().Add(d).After(deadline) {
+			return nil, errors.Wrapf(err, "%s: %v after %d attempt(s)", deadlineReached, deadline.Format(time.RFC3339), m.ConnectionAttempts)
+		}
+		if !sleepContext(ctx, d) {
+			return nil, errors.Wrap(ctx.Err(), cancelledMsg(ctx, ""))
+		}
+	}
+}
+
+// cancelled prefixes errors caused by the run being cancelled, e.g. by SIGINT.
+const cancelled = "cancelled"
+
+// errGlobalTimeout is the cause of the run being cancelled once globalTimeout passes.
+var errGlobalTimeout = errors.New("global timeout")
+
+// cancelledMsg describes ctx being cancelled, when, e.g. before run, for errors recorded on
+// machines and commands. A run cut short by globalTimeout or failFastThreshold is aborted rather
+// than cancelled, e.g. "aborted before run: global timeout".
+func cancelledMsg(ctx context.Context, when string) string {
+	cause := context.Cause(ctx)
+	aborted := isAbort(cause)
+	msg := cancelled
+	if aborted {
+		msg = "aborted"
+	}
+	if when != "" {
+		msg += " " + when
+	}
+	if aborted {
+		msg += ": " + cause.Error()
+	}
+	return msg
+}
+
+// isAbort reports whether cause, the cause of the run being cancelled, is boomerang cutting the
+// run short rather than it being interrupted.
+func isAbort(cause error) bool {
+	_, failFast := cause.(*failFastError)
+	return cause == errGlobalTimeout || failFast
+}
+
+// sleepContext sleeps for d, returning false early if ctx is cancelled.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// deadlineReached prefixes errors caused by the deadline option, so they can be told apart
+// from other failures.
+const deadlineReached = "deadline reached"
+
+// waitForSSH polls the machine's SSH port until it accepts a TCP connection and presents an
+// SSH banner, or the deadline is reached. It's meant for freshly provisioned machines that are
+// still booting; unlike connect retries it never attempts authentication.
+func (m *Machine) waitForSSH(ctx context.Context, deadline time.Duration) error {
+	end := time.Now().Add(deadline)
+
+	for {
+		conn, err := m.dialer(5*time.Second).DialContext(ctx, "tcp", m.address())
+		if err == nil {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			banner, _ := bufio.NewReader(conn).ReadString('\n')
+			conn.Close()
+			if strings.HasPrefix(banner, "SSH-") {
+				return nil
+			}
+		}
+
+		if time.Now().Add(time.Second).After(end) {
+			return errors.Errorf("ssh not available on [%v] after %v", m.address(), deadline)
+		}
+		if !sleepContext(ctx, time.Second) {
+			return errors.Wrap(ctx.Err(), cancelledMsg(ctx, ""))
+		}
+	}
+}
+
+// preflight checks the machine's port accepts a TCP connection within timeout.
+func (m *Machine) preflight(ctx context.Context, timeout time.Duration) error {
+	conn, err := m.dialer(timeout).DialContext(ctx, "tcp", m.address())
+	if err != nil {
+		if ctx.Err() != nil {
+			return errors.Wrap(ctx.Err(), cancelledMsg(ctx, ""))
+		}
+		return errors.Wrapf(err, "preflight: port closed/unreachable [%v]", m.address())
+	}
+	return conn.Close()
+}
+
+// dialer returns a dialer for TCP connections made directly from this host, to the machine or
+// its jump host, from bindAddress if set.
+func (m *Machine) dialer(timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout}
+	if m.bindAddr != nil {
+		d.LocalAddr = m.bindAddr
+	}
+	return d
+}
+
+// address is the machine's dial address, with IPv6 literals bracketed, e.g. [::1]:22.
+func (m *Machine) address() string { return net.JoinHostPort(m.HostName, m.Port) }
+
+// Dial connects to the machine as configured by opts, recording the key file, time waiting for
+// SSH and connection attempts on m. Errors say which step failed. m is usually from NewMachine.
+//
+// The client returned is owned by the caller, who must Close it once done. It can be used for
+// any number of Exec calls in between, e.g. to poll a machine without reconnecting.
+func (m *Machine) Dial(ctx context.Context, opts Options) (*ssh.Client, error) {
+	st, err := newState(opts)
+	if err != nil {
+		return nil, err
+	}
+	return m.dial(ctx, st)
+}
+
+// dial is Dial with the state of a run.
+func (m *Machine) dial(ctx context.Context, st *runState) (client *ssh.Client, err error) {
+	start := time.Now()
+	l := st.log().With("host", m.HostName)
+	l.Debug("connecting")
+	defer func() {
+		if err != nil {
+			l.Warn("connection failed", "elapsed", time.Since(start).Round(time.Millisecond), "error", err.Error())
+			return
+		}
+		l.Info("connected", "elapsed", time.Since(start).Round(time.Millisecond), "attempts", m.ConnectionAttempts)
+	}()
+
+	if ctx.Err() != nil {
+		return nil, errors.New(cancelledMsg(ctx, "before run"))
+	}
+
+	if m.HostName == "127.0.0.1" || m.HostName == "localhost" {
+		return nil, errors.Errorf("[%v] is not supported. Consider creating a feature proposal", m.HostName)
+	}
+
+	if !st.Deadline.IsZero() && time.Now().After(st.Deadline) {
+		return nil, errors.Errorf("%s before run: %v", deadlineReached, st.Deadline.Format(time.RFC3339))
+	}
+
+	if err := m.setSSHPort(); err != nil {
+		return nil, errors.Wrap(err, "failed port validation")
+	}
+	if st.BindAddress != nil {
+		m.bindAddr = &net.TCPAddr{IP: st.BindAddress}
+	}
+
+	// Every client must provide a host key check. A machine's fingerprint overrides hostKeyMode.
+	var hostChecking ssh.HostKeyCallback
+	var hostKeyAlgos []string
+	if m.HostKeyFingerprint != "" {
+		hostChecking, hostKeyAlgos, err = fingerprintCallback(m.HostKeyFingerprint)
+	} else {
+		hostChecking, hostKeyAlgos, err = st.hostKeyCallback(m.HostName, m.Port)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed host key check")
+	}
+
+	tracker := &authTracker{}
+	auth, keyFile, err := st.machineAuth(m, tracker.tried)
+	m.KeyFile = keyFile
+	if err != nil {
+		return nil, errors.Wrap(err, "failed auth setup")
+	}
+
+	if len(st.HostKeyAlgorithms) > 0 {
+		hostKeyAlgos = st.HostKeyAlgorithms
+	}
+
+	banner := &bannerRecorder{}
+	conf := &ssh.ClientConfig{
+		Config:            st.Algorithms,
+		User:              m.Username,
+		Auth:              auth,
+		HostKeyCallback:   hostChecking,
+		HostKeyAlgorithms: hostKeyAlgos,
+		BannerCallback:    banner.record,
+		Timeout:           st.ConnTimeout,
+	}
+
+	if err := m.setJumpHost(st, conf); err != nil {
+		return nil, errors.Wrap(err, "failed jump host setup")
+	}
+
+	// a quick probe tells machines that are down apart from ssh or auth failures, without the
+	// retries of a full connection. waitForSSH already waits for the port to open.
+	if st.Preflight && m.jump == nil && st.WaitForSSH == 0 {
+		if err := m.preflight(ctx, st.PreflightTimeout); err != nil {
+			return nil, err
+		}
+	}
+
+	// the machine is only reachable through the bastion, so there's nothing to wait on directly
+	if st.WaitForSSH > 0 && m.jump == nil {
+		w := time.Now()
+		err := m.waitForSSH(ctx, st.WaitForSSH)
+		m.SSHWait = time.Since(w).Seconds()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed waiting for ssh")
+		}
+	}
+
+	m.timing = &connTiming{}
+	client, err = m.connect(ctx, conf, int64(st.Retry), st.Backoff, st.Deadline)
+	// the banner is sent before auth, so it's kept even if auth failed
+	m.Banner = banner.get()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed client connection")
+	}
+	dial, handshake := m.timing.get()
+	m.DialDuration, m.HandshakeDuration = dial.Seconds(), handshake.Seconds()
+	m.AuthMethod = tracker.used()
+	m.ServerVersion = string(client.ServerVersion())
+	return client, nil
+}
+
+// bannerRecorder records the banner a server sends before auth, for ssh.ClientConfig's
+// BannerCallback. Each connection attempt replaces it.
+type bannerRecorder struct {
+	mu     sync.Mutex
+	banner string
+}
+
+func (b *bannerRecorder) record(message string) error {
+	b.mu.Lock()
+	b.banner = strings.TrimSpace(message)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *bannerRecorder) get() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.banner
+}
+
+// Exec runs cs on the machine over client, a client from Dial, with the command settings of
+// opts, e.g. CommandTimeout, and returns their results. It does not close client.
+func (m *Machine) Exec(ctx context.Context, client *ssh.Client, cs []Command, opts Options) ([]Stream, error) {
+	st, err := newState(opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range cs {
+		if err := c.Validate(); err != nil {
+			return nil, err
+		}
+		if err := c.checkStderr(st); err != nil {
+			return nil, err
+		}
+	}
+	return executeCommands(ctx, client, m.SSHInfo, cs, st), nil
+}
+
+// Run TODO comment
+func (m *Machine) run(ctx context.Context, st *runState) *Machine {
+	start := time.Now()
+
+	// checked by Run before any machine is, so this only fails for a machine not in the inventory
+	commands, err := st.hostCommands(m.SSHInfo)
+	if err != nil {
+		m.Connection = false
+		m.ConnectionErrors = []string{fmt.Sprint(errors.Wrap(err, "failed command setup"))}
+		m.RunLength = time.Since(start).Seconds()
+		return m
+	}
+
+	client, err := m.dial(ctx, st)
+	if err != nil {
+		m.Connection = false
+		m.ConnectionErrors = []string{fmt.Sprint(err)}
+		// local commands, e.g. a DNS lookup, still run to help tell why
+		if lc := localCommands(commands); len(lc) > 0 && ctx.Err() == nil && !st.GC {
+			m.StreamData = append(m.StreamData, executeCommands(ctx, nil, m.SSHInfo, lc, st)...)
+		}
+		m.RunLength = time.Since(start).Seconds()
+		return m
+	}
+	defer client.Close()
+
+	connected := time.Now()
+	defer func() { m.CommandsDuration = time.Since(connected).Seconds() }()
+
+	// keepalives stop idle-timeout firewalls dropping the connection during long commands. If
+	// one fails, the connection is gone: the run is cancelled and the machine recorded as lost.
+	if st.KeepaliveInterval > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		var lost atomic.Bool
+		go keepalive(ctx, client, st.KeepaliveInterval, func() {
+			lost.Store(true)
+			cancel()
+			client.Close()
+		})
+		defer func() {
+			cancel()
+			if lost.Load() {
+				m.Connection = false
+				m.ConnectionErrors = append(m.ConnectionErrors, "connection lost (keepalive failed)")
+			}
+		}()
+	}
+
+	// garbage collect temp files from prior runs, nothing else is run
+	if st.GC {
+		sftpClient, err := sftp.NewClient(client)
+		if err != nil {
+			m.Connection = false
+			m.RunLength = time.Since(start).Seconds()
+			m.ConnectionErrors = []string{fmt.Sprint(errors.Wrap(err, "failed to establish sftp client"))}
+			return m
+		}
+		m.StreamData = append(m.StreamData, gcTempFiles(sftpClient, st))
+		m.Connection = true
+		m.RunLength = time.Since(start).Seconds()
+		return m
+	}
+
+	// upload files
+	if len(st.uploads) > 0 {
+
+		var sftpClient *sftp.Client
+
+		if sftpClient, err = sftp.NewClient(client); err != nil {
+			m.Connection = false
+			m.ConnectionErrors = []string{fmt.Sprint(errors.Wrap(err, "failed to establish sftp client"))}
+			m.StreamData = append(m.StreamData, executeFinalizers(client, m.SSHInfo, st.finally, st)...)
+			if st.LogToHostSyslog {
+				m.StreamData = append(m.StreamData, executeSyslog(client, m.SSHInfo, m.StreamData[len(m.StreamData)-len(st.finally):], st))
+			}
+			m.RunLength = time.Since(start).Seconds()
+			return m
+		}
+		s := executeUploads(sftpClient, st.uploads, st)
+		m.StreamData = append(m.StreamData, s...)
+	}
+
+	// execute commands
+	ran := len(m.StreamData)
+	if len(commands) > 0 {
+		m.StreamData = append(m.StreamData, executeCommands(ctx, client, m.SSHInfo, commands, st)...)
+	}
+
+	m.StreamData = append(m.StreamData, executeFinalizers(client, m.SSHInfo, st.finally, st)...)
+	if st.LogToHostSyslog {
+		// the commands and finally, not uploads
+		m.StreamData = append(m.StreamData, executeSyslog(client, m.SSHInfo, m.StreamData[ran:], st))
+	}
+
+	m.Connection = true
+	m.RunLength = time.Since(start).Seconds()
+	st.log().Info("finished", "host", m.HostName, "elapsed", time.Since(start).Round(time.Millisecond))
+
+	return m
+}
+
+// keepalive sends an OpenSSH keepalive on client every interval until ctx is done. A keepalive
+// not answered within interval means the connection is dead, lost is called and it returns.
+func keepalive(ctx context.Context, client *ssh.Client, interval time.Duration, lost func()) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		errc := make(chan error, 1)
+		go func() {
+			// servers reply false to requests they don't know, which is still a reply
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			errc <- err
+		}()
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-errc:
+			if err != nil {
+				lost()
+				return
+			}
+		case <-time.After(interval):
+			lost()
+			return
+		}
+	}
+}
+
+func (m *Machine) setSSHPort() error {
+	p, err := normalizePort(m.Port)
+	if err != nil {
+		return err
+	}
+	m.Port = p
+	return nil
+}
+
+// normalizePort returns port as a number: 22 if empty, a service name, e.g. ssh, resolved with
+// net.LookupPort, and a number checked to be in range.
+func normalizePort(port string) (string, error) {
+	if port == "" {
+		return "22", nil
+	}
+
+	i, err := strconv.Atoi(port)
+	if err != nil {
+		if i, err = net.LookupPort("tcp", port); err != nil {
+			return "", errors.Errorf("invalid port: [%v] is not a number or a known service", port)
+		}
+	}
+	if i < 1 || i > 65535 {
+		return "", errors.Errorf("invalid port: [%v]", port)
+	}
+
+	return strconv.Itoa(i), nil
+}
+
+// NormalizePorts normalizes the port of every machine in inv, in place, with normalizePort:
+// 22 if empty and a service name, e.g. ssh, resolved to its number. An invalid port fails the
+// whole inventory, before any machine is connected to. Every invalid port is reported.
+func (inv Inventory) NormalizePorts() error {
+	inventory := inv
+	var invalid []string
+	for i := range inventory {
+		p, err := normalizePort(inventory[i].Port)
+		if err != nil {
+			invalid = append(invalid, fmt.Sprintf("[%v] %v", inventory[i].HostName, err))
+			continue
+		}
+		inventory[i].Port = p
+	}
+	if len(invalid) > 0 {
+		return errors.Errorf("%d machine(s) with an invalid ssh_port:\n\t%s", len(invalid), strings.Join(invalid, "\n\t"))
+	}
+	return nil
+}
+
+// executeCommands runs cs over client, one session per command, and returns their results. Every
+// command appends exactly one stream, so out[i] is the result of cs[i]. With parallelCommands
+// the commands run concurrently, otherwise in order.
+func executeCommands(ctx context.Context, client *ssh.Client, info SSHInfo, cs []Command, st *runState) []Stream {
+
+	// sftp client for upload and download commands, established on first use
+	sftpc := &lazySFTP{client: client}
+	defer sftpc.close()
+
+	if st.ParallelCommands {
+		return executeParallel(ctx, client, sftpc, info, cs, st)
+	}
+
+	var out []Stream
+
+	// results of completed commands, by name, available to later command templates
+	results := make(map[string]Stream)
+
+	// stopped is set once a command fails with stopOnFailure, the rest are skipped
+	var stopped bool
+
+	for i, c := range cs {
+
+		if ctx.Err() != nil {
+			out = append(out, notRun(c, cancelledMsg(ctx, "before run")))
+			continue
+		}
+
+		if i > 0 && !out[i-1].Succeeded && cs[i-1].stops(st) {
+			stopped = true
+		}
+		if stopped {
+			out = append(out, notRun(c, "skipped due to prior failure"))
+			continue
+		}
+
+		sd := executeRetried(ctx, client, sftpc, info, c, results, st)
+		// only commands that ran are timed, and only those are available to templates
+		if sd.StartTime != "" {
+			results[c.Name] = sd
+		}
+		out = append(out, sd)
+	}
+
+	return out
+}
+
+// executeParallel runs cs concurrently over client, at most st.maxSessions at once, unbounded
+// if <= 0. Results are in the order of cs. Commands can't depend on each other, so stopOnFailure
+// and templates referencing .Results are rejected with parallelCommands when the config is read.
+func executeParallel(ctx context.Context, client *ssh.Client, sftpc *lazySFTP, info SSHInfo, cs []Command, st *runState) []Stream {
+	out := make([]Stream, len(cs))
+
+	// sem bounds the number of sessions open at once, a nil channel means unbounded.
+	var sem chan struct{}
+	if st.MaxSessions > 0 {
+		sem = make(chan struct{}, st.MaxSessions)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(cs))
+	for i, c := range cs {
+		go func(i int, c Command) {
+			defer wg.Done()
+
+			if sem != nil {
+				select {
+				case sem <- struct{}{}:
+					defer func() { <-sem }()
+				case <-ctx.Done():
+				}
+			}
+			if ctx.Err() != nil {
+				out[i] = notRun(c, cancelledMsg(ctx, "before run"))
+				return
+			}
+
+			// no results, a template can only use the machine
+			out[i] = executeRetried(ctx, client, sftpc, info, c, nil, st)
+		}(i, c)
+	}
+	wg.Wait()
+
+	return out
+}
+
+// notRun is the result of a command that was not run, for reason.
+func notRun(c Command, reason string) Stream {
+	return Stream{
+		Name:         c.Name,
+		StreamErrors: []string{reason},
+		ExitCode:     -1,
+	}
+}
+
+// Attempt records one run of a command that was retried.
+type Attempt struct {
+	ExitCode  int     `json:"exit_code"`
+	StartTime string  `json:"start_time"`
+	Duration  float64 `json:"duration"` // seconds
+}
+
+// executeRetried runs c with executeCommand, running it again up to c.retries times, c.retryWait
+// apart, while it fails. The last run is returned, with every run recorded in Attempts if c
+// was retried.
+func executeRetried(ctx context.Context, client *ssh.Client, sftpc *lazySFTP, info SSHInfo, c Command, results map[string]Stream, st *runState) Stream {
+	sd := executeCommand(ctx, client, sftpc, info, c, results, st)
+
+	var attempts []Attempt
+	for i := 0; i < c.Retries && c.retryable(sd); i++ {
+		attempts = append(attempts, Attempt{ExitCode: sd.ExitCode, StartTime: sd.StartTime, Duration: sd.Duration})
+		if !sleepContext(ctx, c.RetryWait) {
+			sd.Attempts = attempts
+			return sd
+		}
+		st.log().Info("retrying command", "host", info.HostName, "command", c.Name, "attempt", i+2)
+		sd = executeCommand(ctx, client, sftpc, info, c, results, st)
+	}
+	if len(attempts) > 0 {
+		sd.Attempts = append(attempts, Attempt{ExitCode: sd.ExitCode, StartTime: sd.StartTime, Duration: sd.Duration})
+	}
+	return sd
+}
+
+// executeCommand runs c in a new session on client, a connection to info. results are the
+// commands completed so far, used with info to render c when templateCommands is set. A local
+// command is run on this machine instead, see executeLocal.
+func executeCommand(ctx context.Context, client *ssh.Client, sftpc *lazySFTP, info SSHInfo, c Command, results map[string]Stream, st *runState) Stream {
+	host := info.HostName
+
+	sd := Stream{
+		Name:         c.Name,
+		StreamErrors: make([]string, 0),
+	}
+
+	l := st.log().With("host", host, "command", c.Name)
+	l.Debug("command started")
+	began := time.Now()
+	defer func() {
+		l.Info("command finished", "exit_code", sd.ExitCode, "succeeded", sd.Succeeded, "elapsed", time.Since(began).Round(time.Millisecond))
+	}()
+
+	if c.Local {
+		executeLocal(ctx, info, c, results, st, &sd)
+		return sd
+	}
+
+	if c.Transfer != nil {
+		sfc, err := sftpc.get()
+		if err != nil {
+			sd.StreamErrors = append(sd.StreamErrors, fmt.Sprintf("Failed to establish sftp client: %v", err))
+			sd.ExitCode = -1
+			return sd
+		}
+		start := time.Now()
+		executeTransfer(sfc, info.DownloadDir, c.Transfer, st, &sd)
+		sd.timed(start)
+		sd.Succeeded = sd.ExitCode == 0
+		return sd
+	}
+
+	cmd := c.Command
+	if st.TemplateCommands {
+		var err error
+		if cmd, err = renderCommand(cmd, commandData{SSHInfo: info, Results: results}, st.TemplateStrict); err != nil {
+			sd.StreamErrors = append(sd.StreamErrors, fmt.Sprintf("Failed to render command: %v", err))
+			sd.ExitCode = -1
+			return sd
+		}
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		sd.StreamErrors = append(sd.StreamErrors, fmt.Sprintf("error type=(%T): Failed to create NewSession: %v\n", errors.Cause(err), err))
+		sd.ExitCode = -1
+		return sd
+	}
+	defer session.Close()
+
+	// env is best effort: servers only accept variables allowed by their AcceptEnv
+	for _, k := range sortedKeys(c.Env) {
+		if err := session.Setenv(k, c.Env[k]); err != nil {
+			sd.StreamErrors = append(sd.StreamErrors, fmt.Sprintf("Failed to set env %s, check the server's AcceptEnv: %v", k, err))
+		}
+	}
+
+	if c.Dir != "" {
+		cmd = "cd " + shellQuote(c.Dir) + " && " + cmd
+	}
+	cmd = c.wrapShell(cmd)
+
+	// an abandoned session may still be writing when its output is read
+	var stout, sterr lockedBuffer
+	outCap := &capWriter{w: &stout, max: st.MaxOutputBytes}
+	errCap := &capWriter{w: &sterr, max: st.MaxOutputBytes}
+	// with combineOutput, stderr is written to stout too, in the order it's received
+	combine := c.combines(st)
+	if combine {
+		errCap = outCap
+	}
+	session.Stdout = outCap
+	session.Stderr = errCap
+	if st.MaxLineLength > 0 {
+		session.Stdout = &lineLimitWriter{w: outCap, max: st.MaxLineLength}
+		session.Stderr = &lineLimitWriter{w: errCap, max: st.MaxLineLength}
+	}
+	if combine {
+		// the session copies stdout and stderr in separate goroutines
+		mu := &sync.Mutex{}
+		session.Stdout = &syncWriter{mu: mu, w: session.Stdout}
+		session.Stderr = &syncWriter{mu: mu, w: session.Stderr}
+	}
+
+	// with streamOutput, output is also written live, line by line, as the command runs
+	var liveOut, liveErr *prefixWriter
+	if st.StreamOutput {
+		liveOut = &prefixWriter{w: st.StreamWriter, prefix: fmt.Sprintf("[%s %s] ", host, c.Name)}
+		liveErr = &prefixWriter{w: st.StreamWriter, prefix: fmt.Sprintf("[%s %s stderr] ", host, c.Name)}
+		session.Stdout = io.MultiWriter(session.Stdout, liveOut)
+		session.Stderr = io.MultiWriter(session.Stderr, liveErr)
+	}
+
+	var sudo *sudoWriter
+	if c.Sudo && st.SudoPassword != "" {
+		if sudo, err = sudoSession(session, st.SudoPassword); err != nil {
+			sd.StreamErrors = append(sd.StreamErrors, fmt.Sprintf("Failed to set up sudo: %v", err))
+			sd.ExitCode = -1
+			return sd
+		}
+	}
+
+	measure := c.measures(st)
+	if measure {
+		cmd = wrapTime(cmd)
+	}
+
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = st.CommandTimeout
+	}
+
+	// abandoned is set if a timed out session could not be closed, in which case
+	// its buffers may still be written to and are not read.
+	var abandoned bool
+
+	start := time.Now()
+	err = runSession(ctx, session, cmd, timeout)
+	sd.timed(start)
+
+	if err != nil {
+		switch e := err.(type) {
+		case *timeoutError:
+			sd.StreamErrors = append(sd.StreamErrors, e.Error())
+			sd.ExitCode = -1
+			sd.Interrupted = interruptedTimeout
+			abandoned = e.abandoned
+		case *cancelError:
+			sd.StreamErrors = append(sd.StreamErrors, e.Error())
+			sd.ExitCode = -1
+			sd.Interrupted = interruptedCancelled
+			abandoned = e.abandoned
+		case *ssh.ExitError:
+			sd.StreamErrors = append(sd.StreamErrors, fmt.Sprintf("Command completed unsuccessfully: [%T]: %v", e, e.String()))
+			// 128 plus the signal number when killed by one, the signal itself is recorded too
+			sd.ExitCode = e.Waitmsg.ExitStatus()
+			if e.Waitmsg.Signal() != "" {
+				sd.Signal = &Signal{Name: e.Waitmsg.Signal(), Message: e.Waitmsg.Msg(), Lang: e.Waitmsg.Lang()}
+			}
+		case *ssh.ExitMissingError:
+			sd.StreamErrors = append(sd.StreamErrors, fmt.Sprintf("Exit code missing: %s", err))
+			sd.ExitCode = -1
+			sd.Interrupted = interruptedNoExit
+			if connLost(client) {
+				sd.Interrupted = interruptedConnLost
+			}
+		default:
+			sd.StreamErrors = append(sd.StreamErrors, fmt.Sprintf("Failed session Run: [%T]: %v", errors.Cause(err), err))
+			sd.ExitCode = -1
+			sd.Interrupted = interruptedConnLost
+		}
+	}
+
+	if !abandoned && sudo != nil {
+		sudo.flush()
+	}
+	// output received before an error, e.g. the connection dropping, is kept. An abandoned
+	// session's output is what was received by the time it was given up on.
+	stdout, stderr := stout.String(), sterr.String()
+	if !abandoned {
+		if st.StreamOutput {
+			liveOut.flush()
+			liveErr.flush()
+		}
+		sd.truncated(outCap, errCap, combine, st.MaxOutputBytes)
+	}
+	if measure {
+		// time writes to stderr, which is in stdout when combined
+		timed := &stderr
+		if combine {
+			timed = &stdout
+		}
+		var err error
+		if *timed, sd.Resources, err = parseTime(*timed); err != nil {
+			sd.StreamErrors = append(sd.StreamErrors, err.Error())
+		}
+	}
+
+	sd.setOutput(c, stdout, stderr, st)
+	return sd
+}
+
+// truncated records in sd which of a command's output, captured by out and err, was cut short
+// at max bytes. With combine, out captured both.
+func (sd *Stream) truncated(out, err *capWriter, combine bool, max int) {
+	if out.truncated {
+		name := "stdout"
+		if combine {
+			name = "combined output"
+		}
+		sd.StreamErrors = append(sd.StreamErrors, fmt.Sprintf("%s truncated to %d bytes (maxOutputBytes)", name, max))
+	}
+	if err.truncated && !combine {
+		sd.StreamErrors = append(sd.StreamErrors, fmt.Sprintf("stderr truncated to %d bytes (maxOutputBytes)", max))
+	}
+}
+
+// setOutput records c's stdout and stderr in sd, stdout as Combined if c combines its output,
+// and whether it succeeded from its exit code and, if c fails on stderr, its stderr.
+func (sd *Stream) setOutput(c Command, stdout, stderr string, st *runState) {
+	combine := c.combines(st)
+	sd.Stdout, sd.Stderr = stdout, stderr
+	if st.TrimOutput {
+		sd.Stdout = strings.TrimSpace(stdout)
+		sd.Stderr = strings.TrimSpace(stderr)
+	}
+	if combine {
+		sd.Combined, sd.Stdout = sd.Stdout, ""
+	}
+
+	sd.Succeeded = sd.ExitCode == 0
+	// without trimOutput, stderr of only whitespace, e.g. a blank line, still succeeds
+	if c.failsOnStderr(st) && strings.TrimSpace(sd.Stderr) != "" {
+		sd.Succeeded = false
+		sd.StreamErrors = append(sd.StreamErrors, "Command wrote to stderr and failOnStderr is set")
+	}
+}
+
+// lazySFTP establishes an sftp client over client on first use. It is safe for concurrent use.
+type lazySFTP struct {
+	client *ssh.Client
+	once   sync.Once
+	sfc    *sftp.Client
+	err    error
+}
+
+func (l *lazySFTP) get() (*sftp.Client, error) {
+	l.once.Do(func() {
+		l.sfc, l.err = sftp.NewClient(l.client)
+	})
+	return l.sfc, l.err
+}
+
+func (l *lazySFTP) close() {
+	if l.sfc != nil {
+		l.sfc.Close()
+	}
+}
+
+// timed records the timing of a command that started at start and just ended.
+func (sd *Stream) timed(start time.Time) {
+	end := time.Now()
+	sd.StartTime = start.Format(time.RFC3339Nano)
+	sd.EndTime = end.Format(time.RFC3339Nano)
+	sd.Duration = end.Sub(start).Seconds()
+}
+
+// stops reports whether a failure of c skips the remaining commands.
+func (c Command) stops(st *runState) bool {
+	if c.StopOnFailure != nil {
+		return *c.StopOnFailure
+	}
+	return st.StopOnFailure
+}
+
+// retryable reports whether c should be run again after sd: it ran and failed with one of
+// c.retryOnExit or, if none are set, any exit code. Commands that didn't run, e.g. failed to
+// render, are not retried.
+func (c Command) retryable(sd Stream) bool {
+	if sd.Succeeded || sd.StartTime == "" {
+		return false
+	}
+	if len(c.RetryOnExit) == 0 {
+		return true
+	}
+	for _, code := range c.RetryOnExit {
+		if sd.ExitCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// combines reports whether c's stdout and stderr are combined.
+func (c Command) combines(st *runState) bool {
+	if c.CombineOutput != nil {
+		return *c.CombineOutput
+	}
+	return st.CombineOutput
+}
+
+// failsOnStderr reports whether c writing to stderr means it did not succeed.
+func (c Command) failsOnStderr(st *runState) bool {
+	if c.FailOnStderr != nil {
+		return *c.FailOnStderr
+	}
+	return st.FailOnStderr
+}
+
+// measures reports whether c is wrapped with /usr/bin/time to record its resource use.
+func (c Command) measures(st *runState) bool {
+	if c.MeasureResources != nil {
+		return *c.MeasureResources
+	}
+	return st.MeasureResources
+}
+
+// wrapShell returns cmd passed, quoted, to c's shell, e.g. bash -lc 'cmd'. The machine's login
+// shell still runs the result, but only to start c's shell. Without a shell cmd is returned as-is.
+func (c Command) wrapShell(cmd string) string {
+	if len(c.Shell) == 0 {
+		return cmd
+	}
+	return strings.Join(c.Shell, " ") + " " + shellQuote(cmd)
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// timeoutError is returned by runSession when a command runs past its timeout.
+type timeoutError struct {
+	timeout   time.Duration
+	abandoned bool // the session did not finish after being killed
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("Command timed out after %v", e.timeout)
+}
+
+// cancelError is returned by runSession when ctx is cancelled while a command runs.
+type cancelError struct {
+	reason    string // e.g. cancelled while running
+	abandoned bool   // the session did not finish after being killed
+}
+
+func (e *cancelError) Error() string {
+	return "Command " + e.reason
+}
+
+// Reasons a command didn't run to completion, recorded as a stream's interrupted.
+const (
+	interruptedTimeout   = "timeout"         // killed after its timeout
+	interruptedCancelled = "cancelled"       // killed when the run was cancelled, e.g. interrupted or fail fast
+	interruptedConnLost  = "connection lost" // the connection dropped while it ran
+	interruptedNoExit    = "no exit status"  // the server closed the session without an exit status
+)
+
+// connLost reports whether client's connection is gone, checked with a keepalive that must be
+// answered within 5s. A closed connection fails the keepalive straight away.
+func connLost(client *ssh.Client) bool {
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		return err != nil
+	case <-time.After(5 * time.Second):
+		return true
+	}
+}
+
+// runSession runs cmd on session. If timeout is non-zero and cmd runs past it, the command is
+// sent SIGKILL, the session is closed and a *timeoutError is returned. A timeout of 0 means no
+// timeout, e.g. a command waiting on stdin blocks forever. If ctx is cancelled first, the
+// command is killed the same way and a *cancelError is returned.
+func runSession(ctx context.Context, session *ssh.Session, cmd string, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() { done <- session.Run(cmd) }()
+
+	// a nil channel never fires, i.e. no timeout
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-expired:
+		return &timeoutError{timeout: timeout, abandoned: killSession(session, done)}
+	case <-ctx.Done():
+		return &cancelError{reason: cancelledMsg(ctx, "while running"), abandoned: killSession(session, done)}
+	}
+}
+
+// killSession kills a running session and reports whether it was abandoned, i.e. Run did
+// not return within 5s.
+func killSession(session *ssh.Session, done <-chan error) bool {
+	// not every server supports signals, closing the session is the fallback
+	session.Signal(ssh.SIGKILL)
+	session.Close()
+
+	select {
+	case <-done:
+		return false
+	case <-time.After(5 * time.Second):
+		return true
+	}
+}
+
+// commandData is the data available to command templates.
+type commandData struct {
+	// SSHInfo is the machine the command runs on, e.g. {{ .HostName }} or {{ .Extras.region }}.
+	SSHInfo
+
+	// Results holds the streams of commands that already ran on the machine, by name, e.g.
+	// {{ .Results.detect_version.Stdout }}. Failed commands are included, so templates can
+	// check ExitCode. Referencing a command that has not run is an error.
+	Results map[string]Stream
+}
+
+// renderCommand renders cmd as a text/template against data. With strict, missing keys, e.g.
+// an Extras field the machine doesn't have, are an error rather than rendering as <no value>.
+// Nothing is escaped, values are inserted into the command as-is.
+func renderCommand(cmd string, data commandData, strict bool) (string, error) {
+	missing := "default"
+	if strict {
+		missing = "error"
+	}
+	t, err := template.New("command").Option("missingkey=" + missing).Parse(cmd)
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		const noEntry = "map has no entry for key "
+		if i := strings.Index(err.Error(), noEntry); i >= 0 {
+			return "", errors.Errorf("missing key %s for host %s", err.Error()[i+len(noEntry):], data.HostName)
+		}
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// usesResults reports whether the command template cmd references .Results, the streams of
+// commands that ran before it. A template that doesn't parse reports false, it fails when it's
+// rendered instead.
+func usesResults(cmd string) bool {
+	t, err := template.New("command").Parse(cmd)
+	if err != nil {
+		return false
+	}
+
+	var walk func(n parse.Node) bool
+	walk = func(n parse.Node) bool {
+		switch n := n.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return false
+			}
+			for _, c := range n.Nodes {
+				if walk(c) {
+					return true
+				}
+			}
+		case *parse.PipeNode:
+			if n == nil {
+				return false
+			}
+			for _, c := range n.Cmds {
+				if walk(c) {
+					return true
+				}
+			}
+		case *parse.CommandNode:
+			for _, a := range n.Args {
+				if walk(a) {
+					return true
+				}
+			}
+		case *parse.ActionNode:
+			return walk(n.Pipe)
+		case *parse.TemplateNode:
+			return walk(n.Pipe)
+		case *parse.IfNode:
+			return walk(n.Pipe) || walk(n.List) || walk(n.ElseList)
+		case *parse.RangeNode:
+			return walk(n.Pipe) || walk(n.List) || walk(n.ElseList)
+		case *parse.WithNode:
+			return walk(n.Pipe) || walk(n.List) || walk(n.ElseList)
+		case *parse.ChainNode:
+			return walk(n.Node)
+		case *parse.FieldNode:
+			// e.g. .Results.name.Stdout
+			return n.Ident[0] == "Results"
+		case *parse.VariableNode:
+			// e.g. $.Results.name.Stdout
+			return len(n.Ident) > 1 && n.Ident[0] == "$" && n.Ident[1] == "Results"
+		}
+		return false
+	}
+	return walk(t.Tree.Root)
+}
+
+// lineTruncated marks a line that was cut short by lineLimitWriter.
+const lineTruncated = "...[line truncated]"
+
+// lineLimitWriter writes to w, truncating any single line longer than max bytes and
+// marking it with lineTruncated. It guards against a single enormous line, e.g. minified JSON,
+// being held in memory in full.
+type lineLimitWriter struct {
+	w         io.Writer
+	max       int
+	n         int  // bytes written on the current line
+	truncated bool // current line already marked as truncated
+}
+
+func (l *lineLimitWriter) Write(p []byte) (int, error) {
+	total := len(p)
+
+	for len(p) > 0 {
+		line := p
+		i := bytes.IndexByte(p, '\n')
+		if i >= 0 {
+			line = p[:i]
+		}
+
+		if room := l.max - l.n; room > 0 {
+			chunk := line
+			if len(chunk) > room {
+				chunk = chunk[:room]
+			}
+			if _, err := l.w.Write(chunk); err != nil {
+				return 0, err
+			}
+			l.n += len(chunk)
+			line = line[len(chunk):]
+		}
+
+		if len(line) > 0 && !l.truncated {
+			if _, err := io.WriteString(l.w, lineTruncated); err != nil {
+				return 0, err
+			}
+			l.truncated = true
+		}
+
+		if i < 0 {
+			break
+		}
+		if _, err := l.w.Write([]byte{'\n'}); err != nil {
+			return 0, err
+		}
+		l.n, l.truncated = 0, false
+		p = p[i+1:]
+	}
+
+	return total, nil
+}
+
+// syncWriter serializes writes to w with mu, which may be shared with other writers.
+type syncWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// lockedBuffer is a bytes.Buffer safe to read while it's written, e.g. the output of an
+// abandoned session still being copied to it.
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Write(p)
+}
+
+func (l *lockedBuffer) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.String()
+}
+
+// capWriter writes at most max bytes to w and discards the rest, so a command emitting
+// gigabytes doesn't exhaust memory. A max of 0 means no limit.
+type capWriter struct {
+	w         io.Writer
+	max       int
+	n         int
+	truncated bool
+}
+
+func (c *capWriter) Write(p []byte) (int, error) {
+	if c.max <= 0 {
+		return c.w.Write(p)
+	}
+
+	b := p
+	if room := c.max - c.n; len(b) > room {
+		b = b[:room]
+		c.truncated = true
+	}
+	if len(b) > 0 {
+		n, err := c.w.Write(b)
+		c.n += n
+		if err != nil {
+			return n, err
+		}
+	}
+	return len(p), nil
+}
+
+// liveMu serializes live output across all machines, so lines aren't interleaved.
+var liveMu sync.Mutex
+
+// maxPartialLine bounds the partial line a prefixWriter holds. Output without newlines is
+// written in pieces of this size, each as a line of its own.
+const maxPartialLine = 64 << 10
+
+// prefixWriter writes each complete line to w, prefixed with prefix. A trailing partial line
+// is held until it's completed or flushed, or passes maxPartialLine.
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	i := bytes.LastIndexByte(p.buf, '\n')
+	if i < 0 && len(p.buf) < maxPartialLine {
+		return len(b), nil
+	}
+
+	var lines [][]byte
+	if i < 0 {
+		// a partial line too long to hold is written as is, ending the line
+		lines = [][]byte{append(p.buf, '\n')}
+		p.buf = nil
+	} else {
+		lines = bytes.SplitAfter(p.buf[:i+1], []byte{'\n'})
+		p.buf = append([]byte(nil), p.buf[i+1:]...)
+	}
+
+	liveMu.Lock()
+	defer liveMu.Unlock()
+	for _, l := range lines {
+		if len(l) == 0 {
+			continue
+		}
+		// live output is best effort, a failed write must not fail the command
+		io.WriteString(p.w, p.prefix)
+		p.w.Write(l)
+	}
+	return len(b), nil
+}
+
+// flush writes any trailing partial line.
+func (p *prefixWriter) flush() {
+	if len(p.buf) > 0 {
+		p.Write([]byte{'\n'})
+	}
+}
+
+// syslogMessage returns the audit record for a machine's results: each stream that ran with
+// its exit code, and those that didn't run, e.g. skipped after a failure.
+func syslogMessage(results []Stream, runID, operator string) string {
+	ran := make([]string, 0, len(results))
+	var skipped []string
+	for _, s := range results {
+		if s.StartTime == "" {
+			skipped = append(skipped, s.Name)
+			continue
+		}
+		ran = append(ran, fmt.Sprintf("%s (exit %d)", s.Name, s.ExitCode))
+	}
+	msg := "boomerang ran: " + strings.Join(ran, ", ")
+	if len(skipped) > 0 {
+		msg += "; not run: " + strings.Join(skipped, ", ")
+	}
+	return fmt.Sprintf("%s (run_id=%s, operator=%s)", msg, runID, operator)
+}
+
+// executeSyslog records results, what boomerang ran on the machine, in its own syslog, leaving
+// an audit trail on the machine independent of boomerang's output. Like finally it runs once
+// everything else has, even if the run was cancelled, and always as written: it isn't
+// rendered, measured or run with sudo.
+func executeSyslog(client *ssh.Client, info SSHInfo, results []Stream, st *runState) Stream {
+	fst := *st
+	fst.StopOnFailure = false
+	fst.ParallelCommands = false
+	fst.TemplateCommands = false
+	fst.MeasureResources = false
+
+	c := Command{Name: "syslog", Command: "logger -t boomerang " + shellQuote(syslogMessage(results, st.RunID, st.Operator))}
+	out := executeCommands(context.Background(), client, info, []Command{c}, &fst)
+	out[0].Finalizer = true
+	return out[0]
+}
+
+// executeFinalizers runs the finally commands, which must run regardless of whether
+// earlier uploads or commands failed, e.g. releasing a lock or removing a temp file.
+// They run even if the run was cancelled, so they aren't given its context.
+func executeFinalizers(client *ssh.Client, info SSHInfo, cs []Command, st *runState) []Stream {
+	// the global stopOnFailure doesn't apply, a failed finalizer shouldn't skip the others.
+	// Finalizers always run in order, even with parallelCommands.
+	fst := *st
+	fst.StopOnFailure = false
+	fst.ParallelCommands = false
+
+	out := executeCommands(context.Background(), client, info, cs, &fst)
+	for i := range out {
+		out[i].Finalizer = true
+	}
+	return out
+}
+
+func executeUploads(sfc *sftp.Client, up []upload, st *runState) []Stream {
+
+	var out []Stream
+
+	for _, u := range up {
+
+		sd := Stream{
+			Name:         fmt.Sprintf("Uploading: %v", u.filename),
+			StreamErrors: make([]string, 0),
+		}
+
+		// remote paths are always joined with /
+		file := path.Join(u.dest, u.filename)
+
+		if !u.overwrite {
+			// check remote file existence
+			if _, err := sfc.Lstat(file); !os.IsNotExist(err) {
+				sd.Stderr = fmt.Sprintf("File exists and overwrite set to false: %v", file)
+				sd.ExitCode = -1
+				out = append(out, sd)
+				continue
+			}
+		}
+
+		// Content is written to a temp file and then moved into place, so an interrupted upload
+		// never leaves a partial file at the destination. Orphaned temp files are removed with --gc.
+		tmp := st.remoteTempFile(u.filename)
+
+		dst, err := sfc.Create(tmp)
+		if err != nil {
+			sd.StreamErrors = append(sd.StreamErrors, fmt.Sprintf("Failed to create %v on remote server: %v", tmp, err))
+			sd.ExitCode = -1
+			out = append(out, sd)
+			continue
+		}
+
+		if _, err := dst.Write(u.content); err != nil {
+			dst.Close()
+			sfc.Remove(tmp)
+			sd.StreamErrors = append(sd.StreamErrors, fmt.Sprintf("Failed writing content to remote file: %v", err))
+			sd.ExitCode = -1
+			out = append(out, sd)
+			continue
+		}
+		dst.Close()
+
+		if err := moveRemote(sfc, tmp, file); err != nil {
+			sfc.Remove(tmp)
+			sd.StreamErrors = append(sd.StreamErrors, fmt.Sprintf("Failed moving %v to %v on remote server: %v", tmp, file, err))
+			sd.ExitCode = -1
+			out = append(out, sd)
+			continue
+		}
+
+		if st.VerifyChecksum {
+			sum, err := remoteChecksum(sfc, file)
+			if err != nil {
+				sd.StreamErrors = append(sd.StreamErrors, fmt.Sprintf("Failed verifying checksum of remote file: %v", err))
+				sd.ExitCode = -1
+				out = append(out, sd)
+				continue
+			}
+			if sum != u.checksum {
+				sd.StreamErrors = append(sd.StreamErrors, fmt.Sprintf("Checksum mismatch for %v: local sha256 %x, remote sha256 %x", file, u.checksum, sum))
+				sd.ExitCode = -1
+				out = append(out, sd)
+				continue
+			}
+		}
+
+		sd.Stdout = fmt.Sprintf("File successfully uploaded: %v", file)
+		sd.Succeeded = true
+
+		out = append(out, sd)
+	}
+
+	return out
+}
+
+// moveRemote moves a remote file from src to dst. A posix rename is tried first and, since
+// it fails across filesystems (e.g. a tmpfs /tmp), falls back to copying and removing src.
+func moveRemote(sfc *sftp.Client, src, dst string) error {
+	if err := sfc.PosixRename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := sfc.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := sfc.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return sfc.Remove(src)
+}
+
+// gcTempFiles removes boomerang temp files left behind on the remote machine by prior runs,
+// e.g. if boomerang crashed mid-upload, and not modified within st.gcMinAge. Only files named
+// by remoteTempFile are removed, see isRemoteTempFile. Removed files are recorded in Stdout.
+func gcTempFiles(sfc *sftp.Client, st *runState) Stream {
+	sd := Stream{
+		Name:         "gc",
+		StreamErrors: make([]string, 0),
+	}
+
+	fs, err := sfc.ReadDir(st.RemoteTmpDir)
+	if err != nil {
+		sd.StreamErrors = append(sd.StreamErrors, fmt.Sprintf("Failed reading %v on remote server: %v", st.RemoteTmpDir, err))
+		sd.ExitCode = -1
+		return sd
+	}
+
+	var removed []string
+	for _, f := range fs {
+		if !f.Mode().IsRegular() || !st.isRemoteTempFile(f.Name()) {
+			continue
+		}
+		// a recently modified file may be an upload in progress by another run
+		if time.Since(f.ModTime()) < st.GCMinAge {
+			continue
+		}
+		file := path.Join(st.RemoteTmpDir, f.Name())
+		if err := sfc.Remove(file); err != nil {
+			sd.StreamErrors = append(sd.StreamErrors, fmt.Sprintf("Failed removing %v: %v", file, err))
+			sd.ExitCode = -1
+			continue
+		}
+		removed = append(removed, file)
+	}
+	sd.Stdout = strings.Join(removed, "\n")
+	sd.Succeeded = sd.ExitCode == 0
+
+	return sd
+}
+
+// remoteChecksum reads a remote file back over sftp and returns its sha256 sum.
+// Reading the file back avoids depending on sha256sum being installed on the remote machine.
+func remoteChecksum(sfc *sftp.Client, file string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+
+	f, err := sfc.Open(file)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+
+	return sum, nil
+}
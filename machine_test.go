@@ -0,0 +1,576 @@
+package boomerang
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	var out bytes.Buffer
+	p := &prefixWriter{w: &out, prefix: "[web1] "}
+
+	for _, s := range []string{"one\ntw", "o\n", "three", "\nfour"} {
+		p.Write([]byte(s))
+	}
+	p.flush()
+	if want := "[web1] one\n[web1] two\n[web1] three\n[web1] four\n"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+
+	// output without newlines isn't held without bound
+	out.Reset()
+	chunk := strings.Repeat("x", 1024)
+	for i := 0; i < 3*maxPartialLine/len(chunk); i++ {
+		p.Write([]byte(chunk))
+		if len(p.buf) >= maxPartialLine {
+			t.Fatalf("held %d bytes, want less than %d", len(p.buf), maxPartialLine)
+		}
+	}
+	p.flush()
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want 3", len(lines))
+	}
+	for _, l := range lines {
+		if l != "[web1] "+strings.Repeat("x", maxPartialLine) {
+			t.Errorf("line of %d bytes, want the prefix and %d bytes", len(l), maxPartialLine)
+		}
+	}
+}
+
+func TestInventoryOrderSorted(t *testing.T) {
+	inventory := Inventory{
+		{HostName: "a", Extras: map[string]interface{}{"Rack": "r2"}},
+		{HostName: "b"},
+		{HostName: "c", Extras: map[string]interface{}{"rack": "r1"}},
+		{HostName: "d", Extras: map[string]interface{}{"RACK": "r1"}},
+		{HostName: "e", Extras: map[string]interface{}{"zone": "z1"}},
+	}
+	inventory.Order("sorted", "rack")
+
+	var got []string
+	for _, s := range inventory {
+		got = append(got, s.HostName)
+	}
+	// keys match case-insensitively, machines without one keep their order at the end
+	if want := []string{"c", "d", "a", "b", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("order = %q, want %q", got, want)
+	}
+}
+
+func TestUsesResults(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want bool
+	}{
+		{"uptime", false},
+		{"deploy --node {{ .HostName }} --region {{ .Extras.region }}", false},
+		{"upgrade --from {{ .Results.detect_version.Stdout }}", true},
+		{`upgrade --from {{ (index .Results "detect-version").Stdout }}`, true},
+		{"{{ if eq .Results.check.ExitCode 0 }}restart{{ end }}", true},
+		{"{{ with .Extras }}{{ $.Results.check.Stdout }}{{ end }}", true},
+		{"{{ range .Extras.tags }}echo {{ . }};{{ else }}{{ .Results.x.Stdout }}{{ end }}", true},
+		{"echo {{ .Extras.Results }}", false},
+		{"echo {{ .Unclosed", false},
+	}
+	for _, tt := range tests {
+		if got := usesResults(tt.cmd); got != tt.want {
+			t.Errorf("usesResults(%q) = %v, want %v", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestLineLimitWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		max    int
+		writes []string
+		want   string
+	}{
+		{"short lines", 5, []string{"abc\nde\n"}, "abc\nde\n"},
+		{"exact", 3, []string{"abc\n"}, "abc\n"},
+		{"long line", 3, []string{"abcdef\nxy\n"}, "abc" + lineTruncated + "\nxy\n"},
+		{"split across writes", 4, []string{"ab", "cd", "ef\n", "g"}, "abcd" + lineTruncated + "\ng"},
+		{"marked once", 2, []string{"abc", "def", "ghi\n"}, "ab" + lineTruncated + "\n"},
+		{"no trailing newline", 2, []string{"abcd"}, "ab" + lineTruncated},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		l := &lineLimitWriter{w: &out, max: tt.max}
+		for _, w := range tt.writes {
+			if n, err := l.Write([]byte(w)); err != nil || n != len(w) {
+				t.Fatalf("%s: Write(%q) = %d, %v, want %d", tt.name, w, n, err, len(w))
+			}
+		}
+		if out.String() != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, out.String(), tt.want)
+		}
+	}
+}
+
+func TestCapWriter(t *testing.T) {
+	tests := []struct {
+		name          string
+		max           int
+		writes        []string
+		want          string
+		wantTruncated bool
+	}{
+		{"unlimited", 0, []string{"abc", "def"}, "abcdef", false},
+		{"under", 10, []string{"abc", "def"}, "abcdef", false},
+		{"exact", 6, []string{"abc", "def"}, "abcdef", false},
+		{"over in one write", 4, []string{"abcdef"}, "abcd", true},
+		{"over across writes", 4, []string{"abc", "def", "ghi"}, "abcd", true},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		c := &capWriter{w: &out, max: tt.max}
+		for _, w := range tt.writes {
+			// the rest is discarded, not an error, so the command's output keeps being read
+			if n, err := c.Write([]byte(w)); err != nil || n != len(w) {
+				t.Fatalf("%s: Write(%q) = %d, %v, want %d", tt.name, w, n, err, len(w))
+			}
+		}
+		if out.String() != tt.want || c.truncated != tt.wantTruncated {
+			t.Errorf("%s: got %q truncated=%v, want %q truncated=%v", tt.name, out.String(), c.truncated, tt.want, tt.wantTruncated)
+		}
+	}
+}
+
+func TestInventoryLimit(t *testing.T) {
+	inv := Inventory{
+		{HostName: "web-1", Extras: map[string]interface{}{"role": "web", "env": "prod"}},
+		{HostName: "web-2", Extras: map[string]interface{}{"role": "web", "env": "dev"}},
+		{HostName: "db-1", Extras: map[string]interface{}{"Role": "db", "env": "prod", "shard": 1}},
+	}
+
+	tests := []struct {
+		selector string
+		want     Inventory
+		wantErr  bool
+	}{
+		{"", inv, false},
+		{" , ", inv, false},
+		{"web-*", Inventory{inv[0], inv[1]}, false},
+		{"db-1", Inventory{inv[2]}, false},
+		{"env=prod", Inventory{inv[0], inv[2]}, false},
+		{"role=db", Inventory{inv[2]}, false}, // extras keys compared case-insensitively
+		{"role=web, env=dev", Inventory{inv[1]}, false},
+		{"shard=1", Inventory{inv[2]}, false},
+		{"missing=*", nil, false},
+		{"=db", nil, true},
+		{"web-[", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := inv.Limit(tt.selector)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error %v, want error: %v", tt.selector, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		// nil and empty are the same
+		if len(got)+len(tt.want) > 0 && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %+v, want %+v", tt.selector, got, tt.want)
+		}
+	}
+}
+
+func TestSyncWriter(t *testing.T) {
+	tests := []struct {
+		writers, writes int
+	}{
+		{1, 100},
+		{2, 100},
+		{8, 50},
+	}
+	for _, tt := range tests {
+		// writers share one mutex, as stdout and stderr do with combineOutput
+		var out bytes.Buffer
+		mu := &sync.Mutex{}
+		var wg sync.WaitGroup
+		for i := 0; i < tt.writers; i++ {
+			w := &syncWriter{mu: mu, w: &out}
+			line := []byte(strings.Repeat(fmt.Sprint(i), 64) + "\n")
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < tt.writes; j++ {
+					w.Write(line)
+				}
+			}()
+		}
+		wg.Wait()
+
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		if len(lines) != tt.writers*tt.writes {
+			t.Errorf("%d writers: got %d lines, want %d", tt.writers, len(lines), tt.writers*tt.writes)
+		}
+		for _, l := range lines {
+			if len(l) != 64 || strings.Trim(l, l[:1]) != "" {
+				t.Errorf("%d writers: interleaved write %q", tt.writers, l)
+				break
+			}
+		}
+	}
+}
+
+func TestCommandRetryable(t *testing.T) {
+	ran := "2020-01-01T00:00:00Z"
+	tests := []struct {
+		name string
+		c    Command
+		sd   Stream
+		want bool
+	}{
+		{"succeeded", Command{}, Stream{Succeeded: true, StartTime: ran}, false},
+		{"failed", Command{}, Stream{ExitCode: 1, StartTime: ran}, true},
+		{"did not run", Command{}, Stream{ExitCode: 1}, false},
+		{"exit code listed", Command{RetryOnExit: []int{75, 1}}, Stream{ExitCode: 1, StartTime: ran}, true},
+		{"exit code not listed", Command{RetryOnExit: []int{75}}, Stream{ExitCode: 1, StartTime: ran}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.c.retryable(tt.sd); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSortMachines(t *testing.T) {
+	// completion order, each machine's dispatch order after #
+	completed := func() []Machine {
+		var ms []Machine
+		for _, s := range []string{"web2:22/u#2", "db1:2222/u#4", "web1:22/b#3", "db1:22/u#0", "web1:22/a#1", "db1:x/u#5"} {
+			var m Machine
+			hp, ord, _ := strings.Cut(s, "#")
+			hp, m.Username, _ = strings.Cut(hp, "/")
+			m.HostName, m.Port, _ = strings.Cut(hp, ":")
+			fmt.Sscan(ord, &m.order)
+			ms = append(ms, m)
+		}
+		return ms
+	}
+
+	tests := []struct {
+		order string
+		want  []string // host:port/user
+	}{
+		{OutputOrderHostname, []string{"db1:22/u", "db1:2222/u", "db1:x/u", "web1:22/a", "web1:22/b", "web2:22/u"}},
+		{OutputOrderInventory, []string{"db1:22/u", "web1:22/a", "web2:22/u", "web1:22/b", "db1:2222/u", "db1:x/u"}},
+		{OutputOrderCompletion, []string{"web2:22/u", "db1:2222/u", "web1:22/b", "db1:22/u", "web1:22/a", "db1:x/u"}},
+	}
+	for _, tt := range tests {
+		ms := completed()
+		sortMachines(ms, tt.order)
+		var got []string
+		for _, m := range ms {
+			got = append(got, m.HostName+":"+m.Port+"/"+m.Username)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.order, got, tt.want)
+		}
+	}
+}
+
+func TestWrapShell(t *testing.T) {
+	tests := []struct {
+		shell []string
+		cmd   string
+		want  string
+	}{
+		{nil, "echo $HOME", "echo $HOME"},
+		{[]string{"bash", "-lc"}, "echo $HOME", `bash -lc 'echo $HOME'`},
+		{[]string{"sh", "-c"}, "echo 'hi'", `sh -c 'echo '"'"'hi'"'"''`},
+	}
+	for _, tt := range tests {
+		if got := (Command{Shell: tt.shell}).wrapShell(tt.cmd); got != tt.want {
+			t.Errorf("%q %q: got %s, want %s", tt.shell, tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestInventoryDedupe(t *testing.T) {
+	inv := Inventory{
+		{HostName: "web1", Username: "u"},
+		{HostName: "WEB1", Port: "22", Username: "u"}, // identical to the first
+		{HostName: "web1", Port: "22", Username: "v"},
+		{HostName: "web1", Port: "2222", Username: "u"},
+		{HostName: "web1", Username: "u", Extras: map[string]interface{}{"role": "db"}},
+	}
+
+	tests := []struct {
+		inv     Inventory
+		mode    string
+		want    Inventory // the machines kept
+		wantErr bool
+	}{
+		{inv, "off", inv, false},
+		{inv, "first", Inventory{inv[0], inv[2], inv[3]}, false},
+		{inv, "strict", nil, true},
+		{inv[:4], "strict", Inventory{inv[0], inv[2], inv[3]}, false}, // without the conflicting machine
+	}
+	for _, tt := range tests {
+		got, err := tt.inv.Dedupe(tt.mode)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error: %v", tt.mode, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestInventoryAddFilter(t *testing.T) {
+	var inv Inventory
+	for _, h := range []string{"web1", "db1", "web2"} {
+		inv.Add(SSHInfo{HostName: h})
+	}
+	if inv.Len() != 3 {
+		t.Fatalf("Len() = %d, want 3", inv.Len())
+	}
+
+	tests := []struct {
+		name string
+		pred func(SSHInfo) bool
+		want Inventory
+	}{
+		{"all", func(SSHInfo) bool { return true }, Inventory{{HostName: "web1"}, {HostName: "db1"}, {HostName: "web2"}}},
+		{"none", func(SSHInfo) bool { return false }, nil},
+		{"prefix", func(s SSHInfo) bool { return strings.HasPrefix(s.HostName, "web") }, Inventory{{HostName: "web1"}, {HostName: "web2"}}},
+	}
+	for _, tt := range tests {
+		got := inv.Filter(tt.pred)
+		// nil and empty are the same
+		if len(got)+len(tt.want) > 0 && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+	if inv.Len() != 3 {
+		t.Errorf("Filter modified the inventory, Len() = %d", inv.Len())
+	}
+}
+
+func TestRunServerVersion(t *testing.T) {
+	s := startFakeSSH(t, &fakeSSH{config: func(cfg *ssh.ServerConfig) {
+		cfg.ServerVersion = "SSH-2.0-OpenSSH_8.9 fake"
+		cfg.BannerCallback = func(ssh.ConnMetadata) string { return "Authorized use only\n" }
+	}})
+
+	b, err := Run(context.Background(), Options{
+		Inventory:   Inventory{{HostName: s.host, Port: s.port, Username: "u"}},
+		Commands:    []Command{{Name: "echo", Command: "echo hello"}},
+		Auth:        Auth{Methods: []string{"password"}, Password: "secret"},
+		HostKeyMode: HostKeyInsecure,
+		DownloadDir: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := b.MachineData[0]
+	if !m.Connection {
+		t.Fatalf("machine did not connect: %v", m.ConnectionErrors)
+	}
+	if m.ServerVersion != "SSH-2.0-OpenSSH_8.9 fake" {
+		t.Errorf("server version = %q, want SSH-2.0-OpenSSH_8.9 fake", m.ServerVersion)
+	}
+	if m.Banner != "Authorized use only" {
+		t.Errorf("banner = %q, want it trimmed to Authorized use only", m.Banner)
+	}
+}
+
+func TestRunCiphers(t *testing.T) {
+	// the server only offers a cipher the client doesn't by default
+	s := startFakeSSH(t, &fakeSSH{config: func(cfg *ssh.ServerConfig) {
+		cfg.Ciphers = []string{"aes128-cbc"}
+	}})
+
+	tests := []struct {
+		name        string
+		ciphers     []string
+		wantConnect bool
+	}{
+		{"defaults", nil, false},
+		{"cipher offered", []string{"aes128-cbc"}, true},
+	}
+	for _, tt := range tests {
+		b, err := Run(context.Background(), Options{
+			Inventory:   Inventory{{HostName: s.host, Port: s.port, Username: "u"}},
+			Commands:    []Command{{Name: "echo", Command: "echo hello"}},
+			Auth:        Auth{Methods: []string{"password"}, Password: "secret"},
+			HostKeyMode: HostKeyInsecure,
+			Algorithms:  ssh.Config{Ciphers: tt.ciphers},
+			DownloadDir: t.TempDir(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := b.MachineData[0]
+		if m.Connection != tt.wantConnect {
+			t.Errorf("%s: connection %v, want %v: %v", tt.name, m.Connection, tt.wantConnect, m.ConnectionErrors)
+		}
+		if !tt.wantConnect && (len(m.ConnectionErrors) == 0 || !strings.Contains(m.ConnectionErrors[0], "no common algorithm")) {
+			t.Errorf("%s: errors %q, want no common algorithm", tt.name, m.ConnectionErrors)
+		}
+	}
+}
+
+func TestRunBindAddress(t *testing.T) {
+	tests := []struct {
+		bind        string
+		wantConnect bool
+	}{
+		{"127.0.0.1", true},
+		{"127.0.0.3", true},
+		// not a local address, it can't be bound
+		{"192.0.2.1", false},
+	}
+	for _, tt := range tests {
+		s := startFakeSSH(t, &fakeSSH{})
+
+		b, err := Run(context.Background(), Options{
+			Inventory:   Inventory{{HostName: s.host, Port: s.port, Username: "u"}},
+			Commands:    []Command{{Name: "echo", Command: "echo hello"}},
+			BindAddress: net.ParseIP(tt.bind),
+			Auth:        Auth{Methods: []string{"password"}, Password: "secret"},
+			HostKeyMode: HostKeyInsecure,
+			DownloadDir: t.TempDir(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := b.MachineData[0]
+		if m.Connection != tt.wantConnect {
+			t.Errorf("%s: connection %v, want %v: %v", tt.bind, m.Connection, tt.wantConnect, m.ConnectionErrors)
+		}
+		if !tt.wantConnect {
+			continue
+		}
+		s.mu.Lock()
+		remotes := s.remotes
+		s.mu.Unlock()
+		if len(remotes) != 1 {
+			t.Fatalf("%s: %d connections, want 1", tt.bind, len(remotes))
+		}
+		if h, _, _ := net.SplitHostPort(remotes[0]); h != tt.bind {
+			t.Errorf("%s: connected from %s", tt.bind, remotes[0])
+		}
+	}
+}
+
+func TestRunPreflight(t *testing.T) {
+	s := startFakeSSH(t, &fakeSSH{})
+	downHost, downPort := closedPort(t)
+
+	b, err := Run(context.Background(), Options{
+		Inventory: Inventory{
+			{HostName: s.host, Port: s.port, Username: "up"},
+			{HostName: downHost, Port: downPort, Username: "down"},
+		},
+		Commands:         []Command{{Name: "echo", Command: "echo hello"}},
+		Auth:             Auth{Methods: []string{"password"}, Password: "secret"},
+		HostKeyMode:      HostKeyInsecure,
+		Preflight:        true,
+		PreflightTimeout: time.Second,
+		Retry:            3,
+		Backoff:          Backoff{Wait: 10 * time.Millisecond},
+		DownloadDir:      t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range b.MachineData {
+		switch m.Username {
+		case "up":
+			if !m.Connection || m.ConnectionAttempts != 1 {
+				t.Errorf("open port: connection %v after %d attempt(s), want connected after 1: %v", m.Connection, m.ConnectionAttempts, m.ConnectionErrors)
+			}
+		case "down":
+			if m.Connection {
+				t.Error("closed port: connected")
+			}
+			// unreachable machines are recorded without retrying ssh
+			if m.ConnectionAttempts != 0 {
+				t.Errorf("closed port: %d ssh attempt(s), want 0", m.ConnectionAttempts)
+			}
+			if len(m.ConnectionErrors) != 1 || !strings.Contains(m.ConnectionErrors[0], "preflight: port closed/unreachable") {
+				t.Errorf("closed port: errors %q, want it recorded as unreachable", m.ConnectionErrors)
+			}
+		}
+	}
+	// the probe, then the ssh connection
+	if got := s.conns.Load(); got != 2 {
+		t.Errorf("%d connection(s) to the open port, want 2", got)
+	}
+}
+
+func TestNormalizePort(t *testing.T) {
+	tests := []struct {
+		port    string
+		want    string
+		wantErr string // empty if the port is valid
+	}{
+		{"", "22", ""},
+		{"2222", "2222", ""},
+		{"ssh", "22", ""},
+		{"0", "", "invalid port: [0]"},
+		{"70000", "", "invalid port: [70000]"},
+		{"abc", "", "invalid port: [abc] is not a number or a known service"},
+	}
+	for _, tt := range tests {
+		got, err := normalizePort(tt.port)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%q: %v", tt.port, err)
+		case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+			t.Errorf("%q: error %v, want %q", tt.port, err, tt.wantErr)
+		case got != tt.want:
+			t.Errorf("%q: got %q, want %q", tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestInventoryNormalizePorts(t *testing.T) {
+	inv := Inventory{
+		{HostName: "web1"},
+		{HostName: "web2", Port: "ssh"},
+		{HostName: "web3", Port: "2222"},
+	}
+	if err := inv.NormalizePorts(); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range inv {
+		got = append(got, m.Port)
+	}
+	if want := []string{"22", "22", "2222"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ports %q, want %q", got, want)
+	}
+
+	// every invalid port is reported, not only the first
+	inv = Inventory{
+		{HostName: "web1", Port: "70000"},
+		{HostName: "web2", Port: "22"},
+		{HostName: "web3", Port: "abc"},
+	}
+	err := inv.NormalizePorts()
+	if err == nil {
+		t.Fatal("invalid ports, want an error")
+	}
+	for _, want := range []string{"2 machine(s)", "[web1] invalid port: [70000]", "[web3] invalid port: [abc]"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q, want it to contain %q", err, want)
+		}
+	}
+}
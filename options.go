@@ -0,0 +1,596 @@
+package boomerang
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// Options configures a Run. The zero value of each field is usable, e.g. no timeouts and no
+// retries; cmd/boomerang builds Options from its config file, with its own defaults.
+type Options struct {
+	// Inventory is run in the order given.
+	Inventory Inventory
+
+	Uploads         []Upload  // copied to every machine before its commands run
+	Commands        []Command // run on every machine in order, unless it has its own, see SSHInfo.Commands
+	CLI             *Command  // optional, run last on every machine, after its own commands too
+	Finally         []Command // always run last, even if earlier steps failed
+	DupCommandNames string    // suffix or strict, see uniqueCommandNames, suffix if empty
+
+	Auth         Auth   // how machines are authenticated, unless a machine sets its own
+	JumpHost     string // optional, [user@]host[:port] machines are connected through
+	JumpAuth     *Auth  // optional, the jump host's auth, the machine's if nil
+	SudoPassword string // optional, answers the password prompt of commands run with sudo
+
+	HostKeyMode       string     // strict, insecure or tofu, strict if empty
+	KnownHosts        []string   // known_hosts files, the user's and system's if empty; tofu adds to the first
+	HostKeyAlgorithms []string   // optional, replaces those known_hosts would negotiate
+	Algorithms        ssh.Config // optional ciphers, key exchanges and MACs, the defaults if empty
+	BindAddress       net.IP     // local address connections are made from, any if nil
+
+	ConnTimeout       time.Duration // per connection attempt, unbounded if 0
+	Retry             int           // connection attempts after the first
+	Backoff           Backoff       // wait between connection retries
+	WaitForSSH        time.Duration // wait for each machine's SSH port to open before connecting
+	Preflight         bool          // probe the port before connecting
+	PreflightTimeout  time.Duration // per probe with Preflight
+	Deadline          time.Time     // optional, connections are retried until then instead of Retry times
+	CommandTimeout    time.Duration // per command, unbounded if 0
+	KeepaliveInterval time.Duration // between keepalives on an open connection, disabled if 0
+	GlobalTimeout     time.Duration // the whole run may take before it is aborted, unbounded if 0
+	FailFastThreshold float64       // percent of completed machines failing to connect that aborts the run, off if 0
+	FailFastMinHosts  int           // machines completed before FailFastThreshold is checked
+	MaxConcurrency    int           // machines run at once, unbounded if <= 0
+	Canary            string        // count, e.g. 5, or percentage, e.g. 10%, of machines to run first
+	CanaryMaxFailure  float64       // percent of canary machines failing that stops the rest running
+
+	TemplateCommands bool // render commands as templates before running them
+	TemplateStrict   bool // a missing key in a command template is an error
+	FailOnStderr     bool // a command writing to stderr did not succeed, even if it exited 0
+	StopOnFailure    bool // skip a machine's remaining commands after one fails
+	CombineOutput    bool // record stdout and stderr together, in the order received
+	TrimOutput       bool // trim leading and trailing whitespace from command output
+	MeasureResources bool // wrap commands with /usr/bin/time
+	ParallelCommands bool // run a machine's commands concurrently, one session each
+	MaxSessions      int  // sessions open at once per machine with ParallelCommands, unbounded if <= 0
+	MaxOutputBytes   int  // captured per stream, unbounded if 0
+	MaxLineLength    int  // truncate captured lines longer than this, 0 disables
+	VerifyChecksum   bool // verify uploads by comparing sha256 sums
+
+	RemoteTmpDir    string        // /tmp if empty
+	RemoteTmpPrefix string        // boomerang if empty
+	GC              bool          // remove stale remote temp files instead of running commands
+	GCMinAge        time.Duration // only temp files not modified for this long are stale
+	LogToHostSyslog bool          // record what was run in each machine's syslog
+	Operator        string        // recorded in syslog, the local user if empty
+
+	StreamOutput bool         // write command output live, prefixed by hostname
+	StreamWriter io.Writer    // where live output is written, os.Stderr if nil
+	Logger       *slog.Logger // progress per machine and command, discarded if nil
+
+	DownloadDir string // downloads are written to <DownloadDir>/<hostname>, raw if empty
+	OutputOrder string // hostname, inventory or completion, order of machines returned, hostname if empty
+
+	// Recorded as is in the metadata. RunID, a new UUID if empty, also names remote temp files.
+	RunID    string
+	Type     string
+	TypeFrom string // optional, Extras key to derive Type from
+	Profile  string
+	Labels   map[string]string
+
+	// OnMachine, if set, is called with each machine as it completes, one at a time, e.g. to
+	// write results as they come in.
+	OnMachine func(Machine)
+}
+
+// Auth is how machines are authenticated. Methods are tried in order; with several, a method
+// missing what it needs, e.g. a password, is skipped with a warning, a single method must be usable.
+type Auth struct {
+	Methods     []string // key, cert, agent or password
+	PrivateKey  string   // key and cert, with KeyDir only a fallback for key
+	Certificate string   // cert, defaults to <PrivateKey>-cert.pub
+	KeyDir      string   // optional, per-machine keys named by hostname, or extras key_name
+	Password    string
+	Agent       string // env variable holding the agent socket, SSH_AUTH_SOCK if empty
+}
+
+// Upload is a file copied to every machine before its commands run.
+type Upload struct {
+	Src       string // local file
+	Dest      string // remote directory, the file keeps its name
+	Overwrite bool   // replace a file already at Dest
+}
+
+// Command is a command run on each machine, a command run locally, or an upload or download.
+type Command struct {
+	Name    string
+	Command string
+	Sudo    bool
+	Timeout time.Duration // overrides CommandTimeout when non-zero
+	Env     map[string]string
+	Dir     string   // run from this directory
+	Shell   []string // shell and flags the command is passed to, e.g. bash -lc, run as-is if empty
+
+	StopOnFailure    *bool // overrides the global StopOnFailure when set
+	CombineOutput    *bool // overrides the global CombineOutput when set
+	MeasureResources *bool // overrides the global MeasureResources when set
+	FailOnStderr     *bool // overrides the global FailOnStderr when set
+
+	Retries     int           // times a failed command is run again
+	RetryWait   time.Duration // wait between retries
+	RetryOnExit []int         // exit codes retried, any failure if empty
+
+	Transfer *FileTransfer // set for upload and download commands
+
+	Local      bool // run on this machine instead, see executeLocal
+	LocalShell bool // run a local command with sh -c rather than splitting it into arguments
+}
+
+// CommandFromArgs returns a command named name running args. Each arg is quoted as needed so
+// the remote shell sees the same words, e.g. echo "a  b". It's run with sudo if args[0] is sudo.
+func CommandFromArgs(name string, args ...string) Command {
+	words := make([]string, len(args))
+	for i, a := range args {
+		words[i] = a
+		if !shellWord.MatchString(a) {
+			words[i] = shellQuote(a)
+		}
+	}
+	// e.g. sudo systemctl restart nginx, there's no other way to set sudo for it
+	return Command{Name: name, Command: strings.Join(words, " "), Sudo: len(args) > 0 && args[0] == "sudo"}
+}
+
+// shellWord matches a shell or flag that's passed through the machine's login shell unquoted.
+var shellWord = regexp.MustCompile(`^[A-Za-z0-9_./+-]+$`)
+
+// Validate reports whether c can run, e.g. that options only applying to commands run on the
+// machine aren't set on a local command. Run validates every command.
+func (c Command) Validate() error {
+	name := c.Name
+	if name == "" {
+		return errors.Errorf("command [%v] must have a name", c.Command)
+	}
+	if c.Transfer == nil && c.Command == "" {
+		return errors.Errorf("command [%v] is not a string", name)
+	}
+	if c.Transfer != nil {
+		if err := c.Transfer.validate(name); err != nil {
+			return err
+		}
+	}
+	if c.Timeout < 0 {
+		return errors.Errorf("command [%v] timeout must be a positive number of seconds", name)
+	}
+	if c.Retries < 0 {
+		return errors.Errorf("command [%v] retries must be a positive number", name)
+	}
+	if c.RetryWait < 0 {
+		return errors.Errorf("command [%v] retryWait must be a positive number of seconds", name)
+	}
+	if len(c.Shell) > 0 {
+		if err := checkShell(c.Shell); err != nil {
+			return errors.Wrapf(err, "command [%v]", name)
+		}
+	}
+	if len(c.Shell) > 0 && (c.Local || c.Transfer != nil) {
+		return errors.Errorf("command [%v] shell only applies to commands run on the machine", name)
+	}
+	if c.Local && c.Transfer != nil {
+		return errors.Errorf("command [%v] an upload or download can't be local", name)
+	}
+	if c.LocalShell && !c.Local {
+		return errors.Errorf("command [%v] localShell requires local: true", name)
+	}
+	if c.MeasureResources != nil && *c.MeasureResources && (c.Local || c.Transfer != nil) {
+		return errors.Errorf("command [%v] measureResources only applies to commands run on the machine", name)
+	}
+	if c.Sudo && (c.Local || c.Transfer != nil) {
+		return errors.Errorf("command [%v] sudo only applies to commands run on the machine", name)
+	}
+	if c.Local && !c.LocalShell {
+		if _, err := splitArgs(c.Command); err != nil {
+			return errors.Wrapf(err, "command [%v]", name)
+		}
+	}
+	return nil
+}
+
+// checkShell checks a command's shell, a shell and its flags ending with the one that takes the
+// command, e.g. bash -lc or sh -c. They're passed through the machine's login shell unquoted.
+func checkShell(shell []string) error {
+	s := strings.Join(shell, " ")
+	for _, f := range shell {
+		if !shellWord.MatchString(f) {
+			return errors.Errorf("unsupported shell: %v\n\tmust use none or a shell and its flags, e.g. bash -lc", s)
+		}
+	}
+	last := shell[len(shell)-1]
+	if len(shell) < 2 || !strings.HasPrefix(last, "-") || !strings.HasSuffix(last, "c") {
+		return errors.Errorf("unsupported shell: %v\n\tthe last flag must take the command, e.g. bash -lc or sh -c", s)
+	}
+	return nil
+}
+
+// runState is the Options of a single Run, with defaults filled in and what's derived from them,
+// e.g. parsed keys. Once built no fields are mutable.
+type runState struct {
+	Options
+
+	auth     []authSource     // Auth.Methods, tried in order
+	jumpAuth []ssh.AuthMethod // JumpAuth's, the machine's auth if nil
+	keys     *keyCache        // lazily parsed signers for Auth.KeyDir and machines' own keys
+	commands []Command        // Commands, then CLI, with unique names
+	cli      bool             // the last of commands is CLI
+	finally  []Command
+	uploads  []upload
+}
+
+type upload struct {
+	src       string
+	dest      string
+	filename  string
+	content   []byte
+	checksum  [sha256.Size]byte
+	overwrite bool
+}
+
+// defaultDownloadDir is where downloads are written when DownloadDir is empty.
+const defaultDownloadDir = "raw"
+
+// newState checks opts and returns the state of a run with them, reading uploads and keys.
+func newState(opts Options) (*runState, error) {
+	st := &runState{Options: opts, keys: newKeyCache()}
+
+	if st.StreamWriter == nil {
+		st.StreamWriter = os.Stderr
+	}
+	if st.RunID == "" {
+		st.RunID = NewRunID()
+	}
+	if st.Operator == "" {
+		st.Operator = currentOperator()
+	}
+	if st.RemoteTmpDir == "" {
+		st.RemoteTmpDir = "/tmp"
+	}
+	if st.RemoteTmpPrefix == "" {
+		st.RemoteTmpPrefix = "boomerang"
+	}
+	if st.DownloadDir == "" {
+		st.DownloadDir = defaultDownloadDir
+	}
+	if st.Auth.Agent == "" {
+		st.Auth.Agent = "SSH_AUTH_SOCK"
+	}
+
+	switch st.HostKeyMode {
+	case "":
+		st.HostKeyMode = HostKeyStrict
+	case HostKeyStrict, HostKeyInsecure, HostKeyTOFU:
+	default:
+		return nil, errors.Errorf("unsupported HostKeyMode: %v\n\tmust use strict, insecure or tofu", st.HostKeyMode)
+	}
+
+	switch st.OutputOrder {
+	case "":
+		st.OutputOrder = OutputOrderHostname
+	case OutputOrderHostname, OutputOrderInventory, OutputOrderCompletion:
+	default:
+		return nil, errors.Errorf("unsupported OutputOrder: %v\n\tmust use hostname, inventory or completion", st.OutputOrder)
+	}
+
+	switch st.Backoff.Policy {
+	case "", "fixed", "exponential":
+	default:
+		return nil, errors.Errorf("unsupported Backoff policy: %v\n\tmust use fixed or exponential", st.Backoff.Policy)
+	}
+
+	if _, err := parseCanary(st.Canary); err != nil {
+		return nil, err
+	}
+	if st.CanaryMaxFailure < 0 || st.CanaryMaxFailure > 100 {
+		return nil, errors.New("CanaryMaxFailure must be a percentage between 0 and 100")
+	}
+	if st.FailFastThreshold < 0 || st.FailFastThreshold > 100 {
+		return nil, errors.New("FailFastThreshold must be a percentage between 0 and 100")
+	}
+	if st.GCMinAge < 0 {
+		return nil, errors.New("GCMinAge must not be negative")
+	}
+
+	if err := st.setCommands(); err != nil {
+		return nil, err
+	}
+
+	for _, u := range st.Uploads {
+		by, err := ioutil.ReadFile(u.Src)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read upload")
+		}
+		st.uploads = append(st.uploads, upload{
+			src:       u.Src,
+			dest:      u.Dest,
+			filename:  filepath.Base(u.Src),
+			content:   by,
+			checksum:  sha256.Sum256(by),
+			overwrite: u.Overwrite,
+		})
+	}
+
+	auth, err := authSources(st.Auth)
+	if err != nil {
+		return nil, err
+	}
+	st.auth = auth
+
+	if st.JumpHost != "" {
+		if _, err := parseJumpHost(st.JumpHost); err != nil {
+			return nil, err
+		}
+	}
+	if st.JumpAuth != nil {
+		a := *st.JumpAuth
+		if a.Agent == "" {
+			a.Agent = st.Auth.Agent
+		}
+		sources, err := authSources(a)
+		if err != nil {
+			return nil, errors.Wrap(err, "JumpAuth")
+		}
+		st.jumpAuth = authMethods(sources, nil)
+	}
+
+	return st, nil
+}
+
+// setCommands checks the commands and sets the list run on every machine: Commands, then CLI.
+func (st *runState) setCommands() error {
+	st.commands = append([]Command(nil), st.Commands...)
+	if st.CLI != nil {
+		// the cli command is named like any other, so it may be renamed, e.g. cli-2
+		st.commands = append(st.commands, *st.CLI)
+		st.cli = true
+	}
+	st.finally = append([]Command(nil), st.Finally...)
+
+	for _, c := range append(st.commands[:len(st.commands):len(st.commands)], st.finally...) {
+		if err := c.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if st.ParallelCommands {
+		// parallel commands have no order, so none can depend on another having run
+		if st.StopOnFailure {
+			return errors.New("StopOnFailure cannot be used with ParallelCommands")
+		}
+		for _, c := range st.commands {
+			if c.stops(st) {
+				return errors.Errorf("command [%v]: stopOnFailure cannot be used with parallelCommands", c.Name)
+			}
+			if c.usesResults(st) {
+				return errors.Errorf("command [%v]: a template using .Results cannot be used with parallelCommands", c.Name)
+			}
+		}
+	}
+
+	switch st.DupCommandNames {
+	case "":
+		st.DupCommandNames = "suffix"
+	case "suffix", "strict":
+	default:
+		return errors.Errorf("unsupported DupCommandNames: %v\n\tmust use suffix or strict", st.DupCommandNames)
+	}
+	if err := uniqueCommandNames(st.DupCommandNames, true, st.commands, st.finally); err != nil {
+		return err
+	}
+
+	for _, c := range append(st.commands[:len(st.commands):len(st.commands)], st.finally...) {
+		if err := c.checkStderr(st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewRunID returns a random identifier for a single boomerang run, a version 4 UUID.
+func NewRunID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// still unique enough to correlate runs, though not a UUID
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	h := hex.EncodeToString(b)
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// remoteTempFile returns the path of a remote temp file for name. All remote temp files share
+// the <remoteTmpDir>/<remoteTmpPrefix>-<runID>- prefix so orphans can be found with --gc.
+func (s *runState) remoteTempFile(name string) string {
+	return path.Join(s.RemoteTmpDir, s.RemoteTmpPrefix+"-"+s.RunID+"-"+name)
+}
+
+// tempFileRunID matches the start of a remote temp file name after its prefix, a run id from
+// NewRunID and the -, see remoteTempFile.
+var tempFileRunID = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}-.`)
+
+// isRemoteTempFile reports whether name, a file in remoteTmpDir, is named like a remote temp
+// file, <remoteTmpPrefix>-<uuid>-<name>, so other files sharing the prefix, e.g. boomerang-notes.txt,
+// are never removed with --gc. Temp files of a run with a RunID that isn't a UUID aren't matched.
+func (s *runState) isRemoteTempFile(name string) bool {
+	rest, ok := strings.CutPrefix(name, s.RemoteTmpPrefix+"-")
+	return ok && tempFileRunID.MatchString(rest)
+}
+
+// currentOperator returns the name of the local user running boomerang.
+func currentOperator() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// parseCanary parses the canary option, either a count or a percentage of machines, into a func
+// returning the canary size for an inventory of n machines.
+func parseCanary(c string) (func(n int) int, error) {
+	if c == "" {
+		return func(int) int { return 0 }, nil
+	}
+
+	if strings.HasSuffix(c, "%") {
+		p, err := strconv.ParseFloat(strings.TrimSuffix(c, "%"), 64)
+		if err != nil || p <= 0 || p > 100 {
+			return nil, errors.Errorf("invalid canary percentage: %s", c)
+		}
+		return func(n int) int {
+			size := int(math.Ceil(float64(n) * p / 100))
+			if size > n {
+				return n
+			}
+			return size
+		}, nil
+	}
+
+	i, err := strconv.Atoi(c)
+	if err != nil || i < 0 {
+		return nil, errors.Errorf("invalid canary count: %s", c)
+	}
+	return func(n int) int {
+		if i > n {
+			return n
+		}
+		return i
+	}, nil
+}
+
+// canarySize returns the number of machines, out of n, to run as a canary. 0 disables the canary.
+func (s *runState) canarySize(n int) int {
+	size, err := parseCanary(s.Canary)
+	if err != nil {
+		return 0
+	}
+	return size(n)
+}
+
+// uniqueCommandNames makes command names unique across lists, e.g. commands and finally, as a
+// name identifies a command's stream in the output and its results in templates. A repeated name
+// is an error with mode=strict, and with mode=suffix it's numbered in order, e.g. uptime, uptime-2,
+// logging a warning if warn is set.
+func uniqueCommandNames(mode string, warn bool, lists ...[]Command) error {
+	seen := make(map[string]bool)
+	for _, cs := range lists {
+		for i := range cs {
+			name := cs[i].Name
+			if seen[name] {
+				if mode == "strict" {
+					return errors.Errorf("command [%v] is listed more than once, names must be unique", name)
+				}
+				n := 2
+				for seen[fmt.Sprintf("%s-%d", name, n)] {
+					n++
+				}
+				cs[i].Name = fmt.Sprintf("%s-%d", name, n)
+				if warn {
+					log.Printf("Warning: command [%v] is listed more than once, renamed [%v]\n", name, cs[i].Name)
+				}
+			}
+			seen[cs[i].Name] = true
+		}
+	}
+	return nil
+}
+
+// hostCommands returns the commands run on s: the global commands, unless it has its own, which
+// replace them or, with AppendCommands, run after them. The CLI command runs last either way.
+func (st *runState) hostCommands(s SSHInfo) ([]Command, error) {
+	if s.Commands == nil {
+		return st.commands, nil
+	}
+
+	cs := make([]Command, 0, len(s.Commands))
+	for _, c := range s.Commands {
+		if err := c.Validate(); err != nil {
+			return nil, errors.Wrap(err, "machine commands")
+		}
+		if st.ParallelCommands && c.stops(st) {
+			return nil, errors.Errorf("machine command [%v]: stopOnFailure cannot be used with parallelCommands", c.Name)
+		}
+		if st.ParallelCommands && c.usesResults(st) {
+			return nil, errors.Errorf("machine command [%v]: a template using .Results cannot be used with parallelCommands", c.Name)
+		}
+		if err := c.checkStderr(st); err != nil {
+			return nil, errors.Wrap(err, "machine commands")
+		}
+		cs = append(cs, c)
+	}
+
+	global := st.commands[:len(st.commands):len(st.commands)]
+	var cli []Command
+	if st.cli {
+		global, cli = global[:len(global)-1:len(global)-1], global[len(global)-1:]
+	}
+	if s.AppendCommands {
+		cs = append(global, cs...)
+	}
+	cs = append(cs, cli...)
+
+	// finally commands keep their names, a machine's own command is renamed instead. Renames
+	// aren't logged, they'd be for every machine; --dry-run lists each machine's commands.
+	finally := append([]Command(nil), st.finally...)
+	if err := uniqueCommandNames(st.DupCommandNames, false, finally, cs); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// usesResults reports whether c is rendered as a template that uses the results of earlier
+// commands. Local commands are always rendered, others with templateCommands.
+func (c Command) usesResults(st *runState) bool {
+	if c.Transfer != nil || (!c.Local && !st.TemplateCommands) {
+		return false
+	}
+	return usesResults(c.Command)
+}
+
+// checkStderr rejects options that need c's stderr kept apart from its stdout. combineOutput
+// records them together, and a sudo command is run on a PTY when sudoPassword is set, which
+// merges its stderr into stdout.
+func (c Command) checkStderr(st *runState) error {
+	if c.Transfer != nil {
+		return nil
+	}
+	if c.combines(st) && c.failsOnStderr(st) {
+		return errors.Errorf("command [%v]: failOnStderr cannot be used with combineOutput, stderr is recorded with stdout", c.Name)
+	}
+	if !c.Sudo || st.SudoPassword == "" {
+		return nil
+	}
+	switch {
+	case c.measures(st):
+		return errors.Errorf("command [%v]: measureResources cannot be used with sudo when sudoPassword is set, stderr is merged into stdout", c.Name)
+	case c.failsOnStderr(st):
+		return errors.Errorf("command [%v]: failOnStderr cannot be used with sudo when sudoPassword is set, stderr is merged into stdout", c.Name)
+	}
+	return nil
+}
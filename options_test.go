@@ -0,0 +1,116 @@
+package boomerang
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestNewRunID(t *testing.T) {
+	// a version 4, RFC 4122 variant UUID
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := NewRunID()
+		if !uuid.MatchString(id) {
+			t.Fatalf("NewRunID() = %q, want a version 4 UUID", id)
+		}
+		if seen[id] {
+			t.Fatalf("NewRunID() returned %q twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestCheckShell(t *testing.T) {
+	tests := []struct {
+		shell   []string
+		wantErr bool
+	}{
+		{[]string{"bash", "-lc"}, false},
+		{[]string{"sh", "-c"}, false},
+		{[]string{"/usr/bin/env", "bash", "-e", "-c"}, false},
+		{[]string{"bash"}, true},
+		{[]string{"bash", "-l"}, true},
+		{[]string{"bash", "c"}, true},
+		{[]string{"bash;", "-c"}, true},
+		{[]string{"bash", "-c", "$(id)"}, true},
+	}
+	for _, tt := range tests {
+		if err := checkShell(tt.shell); (err != nil) != tt.wantErr {
+			t.Errorf("%q: error %v, want error: %v", tt.shell, err, tt.wantErr)
+		}
+	}
+}
+
+func TestUniqueCommandNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		lists   [][]string // command names of each list
+		want    [][]string // names after
+		wantErr bool
+	}{
+		{"unique", "strict", [][]string{{"up", "df"}, {"ps"}}, [][]string{{"up", "df"}, {"ps"}}, false},
+		{"numbered", "suffix", [][]string{{"up", "df", "up", "up"}}, [][]string{{"up", "df", "up-2", "up-3"}}, false},
+		{"across lists", "suffix", [][]string{{"up"}, {"up"}}, [][]string{{"up"}, {"up-2"}}, false},
+		{"skips taken names", "suffix", [][]string{{"up-2", "up", "up"}}, [][]string{{"up-2", "up", "up-3"}}, false},
+		{"strict", "strict", [][]string{{"up"}, {"df", "up"}}, nil, true},
+	}
+	for _, tt := range tests {
+		var lists [][]Command
+		for _, names := range tt.lists {
+			var cs []Command
+			for _, n := range names {
+				cs = append(cs, Command{Name: n})
+			}
+			lists = append(lists, cs)
+		}
+		err := uniqueCommandNames(tt.mode, false, lists...)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error: %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		var got [][]string
+		for _, cs := range lists {
+			var names []string
+			for _, c := range cs {
+				names = append(names, c.Name)
+			}
+			got = append(got, names)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIsRemoteTempFile(t *testing.T) {
+	st := &runState{Options: Options{RemoteTmpPrefix: "boomerang"}}
+	id := NewRunID()
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"boomerang-" + id + "-run.sh", true},
+		{"boomerang-" + id + "-push-run.sh", true},
+		{"boomerang-notes.txt", false},
+		{"boomerang-" + id, false},
+		{"boomerang-" + id + "-", false},
+		{"boomerang-" + strings.ToUpper(id) + "-run.sh", false},
+		{"boomerang-1700000000-run.sh", false},
+		{"other-" + id + "-run.sh", false},
+		{"boomerangx-" + id + "-run.sh", false},
+	}
+	for _, tt := range tests {
+		if got := st.isRemoteTempFile(tt.name); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
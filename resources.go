@@ -0,0 +1,107 @@
+package boomerang
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Resources records the resource usage of a command, as reported by /usr/bin/time.
+type Resources struct {
+	MaxRSSKB    int64   `json:"max_rss_kb"`
+	WallSeconds float64 `json:"wall_seconds"`
+	UserSeconds float64 `json:"user_seconds"`
+	SysSeconds  float64 `json:"sys_seconds"`
+}
+
+// timeMissing is written to stderr by the time wrapper when /usr/bin/time is not present.
+const timeMissing = "boomerang: /usr/bin/time not found"
+
+// wrapTime wraps cmd with /usr/bin/time, using -v for GNU time and falling back to -l for BSD time.
+// If /usr/bin/time is not present the command still runs, but timeMissing is written to stderr.
+func wrapTime(cmd string) string {
+	q := shellQuote(cmd)
+	return fmt.Sprintf("if [ -x /usr/bin/time ]; then "+
+		"if /usr/bin/time -v true >/dev/null 2>&1; then /usr/bin/time -v sh -c %[1]s; else /usr/bin/time -l sh -c %[1]s; fi; "+
+		"else echo %[2]s >&2; sh -c %[1]s; fi", q, shellQuote(timeMissing))
+}
+
+// shellQuote single quotes s for use as a single POSIX shell word.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+var (
+	gnuTimeStart = regexp.MustCompile(`(?m)^(Command exited with non-zero status \d+\n)?\tCommand being timed: `)
+	bsdTimeStart = regexp.MustCompile(`(?m)^\s*([\d.]+) real\s+([\d.]+) user\s+([\d.]+) sys$`)
+	gnuTimeField = regexp.MustCompile(`(?m)^\t(.+): (.+)$`)
+	bsdMaxRSS    = regexp.MustCompile(`(?m)^\s*(\d+)\s+maximum resident set size$`)
+)
+
+// parseTime splits the output of /usr/bin/time from a command's stderr. It returns the remaining
+// stderr, the parsed resources, and an error if the usage could not be measured.
+//
+// Both GNU (time -v) and BSD (time -l) formats are understood.
+func parseTime(stderr string) (string, *Resources, error) {
+	if i := strings.Index(stderr, timeMissing); i >= 0 {
+		return stderr[:i] + stderr[i+len(timeMissing):], nil, errors.New("resource measurement skipped: /usr/bin/time not present")
+	}
+
+	if loc := gnuTimeStart.FindStringIndex(stderr); loc != nil {
+		return stderr[:loc[0]], parseGNUTime(stderr[loc[0]:]), nil
+	}
+
+	if loc := bsdTimeStart.FindStringIndex(stderr); loc != nil {
+		return stderr[:loc[0]], parseBSDTime(stderr[loc[0]:]), nil
+	}
+
+	return stderr, nil, errors.New("resource measurement failed: could not find /usr/bin/time output")
+}
+
+func parseGNUTime(s string) *Resources {
+	r := &Resources{}
+	for _, f := range gnuTimeField.FindAllStringSubmatch(s, -1) {
+		switch {
+		case f[1] == "Maximum resident set size (kbytes)":
+			r.MaxRSSKB, _ = strconv.ParseInt(f[2], 10, 64)
+		case f[1] == "User time (seconds)":
+			r.UserSeconds, _ = strconv.ParseFloat(f[2], 64)
+		case f[1] == "System time (seconds)":
+			r.SysSeconds, _ = strconv.ParseFloat(f[2], 64)
+		case strings.HasPrefix(f[1], "Elapsed (wall clock) time"):
+			r.WallSeconds = parseClock(f[2])
+		}
+	}
+	return r
+}
+
+func parseBSDTime(s string) *Resources {
+	r := &Resources{}
+	if m := bsdTimeStart.FindStringSubmatch(s); m != nil {
+		r.WallSeconds, _ = strconv.ParseFloat(m[1], 64)
+		r.UserSeconds, _ = strconv.ParseFloat(m[2], 64)
+		r.SysSeconds, _ = strconv.ParseFloat(m[3], 64)
+	}
+	if m := bsdMaxRSS.FindStringSubmatch(s); m != nil {
+		// macOS reports the maximum resident set size in bytes
+		n, _ := strconv.ParseInt(m[1], 10, 64)
+		r.MaxRSSKB = n / 1024
+	}
+	return r
+}
+
+// parseClock parses GNU time's elapsed format, h:mm:ss or m:ss.ss, into seconds.
+func parseClock(s string) float64 {
+	var secs float64
+	for _, p := range strings.Split(strings.TrimSpace(s), ":") {
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil {
+			return 0
+		}
+		secs = secs*60 + v
+	}
+	return secs
+}
@@ -0,0 +1,84 @@
+package boomerang
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sudoPrompt matches sudo's password prompt, "[sudo] password for user: ", at the end of the
+// output read so far. Other prompts, e.g. su's or mysql -p's "Password:", are never answered.
+var sudoPrompt = regexp.MustCompile(`\[sudo\] password for [^:\n]*: ?$`)
+
+// sudoWriter answers sudo password prompts in a command's output by writing the password to the
+// session's stdin. Prompts are stripped from the output written to w, and PTY line endings are
+// normalized to \n.
+//
+// Output is held until a line is complete, as a prompt never ends with a newline.
+type sudoWriter struct {
+	w        io.Writer
+	stdin    io.Writer
+	password string
+	line     []byte // current incomplete line
+	answered bool   // a prompt was just answered, the newline sudo prints after it is dropped
+}
+
+func (s *sudoWriter) Write(p []byte) (int, error) {
+	s.line = append(s.line, p...)
+
+	if s.answered && len(s.line) > 0 {
+		s.line = bytes.TrimPrefix(bytes.TrimPrefix(s.line, []byte("\r")), []byte("\n"))
+		s.answered = len(s.line) == 0
+	}
+
+	if loc := sudoPrompt.FindIndex(s.line); loc != nil {
+		s.line = s.line[:loc[0]]
+		s.answered = true
+		if _, err := io.WriteString(s.stdin, s.password+"\n"); err != nil {
+			return 0, err
+		}
+	}
+
+	if i := bytes.LastIndexByte(s.line, '\n'); i >= 0 {
+		if _, err := s.w.Write(bytes.Replace(s.line[:i+1], []byte("\r\n"), []byte("\n"), -1)); err != nil {
+			return 0, err
+		}
+		s.line = append(s.line[:0], s.line[i+1:]...)
+	}
+	return len(p), nil
+}
+
+// flush writes any trailing incomplete line.
+func (s *sudoWriter) flush() error {
+	if len(s.line) == 0 {
+		return nil
+	}
+	_, err := s.w.Write(bytes.Replace(s.line, []byte("\r\n"), []byte("\n"), -1))
+	s.line = nil
+	return err
+}
+
+// sudoSession prepares session to answer sudo password prompts. A PTY is requested, as sudo
+// only prompts on a terminal, so stderr is merged into stdout. Commands that don't prompt,
+// e.g. NOPASSWD, run as usual.
+func sudoSession(session *ssh.Session, password string) (*sudoWriter, error) {
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          0, // don't echo the password back into the output
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if err := session.RequestPty("xterm", 80, 200, modes); err != nil {
+		return nil, err
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	sw := &sudoWriter{w: session.Stdout, stdin: stdin, password: password}
+	session.Stdout = sw
+	return sw, nil
+}
@@ -0,0 +1,38 @@
+package boomerang
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSudoWriter(t *testing.T) {
+	tests := []struct {
+		name      string
+		writes    []string
+		want      string
+		wantStdin string
+	}{
+		{"no prompt", []string{"a\r\nb\r\n"}, "a\nb\n", ""},
+		{"prompt answered", []string{"[sudo] password for admin: ", "\r\nok\r\n"}, "ok\n", "secret\n"},
+		{"prompt split across writes", []string{"[sudo] pass", "word for admin: ", "\nok\n"}, "ok\n", "secret\n"},
+		{"output before prompt", []string{"starting\n[sudo] password for admin: ", "\r\ndone\n"}, "starting\ndone\n", "secret\n"},
+		{"other prompts ignored", []string{"Password: ", "\n"}, "Password: \n", ""},
+		{"incomplete line flushed", []string{"a\nb"}, "a\nb", ""},
+		{"prompt repeated", []string{"[sudo] password for admin: ", "\nSorry, try again.\n[sudo] password for admin: ", "\n"}, "Sorry, try again.\n", "secret\nsecret\n"},
+	}
+	for _, tt := range tests {
+		var out, stdin bytes.Buffer
+		s := &sudoWriter{w: &out, stdin: &stdin, password: "secret"}
+		for _, w := range tt.writes {
+			if n, err := s.Write([]byte(w)); err != nil || n != len(w) {
+				t.Fatalf("%s: Write(%q) = %d, %v, want %d", tt.name, w, n, err, len(w))
+			}
+		}
+		if err := s.flush(); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != tt.want || stdin.String() != tt.wantStdin {
+			t.Errorf("%s: output %q stdin %q, want %q and %q", tt.name, out.String(), stdin.String(), tt.want, tt.wantStdin)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package boomerang
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+)
+
+// Transfer records a file copied by an upload or download command.
+type Transfer struct {
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+	Bytes  int64  `json:"bytes"`
+
+	// File is the downloaded file, Local as written, empty for an upload. It isn't written out,
+	// so AnonymizeHosts rewrites Local but not File.
+	File string `json:"-"`
+}
+
+// FileTransfer is an upload or download command, run over sftp instead of a session. A
+// download's Local path is relative to the machine's DownloadDir.
+type FileTransfer struct {
+	Download bool
+	Local    string
+	Remote   string
+}
+
+// validate checks the paths of t, the transfer of command name. A download's local path must
+// be relative to raw/<hostname>/.
+func (t *FileTransfer) validate(name string) error {
+	if t.Remote == "" {
+		return errors.Errorf("command [%v] is missing a remote path", name)
+	}
+	if t.Local == "" {
+		return errors.Errorf("command [%v] is missing a local path", name)
+	}
+	if !t.Download {
+		return nil
+	}
+	local := filepath.Clean(t.Local)
+	if filepath.IsAbs(local) || local == ".." || strings.HasPrefix(local, ".."+string(filepath.Separator)) {
+		return errors.Errorf("command [%v] download local path [%v] must be relative to raw/<hostname>", name, t.Local)
+	}
+	return nil
+}
+
+// downloadDirs returns a copy of inventory with each machine's DownloadDir set, unless it's set
+// already, to <dir>/<hostname> with the hostname made safe for a path, e.g. an IPv6 address's colons.
+// Machines sharing a hostname, e.g. on different ports, are numbered in inventory order, e.g.
+// raw/web1_2, as cmd/boomerang numbers split output files.
+func downloadDirs(inventory Inventory, dir string) Inventory {
+	out := make(Inventory, len(inventory))
+	used := make(map[string]bool)
+	for i, s := range inventory {
+		if s.DownloadDir != "" {
+			out[i] = s
+			continue
+		}
+		base := SafeFileName(s.HostName)
+		name := base
+		for n := 2; used[name]; n++ {
+			name = fmt.Sprintf("%s_%d", base, n)
+		}
+		used[name] = true
+		s.DownloadDir = filepath.Join(dir, name)
+		out[i] = s
+	}
+	return out
+}
+
+// executeTransfer runs an upload or download command over sfc, recording the resolved paths
+// and bytes copied on sd, named for the command.
+func executeTransfer(sfc *sftp.Client, dir string, t *FileTransfer, st *runState, sd *Stream) {
+	var (
+		tr  *Transfer
+		err error
+	)
+	if t.Download {
+		tr, err = download(sfc, dir, t)
+	} else {
+		tr, err = uploadFile(sfc, sd.Name, t, st)
+	}
+	sd.Transfer = tr
+
+	if err != nil {
+		sd.StreamErrors = append(sd.StreamErrors, err.Error())
+		sd.ExitCode = -1
+		return
+	}
+	sd.Stdout = fmt.Sprintf("%d bytes copied", tr.Bytes)
+}
+
+// uploadFile copies a local file to the remote machine for command name, preserving its mode
+// bits. As with uploads, content is written to a remote temp file and then moved into place. The
+// temp file is named for the command too, as with parallelCommands uploads of files sharing a
+// name, e.g. a/run.sh and b/run.sh, run at once.
+func uploadFile(sfc *sftp.Client, name string, t *FileTransfer, st *runState) (*Transfer, error) {
+	tr := &Transfer{Local: t.Local, Remote: t.Remote}
+
+	src, err := os.Open(t.Local)
+	if err != nil {
+		return tr, errors.Wrap(err, "failed to open local file")
+	}
+	defer src.Close()
+
+	fi, err := src.Stat()
+	if err != nil {
+		return tr, errors.Wrap(err, "failed to stat local file")
+	}
+
+	tmp := st.remoteTempFile(SafeFileName(name) + "-" + filepath.Base(t.Local))
+	dst, err := sfc.Create(tmp)
+	if err != nil {
+		return tr, errors.Wrapf(err, "failed to create %v on remote server", tmp)
+	}
+
+	tr.Bytes, err = io.Copy(dst, src)
+	if err != nil {
+		dst.Close()
+		sfc.Remove(tmp)
+		return tr, errors.Wrap(err, "failed writing content to remote file")
+	}
+	dst.Close()
+
+	if err := moveRemote(sfc, tmp, t.Remote); err != nil {
+		sfc.Remove(tmp)
+		return tr, errors.Wrapf(err, "failed moving %v to %v on remote server", tmp, t.Remote)
+	}
+
+	if err := sfc.Chmod(t.Remote, fi.Mode().Perm()); err != nil {
+		return tr, errors.Wrapf(err, "failed to set mode %v on %v", fi.Mode().Perm(), t.Remote)
+	}
+
+	return tr, nil
+}
+
+// download copies a remote file to <dir>/<local>. A partially written file is removed.
+func download(sfc *sftp.Client, dir string, t *FileTransfer) (*Transfer, error) {
+	local := filepath.Join(dir, t.Local)
+	tr := &Transfer{Local: local, Remote: t.Remote, File: local}
+
+	src, err := sfc.Open(t.Remote)
+	if err != nil {
+		return tr, errors.Wrap(err, "failed to open remote file")
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return tr, errors.Wrap(err, "failed to create local directory")
+	}
+
+	dst, err := os.Create(local)
+	if err != nil {
+		return tr, errors.Wrap(err, "failed to create local file")
+	}
+
+	tr.Bytes, err = io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(local)
+		return tr, errors.Wrap(err, "failed writing content to local file")
+	}
+
+	return tr, nil
+}
+
+// SafeFileName replaces characters in name that don't belong in a file name, e.g. the colons of
+// an IPv6 address, with _. Download directories are named with it.
+func SafeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+}
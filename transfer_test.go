@@ -0,0 +1,120 @@
+package boomerang
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUploadParallelSameName(t *testing.T) {
+	host, port := fakeSSHServer(t)
+	local, remote, tmp := t.TempDir(), t.TempDir(), t.TempDir()
+
+	// files sharing a name uploaded at once must not share a remote temp file
+	var cs []Command
+	want := make(map[string][]byte)
+	for _, dir := range []string{"a", "b", "c"} {
+		src := filepath.Join(local, dir, "run.sh")
+		content := bytes.Repeat([]byte(dir), 1<<20)
+		if err := os.MkdirAll(filepath.Dir(src), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(src, content, 0755); err != nil {
+			t.Fatal(err)
+		}
+		dst := filepath.Join(remote, dir+".sh")
+		want[dst] = content
+		cs = append(cs, Command{Name: "push_" + dir, Transfer: &FileTransfer{Local: src, Remote: dst}})
+	}
+
+	b, err := Run(context.Background(), Options{
+		Inventory:        Inventory{{HostName: host, Port: port, Username: "u"}},
+		Commands:         cs,
+		ParallelCommands: true,
+		RemoteTmpDir:     tmp,
+		Auth:             Auth{Methods: []string{"password"}, Password: "secret"},
+		HostKeyMode:      HostKeyInsecure,
+		DownloadDir:      t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := b.MachineData[0]
+	if !m.Connection {
+		t.Fatalf("machine did not connect: %v", m.ConnectionErrors)
+	}
+	for _, s := range m.StreamData {
+		if !s.Succeeded {
+			t.Errorf("%s did not succeed: %v", s.Name, s.StreamErrors)
+		}
+	}
+	for dst, content := range want {
+		got, err := os.ReadFile(dst)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("%s: got %d bytes starting %q, want %d bytes of %q", dst, len(got), got[:1], len(content), content[:1])
+		}
+	}
+	if left, _ := os.ReadDir(tmp); len(left) != 0 {
+		t.Errorf("temp files left behind: %v", left)
+	}
+}
+
+func TestGCTempFiles(t *testing.T) {
+	host, port := fakeSSHServer(t)
+	tmp := t.TempDir()
+
+	id := NewRunID()
+	old := time.Now().Add(-2 * time.Hour)
+	files := []struct {
+		name    string
+		old     bool
+		removed bool
+	}{
+		{"boomerang-" + id + "-run.sh", true, true},
+		{"boomerang-" + id + "-push-run.sh", true, true},
+		{"boomerang-" + id + "-new.sh", false, false}, // may be an upload in progress
+		{"boomerang-notes.txt", true, false},
+		{"other-" + id + "-run.sh", true, false},
+	}
+	for _, f := range files {
+		p := filepath.Join(tmp, f.name)
+		if err := os.WriteFile(p, []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if f.old {
+			if err := os.Chtimes(p, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	b, err := Run(context.Background(), Options{
+		Inventory:    Inventory{{HostName: host, Port: port, Username: "u"}},
+		GC:           true,
+		GCMinAge:     time.Hour,
+		RemoteTmpDir: tmp,
+		Auth:         Auth{Methods: []string{"password"}, Password: "secret"},
+		HostKeyMode:  HostKeyInsecure,
+		DownloadDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := b.MachineData[0].StreamData; len(s) != 1 || s[0].Name != "gc" || !s[0].Succeeded {
+		t.Fatalf("streams = %+v, want a gc stream that succeeded", s)
+	}
+	for _, f := range files {
+		_, err := os.Stat(filepath.Join(tmp, f.name))
+		if removed := os.IsNotExist(err); removed != f.removed {
+			t.Errorf("%s: removed %v, want %v", f.name, removed, f.removed)
+		}
+	}
+}